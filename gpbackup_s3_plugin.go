@@ -34,12 +34,12 @@ func main() {
 		},
 		{
 			Name:   "cleanup_plugin_for_backup",
-			Action: s3plugin.CleanupPlugin,
+			Action: s3plugin.CleanupPluginForBackup,
 			Before: buildBeforeFunc(3, 4),
 		},
 		{
 			Name:   "cleanup_plugin_for_restore",
-			Action: s3plugin.CleanupPlugin,
+			Action: s3plugin.CleanupPluginForRestore,
 			Before: buildBeforeFunc(3, 4),
 		},
 		{
@@ -105,6 +105,153 @@ func main() {
 			Name:   "list_directory",
 			Action: s3plugin.ListDirectory,
 			Before: buildBeforeFunc(1, 2),
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "format",
+					Value: s3plugin.TableFormat,
+					Usage: "output format: table, jsonl or csv",
+				},
+				cli.StringFlag{
+					Name:  "view",
+					Value: s3plugin.RecursiveView,
+					Usage: "recursive lists every object below the directory, directory lists only its immediate contents",
+				},
+				cli.BoolFlag{
+					Name:  "metadata",
+					Usage: "include the metadata of each object in jsonl and csv output, at the cost of one request per object",
+				},
+				cli.BoolFlag{
+					Name:  "tags",
+					Usage: "include the tags of each object in jsonl and csv output, at the cost of one request per object",
+				},
+			},
+		},
+		{
+			Name:   "list_backups",
+			Action: s3plugin.ListBackups,
+			Before: buildBeforeFunc(1),
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "format",
+					Value: s3plugin.TableFormat,
+					Usage: "output format: table, jsonl or csv",
+				},
+			},
+		},
+		{
+			Name:   "prune_backups",
+			Action: s3plugin.PruneBackups,
+			Before: buildBeforeFunc(1),
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "only report which backups would be deleted",
+				},
+				cli.StringFlag{
+					Name:  "format",
+					Value: s3plugin.TableFormat,
+					Usage: "output format: table, jsonl or csv",
+				},
+			},
+		},
+		{
+			Name:   "list_incomplete_uploads",
+			Action: s3plugin.ListIncompleteUploads,
+			Before: buildBeforeFunc(1),
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "format",
+					Value: s3plugin.TableFormat,
+					Usage: "output format: table, jsonl or csv",
+				},
+			},
+		},
+		{
+			Name:   "abort_incomplete_uploads",
+			Action: s3plugin.AbortIncompleteUploads,
+			Before: buildBeforeFunc(1, 2),
+		},
+		{
+			Name:   "cleanup_incomplete_uploads",
+			Action: s3plugin.CleanupIncompleteUploads,
+			Before: buildBeforeFunc(1),
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "only report which uploads would be aborted",
+				},
+				cli.StringFlag{
+					Name:  "older-than",
+					Usage: "abort uploads started longer ago than this duration instead of incomplete_upload_max_age",
+				},
+				cli.StringFlag{
+					Name:  "format",
+					Value: s3plugin.TableFormat,
+					Usage: "output format: table, jsonl or csv",
+				},
+			},
+		},
+		{
+			Name:   "verify_backup",
+			Action: s3plugin.VerifyBackup,
+			Before: buildBeforeFunc(2),
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "format",
+					Value: s3plugin.TableFormat,
+					Usage: "output format: table, jsonl or csv",
+				},
+			},
+		},
+		{
+			Name:   "verify_backup_data",
+			Action: s3plugin.VerifyBackupData,
+			Before: buildBeforeFunc(2),
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "concurrency",
+					Usage: "number of objects read at a time instead of restore_max_concurrent_requests",
+				},
+				cli.StringFlag{
+					Name:  "format",
+					Value: s3plugin.TableFormat,
+					Usage: "output format: table, jsonl or csv",
+				},
+			},
+		},
+		{
+			Name:   "thaw_backup",
+			Action: s3plugin.ThawBackup,
+			Before: buildBeforeFunc(2),
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "tier",
+					Value: s3plugin.DefaultThawTier,
+					Usage: "retrieval tier: Standard, Bulk or Expedited",
+				},
+				cli.IntFlag{
+					Name:  "days",
+					Value: s3plugin.DefaultThawDays,
+					Usage: "number of days the thawed copies are kept",
+				},
+				cli.StringFlag{
+					Name:  "format",
+					Value: s3plugin.TableFormat,
+					Usage: "output format: table, jsonl or csv",
+				},
+			},
+		},
+		{
+			Name:   "thaw_status",
+			Action: s3plugin.ThawStatus,
+			Before: buildBeforeFunc(2),
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "format",
+					Value: s3plugin.TableFormat,
+					Usage: "output format: table, jsonl or csv",
+				},
+			},
 		},
 	}
 
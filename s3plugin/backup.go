@@ -1,18 +1,17 @@
 package s3plugin
 
 import (
-	"bufio"
 	"fmt"
+	"hash"
+	"io"
 	"os"
 	"path/filepath"
 	"strconv"
 	"sync"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/greenplum-db/gp-common-go-libs/gplog"
+	"github.com/greenplum-db/gp-common-go-libs/operating"
 	"github.com/urfave/cli"
 )
 
@@ -21,10 +20,16 @@ func SetupPluginForBackup(c *cli.Context) error {
 	if scope != Master && scope != Coordinator && scope != SegmentHost {
 		return nil
 	}
-	config, sess, err := readConfigAndStartSession(c)
+	config, storage, err := readConfigAndOpenStorage(c)
 	if err != nil {
 		return err
 	}
+	if err = prepareHostCoordination(config); err != nil {
+		return err
+	}
+	if err = checkObjectLockEnabled(config, storage); err != nil {
+		return err
+	}
 	localBackupDir := c.Args().Get(1)
 	_, timestamp := filepath.Split(localBackupDir)
 	testFileName := fmt.Sprintf("gpbackup_%s_report", timestamp)
@@ -35,15 +40,20 @@ func SetupPluginForBackup(c *cli.Context) error {
 	if err != nil {
 		return err
 	}
-	_, _, err = uploadFile(sess, config, fileKey, file)
+	_, _, err = uploadFile(storage, config, fileKey, file)
 	return err
 }
 
 func BackupFile(c *cli.Context) error {
-	config, sess, err := readConfigAndStartSession(c)
+	config, storage, err := readConfigAndOpenStorage(c)
 	if err != nil {
 		return err
 	}
+	release, err := beginTransfers(config, storage, BackupTransfer, 1)
+	if err != nil {
+		return err
+	}
+	defer release()
 	fileName := c.Args().Get(1)
 	fileKey := GetS3Path(config.Options.Folder, fileName)
 	file, err := os.Open(fileName)
@@ -51,10 +61,11 @@ func BackupFile(c *cli.Context) error {
 	if err != nil {
 		return err
 	}
-	bytes, elapsed, err := uploadFile(sess, config, fileKey, file)
+	bytes, elapsed, err := uploadFile(storage, config, fileKey, file)
 	if err != nil {
 		return err
 	}
+	recordTransfer(config, BackupTransfer, fileKey, bytes, elapsed)
 
 	gplog.Info("Uploaded %d bytes for %s in %v", bytes, filepath.Base(fileKey),
 		elapsed.Round(time.Millisecond))
@@ -64,13 +75,18 @@ func BackupFile(c *cli.Context) error {
 func BackupDirectory(c *cli.Context) error {
 	start := time.Now()
 	totalBytes := int64(0)
-	config, sess, err := readConfigAndStartSession(c)
+	config, storage, err := readConfigAndOpenStorage(c)
 	if err != nil {
 		return err
 	}
+	release, err := beginTransfers(config, storage, BackupTransfer, 1)
+	if err != nil {
+		return err
+	}
+	defer release()
 	dirName := c.Args().Get(1)
 	gplog.Verbose("Restore Directory '%s' from S3", dirName)
-	gplog.Verbose("S3 Location = s3://%s/%s", config.Options.Bucket, dirName)
+	gplog.Verbose("S3 Location = %s", storage.URL(dirName))
 	gplog.Info("dirKey = %s\n", dirName)
 
 	// Populate a list of files to be backed up
@@ -89,13 +105,14 @@ func BackupDirectory(c *cli.Context) error {
 		if err != nil {
 			return err
 		}
-		bytes, elapsed, err := uploadFile(sess, config, fileName, file)
+		bytes, elapsed, err := uploadFile(storage, config, fileName, file)
 		_ = file.Close()
 		if err != nil {
 			return err
 		}
 
 		totalBytes += bytes
+		recordTransfer(config, BackupTransfer, fileName, bytes, elapsed)
 		gplog.Debug("Uploaded %d bytes for %s in %v", bytes,
 			filepath.Base(fileName), elapsed.Round(time.Millisecond))
 	}
@@ -109,7 +126,7 @@ func BackupDirectoryParallel(c *cli.Context) error {
 	start := time.Now()
 	totalBytes := int64(0)
 	parallel := 5
-	config, sess, err := readConfigAndStartSession(c)
+	config, storage, err := readConfigAndOpenStorage(c)
 	if err != nil {
 		return err
 	}
@@ -117,8 +134,13 @@ func BackupDirectoryParallel(c *cli.Context) error {
 	if len(c.Args()) == 3 {
 		parallel, _ = strconv.Atoi(c.Args().Get(2))
 	}
+	release, err := beginTransfers(config, storage, BackupTransfer, parallel)
+	if err != nil {
+		return err
+	}
+	defer release()
 	gplog.Verbose("Backup Directory '%s' to S3", dirName)
-	gplog.Verbose("S3 Location = s3://%s/%s", config.Options.Bucket, dirName)
+	gplog.Verbose("S3 Location = %s", storage.URL(dirName))
 	gplog.Info("dirKey = %s\n", dirName)
 
 	// Populate a list of files to be backed up
@@ -132,6 +154,8 @@ func BackupDirectoryParallel(c *cli.Context) error {
 	})
 
 	var wg sync.WaitGroup
+	// Guards finalErr and totalBytes, which every worker updates
+	var mutex sync.Mutex
 	var finalErr error
 	// Create jobs using a channel
 	fileChannel := make(chan string, len(fileList))
@@ -146,18 +170,26 @@ func BackupDirectoryParallel(c *cli.Context) error {
 			for fileKey := range jobs {
 				file, err := os.Open(fileKey)
 				if err != nil {
+					mutex.Lock()
 					finalErr = err
-					return
+					mutex.Unlock()
+					wg.Done()
+					continue
 				}
-				bytes, elapsed, err := uploadFile(sess, config, fileKey, file)
+				bytes, elapsed, err := uploadFile(storage, config, fileKey, file)
 				if err == nil {
+					mutex.Lock()
 					totalBytes += bytes
+					mutex.Unlock()
+					recordTransfer(config, BackupTransfer, fileKey, bytes, elapsed)
 					msg := fmt.Sprintf("Uploaded %d bytes for %s in %v", bytes,
 						filepath.Base(fileKey), elapsed.Round(time.Millisecond))
 					gplog.Verbose(msg)
 					fmt.Println(msg)
 				} else {
+					mutex.Lock()
 					finalErr = err
+					mutex.Unlock()
 					gplog.FatalOnError(err)
 				}
 				_ = file.Close()
@@ -174,48 +206,100 @@ func BackupDirectoryParallel(c *cli.Context) error {
 }
 
 func BackupData(c *cli.Context) error {
-	config, sess, err := readConfigAndStartSession(c)
+	config, storage, err := readConfigAndOpenStorage(c)
+	if err != nil {
+		return err
+	}
+	release, err := beginTransfers(config, storage, BackupTransfer, 1)
 	if err != nil {
 		return err
 	}
+	defer release()
 	dataFile := c.Args().Get(1)
 	fileKey := GetS3Path(config.Options.Folder, dataFile)
 
-	bytes, elapsed, err := uploadFile(sess, config, fileKey, os.Stdin)
+	bytes, elapsed, err := uploadFile(storage, config, fileKey, operating.System.Stdin)
 	if err != nil {
 		return err
 	}
+	recordTransfer(config, BackupTransfer, fileKey, bytes, elapsed)
 
 	gplog.Debug("Uploaded %d bytes for file %s in %v", bytes,
 		filepath.Base(fileKey), elapsed.Round(time.Millisecond))
 	return nil
 }
 
-func uploadFile(sess *session.Session, config *PluginConfig, fileKey string,
-	file *os.File) (int64, time.Duration, error) {
+func uploadFile(storage Storage, config *PluginConfig, fileKey string,
+	file io.Reader) (int64, time.Duration, error) {
 
 	start := time.Now()
-	bucket := config.Options.Bucket
-	uploadChunkSize := config.Options.UploadChunkSize
-	uploadConcurrency := config.Options.UploadConcurrency
-
-	uploader := s3manager.NewUploader(sess, func(u *s3manager.Uploader) {
-		u.PartSize = uploadChunkSize
-		u.Concurrency = uploadConcurrency
-	})
-	gplog.Debug("Uploading file %s with chunksize %d and concurrency %d",
-		filepath.Base(fileKey), uploader.PartSize, uploader.Concurrency)
-	_, err := uploader.Upload(&s3manager.UploadInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(fileKey),
-		// This will cause memory issues if
-		// segment_per_host*uploadChunkSize*uploadConcurreny is larger than
-		// the amount of ram a system has.
-		Body: bufio.NewReaderSize(file, int(uploadChunkSize)*uploadConcurrency),
-	})
+	digest := newChecksumHash()
+	metadata := backupMetadata(config, fileKey, localFileDir(file))
+	metadata[checksumMeta] = checksumAlgorithm
+	var bytes int64
+	var err error
+	if resumable, localFile := canResumeUpload(storage, config, file); resumable != nil {
+		bytes, err = putLocalFile(resumable, fileKey, localFile, digest, metadata)
+	} else {
+		body := io.TeeReader(file, digest)
+		if config.Options.Compression == CompressionGzip {
+			body, err = newCompressingReader(body, config.Options.CompressionLevelValue, metadata)
+			if err != nil {
+				return 0, -1, err
+			}
+		}
+		bytes, err = putObject(storage, config, fileKey, body, metadata)
+	}
 	if err != nil {
 		return 0, -1, err
 	}
-	bytes, err := getFileSize(uploader.S3, bucket, fileKey)
-	return bytes, time.Since(start), err
+	if err = uploadChecksum(storage, config, fileKey, digest, bytes); err != nil {
+		return 0, -1, err
+	}
+	return bytes, time.Since(start), nil
+}
+
+/*
+ * Uploads a local file so that a failed upload can be resumed. The parts are
+ * uploaded out of order, so the file is read once upfront for its checksum.
+ */
+func putLocalFile(resumable resumableStorage, fileKey string, file *os.File, digest hash.Hash,
+	metadata map[string]string) (int64, error) {
+
+	bytes, err := io.Copy(digest, file)
+	if err != nil {
+		return 0, err
+	}
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	if err = resumable.PutFile(fileKey, file, metadata); err != nil {
+		return 0, err
+	}
+	return bytes, nil
+}
+
+/*
+ * Uploads body to fileKey, encrypting it first if client-side encryption is
+ * configured, and returns the size of the stored object
+ */
+func putObject(storage Storage, config *PluginConfig, fileKey string, body io.Reader,
+	metadata map[string]string) (int64, error) {
+
+	var err error
+	if len(config.Options.ClientSideEncryptionKey) > 0 {
+		body, err = newEncryptingReader(body, config.Options.ClientSideEncryptionKey, metadata)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if err = storage.Put(fileKey, body, metadata); err != nil {
+		return 0, err
+	}
+	info, err := storage.Head(fileKey)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size, nil
 }
@@ -0,0 +1,103 @@
+package s3plugin
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+/*
+ * backup_max_bandwidth and restore_max_bandwidth limit the bandwidth of every
+ * plugin process in their direction. With bandwidth_limit_hours they only
+ * apply during those hours of the day, in the local time of the host, so that
+ * backups can run at full speed overnight. A transfer that is running when the
+ * hours start or end picks up the change within the next read.
+ */
+
+func validateBandwidth(opt *PluginOptions) string {
+	var errTxt string
+	var err error
+	if opt.BackupMaxBandwidth != "" {
+		opt.BackupMaxBandwidthBytes, err = parseBandwidth(opt.BackupMaxBandwidth)
+		if err != nil {
+			errTxt += fmt.Sprintf("Invalid backup_max_bandwidth. Err: %s\n", err)
+		}
+	}
+	if opt.RestoreMaxBandwidth != "" {
+		opt.RestoreMaxBandwidthBytes, err = parseBandwidth(opt.RestoreMaxBandwidth)
+		if err != nil {
+			errTxt += fmt.Sprintf("Invalid restore_max_bandwidth. Err: %s\n", err)
+		}
+	}
+	if opt.BandwidthLimitHours != "" {
+		opt.BandwidthLimitFrom, opt.BandwidthLimitUntil, err = parseHours(opt.BandwidthLimitHours)
+		if err != nil {
+			errTxt += fmt.Sprintf("Invalid bandwidth_limit_hours. Err: %s\n", err)
+		}
+		if opt.BackupMaxBandwidth == "" && opt.RestoreMaxBandwidth == "" {
+			errTxt += fmt.Sprintf("bandwidth_limit_hours requires backup_max_bandwidth or restore_max_bandwidth\n")
+		}
+	}
+	return errTxt
+}
+
+// Parses a range of hours such as 08:00-18:00 into offsets from midnight
+func parseHours(hours string) (time.Duration, time.Duration, error) {
+	bounds := strings.Split(hours, "-")
+	if len(bounds) != 2 {
+		return 0, 0, fmt.Errorf("%s is not a range of hours such as 08:00-18:00", hours)
+	}
+	offsets := make([]time.Duration, 2)
+	for i, bound := range bounds {
+		clock, err := time.Parse("15:04", strings.TrimSpace(bound))
+		if err != nil {
+			return 0, 0, fmt.Errorf("%s is not a time of day such as 08:00", strings.TrimSpace(bound))
+		}
+		offsets[i] = time.Duration(clock.Hour())*time.Hour + time.Duration(clock.Minute())*time.Minute
+	}
+	if offsets[0] == offsets[1] {
+		return 0, 0, fmt.Errorf("%s starts and ends at the same time", hours)
+	}
+	return offsets[0], offsets[1], nil
+}
+
+// Reports whether the bandwidth limits apply at now. Hours may span midnight.
+func isBandwidthLimited(opt *PluginOptions, now time.Time) bool {
+	if opt.BandwidthLimitHours == "" {
+		return true
+	}
+	offset := time.Duration(now.Hour())*time.Hour + time.Duration(now.Minute())*time.Minute
+	if opt.BandwidthLimitFrom < opt.BandwidthLimitUntil {
+		return offset >= opt.BandwidthLimitFrom && offset < opt.BandwidthLimitUntil
+	}
+	return offset >= opt.BandwidthLimitFrom || offset < opt.BandwidthLimitUntil
+}
+
+// The bandwidth limit of direction at now in bytes per second, 0 without one
+func scheduledBandwidth(opt *PluginOptions, direction string, now time.Time) int64 {
+	if !isBandwidthLimited(opt, now) {
+		return 0
+	}
+	if direction == BackupTransfer {
+		return opt.BackupMaxBandwidthBytes
+	}
+	return opt.RestoreMaxBandwidthBytes
+}
+
+/*
+ * Returns the limiter of the transfers of this process in direction, which
+ * keeps to the lower of the scheduled limit of the direction and the share of
+ * host_max_bandwidth of this process. It returns nil if neither is set.
+ */
+func newTransferLimiter(opt *PluginOptions, direction string, host *hostCoordinator) *rateLimiter {
+	if opt.BackupMaxBandwidthBytes == 0 && opt.RestoreMaxBandwidthBytes == 0 && host.bandwidthShare() == 0 {
+		return nil
+	}
+	return newRateLimiter(func() float64 {
+		rate := float64(scheduledBandwidth(opt, direction, time.Now()))
+		if share := host.bandwidthShare(); share > 0 && (rate == 0 || share < rate) {
+			rate = share
+		}
+		return rate
+	})
+}
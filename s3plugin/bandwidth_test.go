@@ -0,0 +1,74 @@
+package s3plugin
+
+import (
+	"bytes"
+	"io"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("bandwidth limits", func() {
+	at := func(clock string) time.Time {
+		now, err := time.Parse("15:04", clock)
+		Expect(err).ToNot(HaveOccurred())
+		return now
+	}
+
+	It("parses the bandwidth limits and the hours they apply", func() {
+		opt := &PluginOptions{BackupMaxBandwidth: "200MB/s", RestoreMaxBandwidth: "1GB", BandwidthLimitHours: "08:00-18:30"}
+		Expect(validateBandwidth(opt)).To(BeEmpty())
+		Expect(opt.BackupMaxBandwidthBytes).To(Equal(int64(200 * Mebibyte)))
+		Expect(opt.RestoreMaxBandwidthBytes).To(Equal(int64(1024 * Mebibyte)))
+		Expect(opt.BandwidthLimitFrom).To(Equal(8 * time.Hour))
+		Expect(opt.BandwidthLimitUntil).To(Equal(18*time.Hour + 30*time.Minute))
+	})
+	It("rejects invalid bandwidth limits and hours", func() {
+		errTxt := validateBandwidth(&PluginOptions{BackupMaxBandwidth: "0MB/s", RestoreMaxBandwidth: "fast"})
+		Expect(errTxt).To(ContainSubstring("Invalid backup_max_bandwidth"))
+		Expect(errTxt).To(ContainSubstring("Invalid restore_max_bandwidth"))
+
+		errTxt = validateBandwidth(&PluginOptions{BackupMaxBandwidth: "1MB/s", BandwidthLimitHours: "8-18"})
+		Expect(errTxt).To(ContainSubstring("Invalid bandwidth_limit_hours"))
+		errTxt = validateBandwidth(&PluginOptions{BackupMaxBandwidth: "1MB/s", BandwidthLimitHours: "08:00-08:00"})
+		Expect(errTxt).To(ContainSubstring("starts and ends at the same time"))
+		errTxt = validateBandwidth(&PluginOptions{BandwidthLimitHours: "08:00-18:00"})
+		Expect(errTxt).To(ContainSubstring("bandwidth_limit_hours requires backup_max_bandwidth or restore_max_bandwidth"))
+	})
+	It("applies the limit of the direction during the limited hours", func() {
+		opt := &PluginOptions{BackupMaxBandwidth: "10MB/s", BandwidthLimitHours: "08:00-18:00"}
+		Expect(validateBandwidth(opt)).To(BeEmpty())
+		Expect(scheduledBandwidth(opt, BackupTransfer, at("08:00"))).To(Equal(int64(10 * Mebibyte)))
+		Expect(scheduledBandwidth(opt, BackupTransfer, at("17:59"))).To(Equal(int64(10 * Mebibyte)))
+		Expect(scheduledBandwidth(opt, BackupTransfer, at("18:00"))).To(BeZero())
+		Expect(scheduledBandwidth(opt, BackupTransfer, at("03:00"))).To(BeZero())
+		Expect(scheduledBandwidth(opt, RestoreTransfer, at("12:00"))).To(BeZero())
+	})
+	It("applies hours that span midnight", func() {
+		opt := &PluginOptions{RestoreMaxBandwidth: "10MB/s", BandwidthLimitHours: "22:00-06:00"}
+		Expect(validateBandwidth(opt)).To(BeEmpty())
+		Expect(isBandwidthLimited(opt, at("23:30"))).To(BeTrue())
+		Expect(isBandwidthLimited(opt, at("05:59"))).To(BeTrue())
+		Expect(isBandwidthLimited(opt, at("06:00"))).To(BeFalse())
+		Expect(isBandwidthLimited(opt, at("12:00"))).To(BeFalse())
+	})
+	It("does not limit transfers without a limit", func() {
+		Expect(newTransferLimiter(&PluginOptions{}, BackupTransfer, nil)).To(BeNil())
+		Expect(newTransferLimiter(&PluginOptions{RestoreMaxBandwidthBytes: Mebibyte}, BackupTransfer, nil).rate()).To(BeZero())
+	})
+	It("keeps readers to the limit after a burst of a second's worth", func() {
+		limiter := newTransferLimiter(&PluginOptions{BackupMaxBandwidthBytes: Mebibyte}, BackupTransfer, nil)
+		start := time.Now()
+		read, err := io.Copy(io.Discard, limiter.limitReader(bytes.NewReader(make([]byte, Mebibyte))))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(read).To(Equal(int64(Mebibyte)))
+		Expect(time.Since(start)).To(BeNumerically("<", 200*time.Millisecond))
+
+		start = time.Now()
+		read, err = io.Copy(io.Discard, limiter.limitReader(bytes.NewReader(make([]byte, Mebibyte/2))))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(read).To(Equal(int64(Mebibyte / 2)))
+		Expect(time.Since(start)).To(BeNumerically(">=", 400*time.Millisecond))
+	})
+})
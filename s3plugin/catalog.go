@@ -0,0 +1,160 @@
+package s3plugin
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/greenplum-db/gp-common-go-libs/operating"
+	"github.com/urfave/cli"
+)
+
+/*
+ * The backup catalog is derived from the layout gpbackup uses for its files,
+ * <folder>/backups/<YYYYMMDD>/<YYYYMMDDHHMMSS>/, so it needs no state of its
+ * own and reflects whatever is actually stored.
+ */
+
+var dateFormat = regexp.MustCompile(`^([0-9]{8})$`)
+
+type backupInfo struct {
+	Timestamp   string    `json:"timestamp"`
+	Prefix      string    `json:"prefix"`
+	Objects     int       `json:"objects"`
+	Bytes       int64     `json:"bytes"`
+	Oldest      time.Time `json:"oldest_object"`
+	Newest      time.Time `json:"newest_object"`
+	HasReport   bool      `json:"has_report"`
+	HasToc      bool      `json:"has_toc"`
+	Failed      bool      `json:"failed"`
+	HasManifest bool      `json:"has_manifest"`
+	HasConfig   bool      `json:"-"`
+	// The older backups an incremental backup is restored along with, only
+	// read by prune_backups
+	DependsOn []string `json:"-"`
+}
+
+var backupInfoTableColumns = []string{"TIMESTAMP", "OBJECTS", "SIZE(bytes)", "OLDEST", "NEWEST", "REPORT", "TOC", "MANIFEST", "FAILED"}
+var backupInfoCSVColumns = []string{"timestamp", "prefix", "objects", "bytes", "oldest_object", "newest_object", "has_report", "has_toc", "has_manifest", "failed"}
+
+func (backup backupInfo) tableRow() []string {
+	return []string{backup.Timestamp, fmt.Sprint(backup.Objects), fmt.Sprint(backup.Bytes),
+		formatCatalogTime(backup.Oldest), formatCatalogTime(backup.Newest),
+		yesNo(backup.HasReport), yesNo(backup.HasToc), yesNo(backup.HasManifest), yesNo(backup.Failed)}
+}
+
+func (backup backupInfo) csvRow() []string {
+	return []string{backup.Timestamp, backup.Prefix, fmt.Sprint(backup.Objects), fmt.Sprint(backup.Bytes),
+		formatCatalogTime(backup.Oldest), formatCatalogTime(backup.Newest),
+		fmt.Sprint(backup.HasReport), fmt.Sprint(backup.HasToc), fmt.Sprint(backup.HasManifest), fmt.Sprint(backup.Failed)}
+}
+
+func formatCatalogTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func yesNo(value bool) string {
+	if value {
+		return "yes"
+	}
+	return "no"
+}
+
+func backupsPrefix(folder string) string {
+	return strings.TrimSuffix(folder, "/") + "/backups/"
+}
+
+func backupPrefix(folder string, timestamp string) string {
+	return backupsPrefix(folder) + timestamp[0:8] + "/" + timestamp + "/"
+}
+
+// The configuration gpbackup writes for every backup
+func backupConfigName(timestamp string) string {
+	return fmt.Sprintf("gpbackup_%s_config.yaml", timestamp)
+}
+
+/*
+ * Calls fn with a summary of every backup stored under folder, oldest
+ * timestamp first. Only the date and timestamp levels are listed with a
+ * delimiter, the objects of a backup are listed to summarize it.
+ */
+func walkBackups(storage Storage, folder string, fn func(backup backupInfo) error) error {
+	return storage.WalkDirectory(backupsPrefix(folder), func(date ObjectInfo) error {
+		if !date.IsPrefix || !dateFormat.MatchString(path.Base(date.Key)) {
+			return nil
+		}
+		return storage.WalkDirectory(date.Key, func(timestampDir ObjectInfo) error {
+			timestamp := path.Base(timestampDir.Key)
+			if !timestampDir.IsPrefix || !IsValidTimestamp(timestamp) {
+				return nil
+			}
+			backup, err := summarizeBackup(storage, timestampDir.Key, timestamp)
+			if err != nil {
+				return err
+			}
+			return fn(backup)
+		})
+	})
+}
+
+func summarizeBackup(storage Storage, prefix string, timestamp string) (backupInfo, error) {
+	backup := backupInfo{Timestamp: timestamp, Prefix: prefix}
+	reportKey := prefix + fmt.Sprintf("gpbackup_%s_report", timestamp)
+	tocKey := prefix + fmt.Sprintf("gpbackup_%s_toc.yaml", timestamp)
+	failedKey := prefix + failedMarkerName(timestamp)
+	manifestKey := prefix + manifestName(timestamp)
+	configKey := prefix + backupConfigName(timestamp)
+	sidecars := &checksumSidecars{}
+	err := storage.Walk(prefix, func(object ObjectInfo) error {
+		if sidecars.isChecksumFile(object.Key) {
+			return nil
+		}
+		backup.Objects++
+		backup.Bytes += object.Size
+		if backup.Oldest.IsZero() || object.LastModified.Before(backup.Oldest) {
+			backup.Oldest = object.LastModified
+		}
+		if object.LastModified.After(backup.Newest) {
+			backup.Newest = object.LastModified
+		}
+		switch object.Key {
+		case reportKey:
+			backup.HasReport = true
+		case tocKey:
+			backup.HasToc = true
+		case failedKey:
+			backup.Failed = true
+		case manifestKey:
+			backup.HasManifest = true
+		case configKey:
+			backup.HasConfig = true
+		}
+		return nil
+	})
+	return backup, err
+}
+
+func ListBackups(c *cli.Context) error {
+	format := c.String("format")
+	if err := validateListFormat(format); err != nil {
+		return err
+	}
+	config, storage, err := readConfigAndOpenStorage(c)
+	if err != nil {
+		return err
+	}
+
+	writer := newListWriter(format, operating.System.Stdout, backupInfoTableColumns, backupInfoCSVColumns)
+	err = walkBackups(storage, config.Options.Folder, func(backup backupInfo) error {
+		return writer.Write(backup)
+	})
+	if err != nil {
+		return err
+	}
+	return writer.Flush()
+}
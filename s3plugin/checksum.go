@@ -0,0 +1,136 @@
+package s3plugin
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/greenplum-db/gp-common-go-libs/gplog"
+)
+
+/*
+ * End-to-end checksums.
+ *
+ * The SHA-256 of the data handed to the plugin is computed while it is
+ * streamed to S3. Since object metadata has to be set before the upload
+ * starts, the digest is stored in a small sidecar object next to the backup
+ * object, in the same format sha256sum uses. The backup object itself is
+ * marked in its metadata so that restore knows a sidecar exists and can verify
+ * the restored bytes against it. The sidecar also records the size the object
+ * was stored with in its metadata, which makes it the record of the upload
+ * that the manifest of the backup is built from.
+ */
+
+const (
+	checksumAlgorithm = "sha256"
+	checksumMeta      = "gpbackup-checksum"
+	checksumSuffix    = ".sha256"
+	checksumSizeMeta  = "gpbackup-size"
+)
+
+func checksumKey(fileKey string) string {
+	return fileKey + checksumSuffix
+}
+
+/*
+ * A key ending in .sha256 is only a sidecar when the object it belongs to is
+ * stored as well, so that files of that name handed to the plugin are still
+ * listed and restored.
+ */
+func isChecksumFile(fileKey string, objects map[string]ObjectInfo) bool {
+	if !strings.HasSuffix(fileKey, checksumSuffix) {
+		return false
+	}
+	_, ok := objects[strings.TrimSuffix(fileKey, checksumSuffix)]
+	return ok
+}
+
+/*
+ * Recognizes the sidecars in a listing that is walked in key order, without
+ * holding every listed key. An object sorts before its sidecar and every key
+ * in between starts with the key of the object, so only the listed keys that
+ * are a prefix of the last one need to be kept.
+ */
+type checksumSidecars struct {
+	keys []string
+}
+
+func (sidecars *checksumSidecars) isChecksumFile(fileKey string) bool {
+	for len(sidecars.keys) > 0 && !strings.HasPrefix(fileKey, sidecars.keys[len(sidecars.keys)-1]) {
+		sidecars.keys = sidecars.keys[:len(sidecars.keys)-1]
+	}
+	isSidecar := false
+	if strings.HasSuffix(fileKey, checksumSuffix) {
+		objectKey := strings.TrimSuffix(fileKey, checksumSuffix)
+		for _, key := range sidecars.keys {
+			if key == objectKey {
+				isSidecar = true
+				break
+			}
+		}
+	}
+	sidecars.keys = append(sidecars.keys, fileKey)
+	return isSidecar
+}
+
+func hasChecksum(metadata map[string]string) bool {
+	return getMetadataValue(metadata, checksumMeta) == checksumAlgorithm
+}
+
+func newChecksumHash() hash.Hash {
+	return sha256.New()
+}
+
+func uploadChecksum(storage Storage, config *PluginConfig, fileKey string, digest hash.Hash, size int64) error {
+	contents := fmt.Sprintf("%s  %s\n", hex.EncodeToString(digest.Sum(nil)), filepath.Base(fileKey))
+	metadata := backupMetadata(config, checksumKey(fileKey), "")
+	metadata[checksumSizeMeta] = strconv.FormatInt(size, 10)
+	_, err := putObject(storage, config, checksumKey(fileKey), strings.NewReader(contents), metadata)
+	return err
+}
+
+func downloadChecksum(storage Storage, config *PluginConfig, fileKey string) (string, error) {
+	buffer := &bytes.Buffer{}
+	if _, _, err := downloadFile(storage, config, checksumKey(fileKey), buffer); err != nil {
+		return "", fmt.Errorf("Unable to read checksum of %s: %s", fileKey, err)
+	}
+	fields := strings.Fields(buffer.String())
+	if len(fields) == 0 {
+		return "", fmt.Errorf("Checksum file %s is empty", checksumKey(fileKey))
+	}
+	return fields[0], nil
+}
+
+type checksumWriter struct {
+	io.Writer
+	digest   hash.Hash
+	expected string
+	fileKey  string
+}
+
+// Returns a writer that verifies the data written to it on Close
+func newChecksumWriter(dst io.Writer, fileKey string, expected string) *checksumWriter {
+	digest := newChecksumHash()
+	return &checksumWriter{
+		Writer:   io.MultiWriter(dst, digest),
+		digest:   digest,
+		expected: expected,
+		fileKey:  fileKey,
+	}
+}
+
+func (w *checksumWriter) Close() error {
+	actual := hex.EncodeToString(w.digest.Sum(nil))
+	if actual != w.expected {
+		return fmt.Errorf("Checksum mismatch for %s: expected %s %s but the restored data has %s. "+
+			"The restored data is incomplete or corrupt", w.fileKey, checksumAlgorithm, w.expected, actual)
+	}
+	gplog.Debug("Verified %s checksum of %s", checksumAlgorithm, filepath.Base(w.fileKey))
+	return nil
+}
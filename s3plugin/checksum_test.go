@@ -0,0 +1,66 @@
+package s3plugin
+
+import (
+	"bytes"
+	"encoding/hex"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("checksums", func() {
+	checksumOf := func(data []byte) string {
+		digest := newChecksumHash()
+		_, _ = digest.Write(data)
+		return hex.EncodeToString(digest.Sum(nil))
+	}
+
+	It("passes data through and verifies it on Close", func() {
+		output := &bytes.Buffer{}
+		writer := newChecksumWriter(output, "backups/20180101/20180101082233/file", checksumOf([]byte("backup data")))
+		_, err := writer.Write([]byte("backup data"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(writer.Close()).To(Succeed())
+		Expect(output.String()).To(Equal("backup data"))
+	})
+	It("returns an error on Close when the restored data does not match", func() {
+		writer := newChecksumWriter(&bytes.Buffer{}, "backups/20180101/20180101082233/file", checksumOf([]byte("backup data")))
+		_, _ = writer.Write([]byte("backup"))
+		Expect(writer.Close()).To(MatchError(ContainSubstring("Checksum mismatch for backups/20180101/20180101082233/file")))
+	})
+	It("recognizes checksum sidecar objects", func() {
+		objects := map[string]ObjectInfo{"gpbackup_0_20180101082233": {}, checksumKey("gpbackup_0_20180101082233"): {}}
+		Expect(isChecksumFile(checksumKey("gpbackup_0_20180101082233"), objects)).To(BeTrue())
+		Expect(isChecksumFile("gpbackup_0_20180101082233", objects)).To(BeFalse())
+		Expect(isChecksumFile("notes.sha256", objects)).To(BeFalse())
+	})
+	It("recognizes checksum sidecar objects in a listing in key order", func() {
+		sidecars := &checksumSidecars{}
+		var found []string
+		for _, key := range []string{"dir/file", "dir/file.gz", "dir/file.gz.sha256", "dir/file.sha256",
+			"dir/notes.sha256", "dir/other"} {
+			if sidecars.isChecksumFile(key) {
+				found = append(found, key)
+			}
+		}
+		Expect(found).To(Equal([]string{"dir/file.gz.sha256", "dir/file.sha256"}))
+	})
+	It("verifies through the decryption layer of a restore writer", func() {
+		// The checksum covers the data before client-side encryption
+		metadata := make(map[string]string)
+		masterKey := []byte("0123456789abcdef0123456789abcdef")
+		reader, err := newEncryptingReader(bytes.NewReader([]byte("backup data")), masterKey, metadata)
+		Expect(err).ToNot(HaveOccurred())
+		ciphertext := &bytes.Buffer{}
+		_, _ = ciphertext.ReadFrom(reader)
+
+		config := &PluginConfig{Options: PluginOptions{ClientSideEncryptionKey: masterKey}}
+		output := &bytes.Buffer{}
+		writer, err := newRestoreWriter(config, "file", metadata, checksumOf([]byte("backup data")), output)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = writer.Write(ciphertext.Bytes())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(writer.Close()).To(Succeed())
+		Expect(output.String()).To(Equal("backup data"))
+	})
+})
@@ -0,0 +1,285 @@
+package s3plugin
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/greenplum-db/gp-common-go-libs/gplog"
+	"github.com/greenplum-db/gp-common-go-libs/operating"
+	"github.com/urfave/cli"
+)
+
+const DefaultIncompleteUploadMaxAge = 24 * time.Hour
+
+// What cleanup_plugin_for_backup does with the objects of a failed backup
+const (
+	KeepFailedBackup   = "keep"
+	MarkFailedBackup   = "mark"
+	DeleteFailedBackup = "delete"
+)
+
+var backupStatusLine = regexp.MustCompile(`(?i)^\s*backup status:\s*(\w+)`)
+
+type uploadCleanup struct {
+	incompleteUpload
+	Action string `json:"action"`
+}
+
+var uploadCleanupTableColumns = append(incompleteUploadTableColumns, "ACTION")
+var uploadCleanupCSVColumns = append(incompleteUploadCSVColumns, "action")
+
+func (cleanup uploadCleanup) tableRow() []string {
+	return append(cleanup.incompleteUpload.tableRow(), cleanup.Action)
+}
+
+func (cleanup uploadCleanup) csvRow() []string {
+	return cleanup.tableRow()
+}
+
+func validateIncompleteUploadCleanup(opt *PluginOptions) string {
+	var errTxt string
+	opt.IncompleteUploadMaxAgeDuration = DefaultIncompleteUploadMaxAge
+	if opt.IncompleteUploadMaxAge != "" {
+		maxAge, err := time.ParseDuration(opt.IncompleteUploadMaxAge)
+		if err != nil || maxAge < 0 {
+			errTxt += fmt.Sprintf("Invalid incomplete_upload_max_age. It must be a duration such as 48h\n")
+		}
+		opt.IncompleteUploadMaxAgeDuration = maxAge
+	}
+	if opt.CleanupIncompleteUploads != "" && opt.CleanupIncompleteUploads != "on" && opt.CleanupIncompleteUploads != "off" {
+		errTxt += fmt.Sprintf("Invalid cleanup_incomplete_uploads configuration. Valid choices are on or off.\n")
+	}
+	return errTxt
+}
+
+func validateFailedBackupAction(opt *PluginOptions) string {
+	switch opt.FailedBackupAction {
+	case "":
+		opt.FailedBackupAction = KeepFailedBackup
+	case KeepFailedBackup, MarkFailedBackup, DeleteFailedBackup:
+	default:
+		return fmt.Sprintf("Invalid failed_backup_action configuration. Valid choices are %s, %s or %s.\n",
+			KeepFailedBackup, MarkFailedBackup, DeleteFailedBackup)
+	}
+	return ""
+}
+
+func failedMarkerName(timestamp string) string {
+	return fmt.Sprintf("gpbackup_%s_failed", timestamp)
+}
+
+/*
+ * Aborts the incomplete uploads under the backups of the folder that were
+ * started more than maxAge ago. Younger uploads may belong to a backup that is
+ * still running.
+ */
+func cleanupIncompleteUploads(storage *s3Storage, config *PluginConfig, maxAge time.Duration,
+	dryRun bool, writer listWriter) (int, error) {
+
+	numAborted := 0
+	now := operating.System.Now()
+	err := storage.walkIncompleteUploads(backupsPrefix(config.Options.Folder), func(upload incompleteUpload) error {
+		cleanup := uploadCleanup{incompleteUpload: upload, Action: "keep"}
+		if now.Sub(upload.Initiated) > maxAge {
+			cleanup.Action = "abort"
+			if !dryRun {
+				if err := storage.abortUpload(upload.Key, upload.UploadId); err != nil {
+					return fmt.Errorf("Unable to abort upload %s of %s: %s", upload.UploadId, upload.Key, err)
+				}
+				numAborted++
+			}
+		}
+		if writer == nil {
+			gplog.Verbose("Incomplete upload %s of %s started %s with %d bytes: %s", upload.UploadId,
+				upload.Key, formatCatalogTime(upload.Initiated), upload.Bytes, cleanup.Action)
+			return nil
+		}
+		return writer.Write(cleanup)
+	})
+	return numAborted, err
+}
+
+func CleanupIncompleteUploads(c *cli.Context) error {
+	format := c.String("format")
+	if err := validateListFormat(format); err != nil {
+		return err
+	}
+	dryRun := c.Bool("dry-run")
+	config, storage, err := readConfigAndOpenStorage(c)
+	if err != nil {
+		return err
+	}
+	bucketStorage, err := requireS3Storage(storage, "cleanup_incomplete_uploads")
+	if err != nil {
+		return err
+	}
+	maxAge := config.Options.IncompleteUploadMaxAgeDuration
+	if olderThan := c.String("older-than"); olderThan != "" {
+		maxAge, err = time.ParseDuration(olderThan)
+		if err != nil || maxAge < 0 {
+			return fmt.Errorf("Invalid --older-than %s. It must be a duration such as 48h", olderThan)
+		}
+	}
+
+	writer := newListWriter(format, operating.System.Stdout, uploadCleanupTableColumns, uploadCleanupCSVColumns)
+	numAborted, err := cleanupIncompleteUploads(bucketStorage, config, maxAge, dryRun, writer)
+	if err != nil {
+		return err
+	}
+	if err = writer.Flush(); err != nil {
+		return err
+	}
+	gplog.Info("Aborted %d incomplete uploads older than %v", numAborted, maxAge)
+	return nil
+}
+
+/*
+ * gpbackup and gprestore call the cleanup hooks at the end of every backup and
+ * restore, whether it succeeded or not, once on the coordinator, once on every
+ * segment host and once per segment. Work that concerns the local files of a
+ * host is done at host scope and work that concerns the whole backup only on
+ * the coordinator. Nothing a cleanup hook does fails the backup or restore it
+ * follows, errors are only logged.
+ */
+func CleanupPluginForBackup(c *cli.Context) error {
+	scope := (Scope)(c.Args().Get(2))
+	if scope != Master && scope != Coordinator && scope != SegmentHost {
+		return nil
+	}
+	config, storage, err := readConfigAndOpenStorage(c)
+	if err != nil {
+		return err
+	}
+	localBackupDir := c.Args().Get(1)
+	_, timestamp := filepath.Split(localBackupDir)
+
+	// Probe file left behind by setup_plugin_for_backup
+	probeFile := "/tmp/" + fmt.Sprintf("gpbackup_%s_report", timestamp)
+	if err = os.Remove(probeFile); err != nil && !os.IsNotExist(err) {
+		gplog.Warn("Unable to remove %s: %s", probeFile, err)
+	}
+	if bucketStorage, ok := primaryS3Storage(storage); ok {
+		abortRecordedUploads(bucketStorage, config, timestamp)
+	}
+	flushTransferStats(config, timestamp, BackupTransfer)
+
+	if scope == SegmentHost {
+		return nil
+	}
+	reportPath := filepath.Join(localBackupDir, fmt.Sprintf("gpbackup_%s_report", timestamp))
+	switch status := readBackupStatus(reportPath); status {
+	case "success":
+		numObjects, err := writeBackupManifest(storage, config, timestamp)
+		if err != nil {
+			gplog.Warn("Unable to write the manifest of backup %s: %s", timestamp, err)
+		} else {
+			gplog.Info("Wrote manifest of %d objects for backup %s", numObjects, timestamp)
+		}
+	case "failure":
+		cleanupFailedBackup(storage, config, localBackupDir, timestamp)
+	default:
+		gplog.Verbose("Backup %s has no status in %s, assuming it did not finish", timestamp, reportPath)
+	}
+	if bucketStorage, ok := primaryS3Storage(storage); ok && config.Options.CleanupIncompleteUploads == "on" {
+		numAborted, err := cleanupIncompleteUploads(bucketStorage, config,
+			config.Options.IncompleteUploadMaxAgeDuration, false, nil)
+		if err != nil {
+			gplog.Warn("Unable to clean up incomplete uploads: %s", err)
+		} else if numAborted > 0 {
+			gplog.Info("Aborted %d incomplete uploads older than %v", numAborted,
+				config.Options.IncompleteUploadMaxAgeDuration)
+		}
+	}
+	return nil
+}
+
+func CleanupPluginForRestore(c *cli.Context) error {
+	scope := (Scope)(c.Args().Get(2))
+	if scope != Master && scope != Coordinator && scope != SegmentHost {
+		return nil
+	}
+	config, err := readAndValidatePluginConfig(c.Args().Get(0))
+	if err != nil {
+		return err
+	}
+	_, timestamp := filepath.Split(c.Args().Get(1))
+	flushTransferStats(config, timestamp, RestoreTransfer)
+	return nil
+}
+
+/*
+ * Aborts the multipart uploads this host recorded in upload_state_dir for
+ * the files of timestamp. They are left over by uploads that were
+ * interrupted, and gpbackup never uploads the files of a finished backup
+ * again that could resume them.
+ */
+func abortRecordedUploads(storage *s3Storage, config *PluginConfig, timestamp string) {
+	statePaths, err := filepath.Glob(filepath.Join(config.Options.UploadStateDir, "*.json"))
+	if err != nil {
+		gplog.Warn("Unable to list upload state files: %s", err)
+		return
+	}
+	for _, statePath := range statePaths {
+		state, err := loadUploadState(statePath)
+		if err != nil {
+			gplog.Warn("%s", err)
+			continue
+		}
+		if state == nil || state.Bucket != storage.bucket || timestampOfKey(state.Key) != timestamp {
+			continue
+		}
+		if err = storage.abortUpload(state.Key, state.UploadId); err != nil {
+			gplog.Warn("Unable to abort upload %s of %s: %s", state.UploadId, state.Key, err)
+			continue
+		}
+		gplog.Info("Aborted interrupted upload %s of %s", state.UploadId, state.Key)
+		if err = os.Remove(statePath); err != nil && !os.IsNotExist(err) {
+			gplog.Warn("Unable to remove upload state file %s: %s", statePath, err)
+		}
+	}
+}
+
+/*
+ * Reads the status gpbackup wrote to the report of the backup on the
+ * coordinator. It returns "" if there is no report or it has no status, as
+ * when gpbackup failed before writing it.
+ */
+func readBackupStatus(reportPath string) string {
+	file, err := os.Open(reportPath)
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if match := backupStatusLine.FindStringSubmatch(scanner.Text()); match != nil {
+			return strings.ToLower(match[1])
+		}
+	}
+	return ""
+}
+
+func cleanupFailedBackup(storage Storage, config *PluginConfig, localBackupDir string, timestamp string) {
+	switch config.Options.FailedBackupAction {
+	case MarkFailedBackup:
+		markerKey := GetS3Path(config.Options.Folder, filepath.Join(localBackupDir, failedMarkerName(timestamp)))
+		contents := fmt.Sprintf("Backup %s failed\n", timestamp)
+		err := storage.Put(markerKey, strings.NewReader(contents), backupMetadata(config, markerKey, ""))
+		if err != nil {
+			gplog.Warn("Unable to mark failed backup %s: %s", timestamp, err)
+			return
+		}
+		gplog.Info("Marked failed backup %s with %s", timestamp, storage.URL(markerKey))
+	case DeleteFailedBackup:
+		if err := deleteBackupTimestamp(storage, config, timestamp); err != nil {
+			gplog.Warn("Unable to delete failed backup %s: %s", timestamp, err)
+			return
+		}
+		gplog.Info("Deleted failed backup %s", timestamp)
+	}
+}
@@ -0,0 +1,153 @@
+package s3plugin
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+/*
+ * Optional compression of backup streams by the plugin.
+ *
+ * Data is compressed before it is encrypted and after its checksum is taken,
+ * so checksums keep covering the data gpbackup handed to the plugin. The
+ * codec is recorded in the object's metadata, and restore decompresses any
+ * object that has one, whatever the current configuration says. The
+ * compressed stream is decompressed as the chunks of a ranged parallel
+ * download are written out in order, so large objects are still downloaded
+ * in parallel.
+ *
+ * Only gzip is supported, as it is the only codec in the standard library.
+ */
+
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+
+	compressionMeta         = "gpbackup-compression"
+	compressionReadSize     = 64 * 1024
+	DefaultCompressionLevel = gzip.DefaultCompression
+)
+
+func validateCompression(opt *PluginOptions) string {
+	var errTxt string
+	if opt.Compression == "" {
+		opt.Compression = CompressionNone
+	}
+	if opt.Compression != CompressionNone && opt.Compression != CompressionGzip {
+		errTxt += fmt.Sprintf("Invalid compression configuration. Valid choices are %s or %s.\n",
+			CompressionNone, CompressionGzip)
+	}
+	opt.CompressionLevelValue = DefaultCompressionLevel
+	if opt.CompressionLevel != "" {
+		level, err := strconv.Atoi(opt.CompressionLevel)
+		if err != nil || level < gzip.BestSpeed || level > gzip.BestCompression {
+			errTxt += fmt.Sprintf("Invalid compression_level. It must be a number from %d to %d\n",
+				gzip.BestSpeed, gzip.BestCompression)
+		}
+		opt.CompressionLevelValue = level
+		if opt.Compression == CompressionNone {
+			errTxt += fmt.Sprintf("compression_level requires compression to be %s\n", CompressionGzip)
+		}
+	}
+	return errTxt
+}
+
+func isCompressed(metadata map[string]string) bool {
+	return getMetadataValue(metadata, compressionMeta) != ""
+}
+
+type compressingReader struct {
+	src        io.Reader
+	compressor *gzip.Writer
+	compressed *bytes.Buffer
+	plain      []byte
+	done       bool
+}
+
+// Returns a reader of the gzip compression of src and records it in metadata
+func newCompressingReader(src io.Reader, level int, metadata map[string]string) (io.Reader, error) {
+	compressed := &bytes.Buffer{}
+	compressor, err := gzip.NewWriterLevel(compressed, level)
+	if err != nil {
+		return nil, err
+	}
+	metadata[compressionMeta] = CompressionGzip
+	return &compressingReader{
+		src:        src,
+		compressor: compressor,
+		compressed: compressed,
+		plain:      make([]byte, compressionReadSize),
+	}, nil
+}
+
+func (r *compressingReader) Read(p []byte) (int, error) {
+	for r.compressed.Len() == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		n, err := r.src.Read(r.plain)
+		if n > 0 {
+			if _, writeErr := r.compressor.Write(r.plain[:n]); writeErr != nil {
+				return 0, writeErr
+			}
+		}
+		if err == io.EOF {
+			r.done = true
+			if err = r.compressor.Close(); err != nil {
+				return 0, err
+			}
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	return r.compressed.Read(p)
+}
+
+/*
+ * Decompresses everything written to it into dst. The gzip reader runs in its
+ * own goroutine, fed through a pipe, and Close waits for it to finish.
+ */
+type decompressingWriter struct {
+	*io.PipeWriter
+	fileKey string
+	done    chan error
+}
+
+func newDecompressingWriter(fileKey string, metadata map[string]string, dst io.Writer) (*decompressingWriter, error) {
+	codec := getMetadataValue(metadata, compressionMeta)
+	if codec != CompressionGzip {
+		return nil, fmt.Errorf("%s is compressed with %s, which this version of the plugin cannot decompress",
+			fileKey, codec)
+	}
+	reader, writer := io.Pipe()
+	w := &decompressingWriter{PipeWriter: writer, fileKey: fileKey, done: make(chan error, 1)}
+	go func() {
+		decompressor, err := gzip.NewReader(reader)
+		if err == nil {
+			_, err = io.Copy(dst, decompressor)
+		}
+		// Fails any further write with the error that stopped decompression
+		_ = reader.CloseWithError(err)
+		w.done <- err
+	}()
+	return w, nil
+}
+
+func (w *decompressingWriter) Write(p []byte) (int, error) {
+	n, err := w.PipeWriter.Write(p)
+	if err != nil && err != io.ErrClosedPipe {
+		return n, fmt.Errorf("Unable to decompress %s: %s", w.fileKey, err)
+	}
+	return n, err
+}
+
+func (w *decompressingWriter) Close() error {
+	_ = w.PipeWriter.Close()
+	if err := <-w.done; err != nil {
+		return fmt.Errorf("Unable to decompress %s: %s", w.fileKey, err)
+	}
+	return nil
+}
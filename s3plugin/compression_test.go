@@ -0,0 +1,104 @@
+package s3plugin
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"math/rand"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("compression", func() {
+	var metadata map[string]string
+
+	compress := func(data []byte) []byte {
+		reader, err := newCompressingReader(bytes.NewReader(data), gzip.BestSpeed, metadata)
+		Expect(err).ToNot(HaveOccurred())
+		compressed, err := ioutil.ReadAll(reader)
+		Expect(err).ToNot(HaveOccurred())
+		return compressed
+	}
+	decompress := func(compressed []byte) ([]byte, error) {
+		output := &bytes.Buffer{}
+		writer, err := newDecompressingWriter("file", metadata, output)
+		if err != nil {
+			return nil, err
+		}
+		// Written in pieces, as the chunks of a ranged download are
+		for len(compressed) > 0 {
+			n := 1000
+			if n > len(compressed) {
+				n = len(compressed)
+			}
+			if _, err = writer.Write(compressed[:n]); err != nil {
+				return nil, err
+			}
+			compressed = compressed[n:]
+		}
+		err = writer.Close()
+		return output.Bytes(), err
+	}
+
+	BeforeEach(func() {
+		metadata = make(map[string]string)
+	})
+	DescribeTable("round trips streams of different lengths",
+		func(length int) {
+			data := bytes.Repeat([]byte("1\tfoo\n"), length/6+1)[:length]
+			compressed := compress(data)
+			Expect(getMetadataValue(metadata, "Gpbackup-Compression")).To(Equal(CompressionGzip))
+
+			result, err := decompress(compressed)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result).To(Equal(data))
+		},
+		Entry("empty stream", 0),
+		Entry("less than a read", 100),
+		Entry("several reads", 5*compressionReadSize+3),
+	)
+	It("produces a standard gzip stream", func() {
+		data := bytes.Repeat([]byte("backup data\n"), 1000)
+		compressed := compress(data)
+		Expect(len(compressed)).To(BeNumerically("<", len(data)/10))
+		reader, err := gzip.NewReader(bytes.NewReader(compressed))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ioutil.ReadAll(reader)).To(Equal(data))
+	})
+	It("fails when the compressed data has been truncated", func() {
+		data := make([]byte, 100000)
+		_, _ = rand.New(rand.NewSource(1)).Read(data)
+		compressed := compress(data)
+		_, err := decompress(compressed[:len(compressed)-10])
+		Expect(err).To(MatchError(ContainSubstring("Unable to decompress file")))
+	})
+	It("fails for a codec it does not know", func() {
+		metadata[compressionMeta] = "zstd"
+		_, err := decompress([]byte("data"))
+		Expect(err).To(MatchError(ContainSubstring("compressed with zstd")))
+	})
+	It("verifies the checksum of the decompressed data in a restore writer", func() {
+		compressed := compress([]byte("backup data"))
+		digest := sha256.Sum256([]byte("backup data"))
+		output := &bytes.Buffer{}
+		writer, err := newRestoreWriter(&PluginConfig{}, "file", metadata, hex.EncodeToString(digest[:]), output)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = writer.Write(compressed)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(writer.Close()).To(Succeed())
+		Expect(output.String()).To(Equal("backup data"))
+	})
+	It("rejects invalid compression options", func() {
+		opt := &PluginOptions{Compression: "lz4", CompressionLevel: "10"}
+		errTxt := validateCompression(opt)
+		Expect(errTxt).To(ContainSubstring("Invalid compression configuration"))
+		Expect(errTxt).To(ContainSubstring("Invalid compression_level"))
+
+		opt = &PluginOptions{CompressionLevel: "3"}
+		Expect(validateCompression(opt)).To(ContainSubstring("compression_level requires compression to be gzip"))
+		Expect(opt.Compression).To(Equal(CompressionNone))
+	})
+})
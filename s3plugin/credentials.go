@@ -0,0 +1,166 @@
+package s3plugin
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/ec2rolecreds"
+	"github.com/aws/aws-sdk-go/aws/credentials/processcreds"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/greenplum-db/gp-common-go-libs/gplog"
+)
+
+/*
+ * Where the plugin gets its AWS credentials from.
+ *
+ * At most one source of credentials may be configured: static keys, a
+ * profile of the shared configuration files, a credential_process command, a
+ * web identity token file or the EC2 instance metadata service. Without one the
+ * SDK's default chain is used. aws_role_arn assumes a role with the
+ * credentials of the source, or with the web identity token. Temporary
+ * credentials are refreshed by the SDK before they expire, so long backups
+ * keep working.
+ *
+ * The credential providers talk to STS and the instance metadata service, so
+ * they are created without the endpoint of the S3 compatible storage.
+ */
+
+const (
+	DefaultRoleSessionName = "gpbackup_s3_plugin"
+	DefaultRoleDuration    = time.Hour
+
+	minRoleDuration = 15 * time.Minute
+	maxRoleDuration = 12 * time.Hour
+	// Assumed role credentials are refreshed this long before they expire
+	roleExpiryWindow = 5 * time.Minute
+	// STS is reached through its global endpoint when no region is configured
+	defaultCredentialsRegion = "us-east-1"
+)
+
+// The names of the sources of credentials configured in opt
+func credentialSources(opt *PluginOptions) []string {
+	sources := make([]string, 0)
+	if opt.AwsAccessKeyId != "" || opt.AwsSecretAccessKey != "" {
+		sources = append(sources, "aws_access_key_id")
+	}
+	if opt.AwsProfile != "" {
+		sources = append(sources, "aws_profile")
+	}
+	if opt.AwsCredentialProcess != "" {
+		sources = append(sources, "aws_credential_process")
+	}
+	if opt.AwsWebIdentityTokenFile != "" {
+		sources = append(sources, "aws_web_identity_token_file")
+	}
+	if opt.AwsInstanceMetadata == "on" {
+		sources = append(sources, "aws_instance_metadata")
+	}
+	return sources
+}
+
+func validateCredentials(opt *PluginOptions) string {
+	var errTxt string
+	if opt.AwsInstanceMetadata == "" {
+		opt.AwsInstanceMetadata = "off"
+	}
+	if opt.AwsInstanceMetadata != "on" && opt.AwsInstanceMetadata != "off" {
+		errTxt += fmt.Sprintf("Invalid aws_instance_metadata configuration. Valid choices are on or off.\n")
+	}
+	if sources := credentialSources(opt); len(sources) > 1 {
+		errTxt += fmt.Sprintf("Only one source of credentials may be configured, but found %s\n",
+			strings.Join(sources, ", "))
+	}
+	if opt.AwsSharedCredentialsFile != "" && opt.AwsProfile == "" {
+		errTxt += fmt.Sprintf("aws_shared_credentials_file requires aws_profile\n")
+	}
+	if opt.AwsWebIdentityTokenFile != "" && opt.AwsRoleArn == "" {
+		errTxt += fmt.Sprintf("aws_web_identity_token_file requires aws_role_arn\n")
+	}
+	if opt.AwsRoleArn == "" && (opt.AwsRoleExternalId != "" || opt.AwsRoleSessionName != "" ||
+		opt.AwsRoleDuration != "") {
+		errTxt += fmt.Sprintf("aws_role_external_id, aws_role_session_name and aws_role_duration require aws_role_arn\n")
+	}
+	opt.AwsRoleDurationValue = DefaultRoleDuration
+	if opt.AwsRoleDuration != "" {
+		duration, err := time.ParseDuration(opt.AwsRoleDuration)
+		if err != nil || duration < minRoleDuration || duration > maxRoleDuration {
+			errTxt += fmt.Sprintf("Invalid aws_role_duration. It must be a duration from %v to %v\n",
+				minRoleDuration, maxRoleDuration)
+		}
+		opt.AwsRoleDurationValue = duration
+	}
+	return errTxt
+}
+
+/*
+ * Returns the credentials configured in opt, or nil to use the default chain
+ * of the SDK. awsConfig supplies the region, retryer and HTTP client.
+ */
+func newCredentials(opt *PluginOptions, awsConfig *aws.Config) (*credentials.Credentials, error) {
+	if len(credentialSources(opt)) == 0 && opt.AwsRoleArn == "" {
+		return nil, nil
+	}
+
+	baseConfig := awsConfig.Copy().WithEndpoint("").WithUseDualStack(false)
+	if opt.Region == "" || opt.Region == "unused" {
+		baseConfig = baseConfig.WithRegion(defaultCredentialsRegion)
+	}
+	sessionOptions := session.Options{}
+	source := "the default credential chain"
+	switch {
+	case opt.AwsAccessKeyId != "":
+		baseConfig = baseConfig.WithCredentials(
+			credentials.NewStaticCredentials(opt.AwsAccessKeyId, opt.AwsSecretAccessKey, ""))
+		source = "static keys"
+	case opt.AwsProfile != "":
+		sessionOptions.Profile = opt.AwsProfile
+		sessionOptions.SharedConfigState = session.SharedConfigEnable
+		if opt.AwsSharedCredentialsFile != "" {
+			sessionOptions.SharedConfigFiles = []string{opt.AwsSharedCredentialsFile}
+		}
+		source = fmt.Sprintf("profile %s", opt.AwsProfile)
+	case opt.AwsCredentialProcess != "":
+		baseConfig = baseConfig.WithCredentials(processcreds.NewCredentials(opt.AwsCredentialProcess))
+		source = "aws_credential_process"
+	}
+	sessionOptions.Config = *baseConfig
+	sess, err := session.NewSessionWithOptions(sessionOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	sessionName := opt.AwsRoleSessionName
+	if sessionName == "" {
+		sessionName = DefaultRoleSessionName
+	}
+	var creds *credentials.Credentials
+	switch {
+	case opt.AwsWebIdentityTokenFile != "":
+		gplog.Verbose("Using role %s with the web identity token in %s", opt.AwsRoleArn, opt.AwsWebIdentityTokenFile)
+		return stscreds.NewWebIdentityCredentials(sess, opt.AwsRoleArn, sessionName, opt.AwsWebIdentityTokenFile), nil
+	case opt.AwsInstanceMetadata == "on":
+		creds = ec2rolecreds.NewCredentials(sess)
+		source = "the instance metadata service"
+	default:
+		creds = sess.Config.Credentials
+	}
+	if opt.AwsRoleArn == "" {
+		gplog.Verbose("Using credentials from %s", source)
+		return creds, nil
+	}
+
+	gplog.Verbose("Using role %s assumed with credentials from %s", opt.AwsRoleArn, source)
+	roleSession := sess.Copy(aws.NewConfig().WithCredentials(creds))
+	return stscreds.NewCredentials(roleSession, opt.AwsRoleArn, func(provider *stscreds.AssumeRoleProvider) {
+		provider.RoleSessionName = sessionName
+		provider.Duration = opt.AwsRoleDurationValue
+		provider.ExpiryWindow = roleExpiryWindow
+		if opt.AwsRoleExternalId != "" {
+			provider.ExternalID = aws.String(opt.AwsRoleExternalId)
+		}
+	}), nil
+}
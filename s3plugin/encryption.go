@@ -0,0 +1,287 @@
+package s3plugin
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+/*
+ * Client-side envelope encryption of backup streams.
+ *
+ * Every object is encrypted with its own randomly generated 256-bit data key.
+ * The data key is wrapped (encrypted) with the master key read from the local
+ * keyfile and stored, together with the algorithm and a fingerprint of the
+ * master key, in the object's metadata. The stream itself is split into
+ * chunks that are each sealed with AES-256-GCM. The chunk counter and a flag
+ * marking the final chunk are part of the nonce, so reordered, dropped or
+ * truncated chunks fail authentication just like modified bytes do.
+ */
+
+const (
+	cseAlgorithm       = "AES-256-GCM-STREAM"
+	cseChunkSize       = 64 * 1024
+	cseMetaAlgorithm   = "gpbackup-cse-algorithm"
+	cseMetaWrappedKey  = "gpbackup-cse-wrapped-key"
+	cseMetaKeyId       = "gpbackup-cse-key-id"
+	cseMetaChunkSize   = "gpbackup-cse-chunk-size"
+	cseDataKeyWrapAAD  = "gpbackup-s3-plugin data key"
+	cseMasterKeyLength = 32
+)
+
+// The keyfile holds either 32 raw bytes or the base64 encoding of them
+func readMasterKey(keyfile string) ([]byte, error) {
+	contents, err := ioutil.ReadFile(keyfile)
+	if err != nil {
+		return nil, err
+	}
+	if len(contents) == cseMasterKeyLength {
+		return contents, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(contents)))
+	if err != nil || len(key) != cseMasterKeyLength {
+		return nil, fmt.Errorf("Keyfile %s must contain a 256-bit key, either raw or base64 encoded", keyfile)
+	}
+	return key, nil
+}
+
+// A short fingerprint lets restore tell a wrong master key apart from tampering
+func keyFingerprint(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+/*
+ * The data key is unique per object, so a counter based nonce never repeats
+ * under the same key. The last byte of the nonce marks the final chunk.
+ */
+func chunkNonce(nonce []byte, counter uint64, final bool) []byte {
+	for i := range nonce {
+		nonce[i] = 0
+	}
+	binary.BigEndian.PutUint64(nonce[len(nonce)-9:len(nonce)-1], counter)
+	if final {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+func isClientSideEncrypted(metadata map[string]string) bool {
+	return getMetadataValue(metadata, cseMetaAlgorithm) != ""
+}
+
+type encryptingReader struct {
+	src     *bufio.Reader
+	aead    cipher.AEAD
+	nonce   []byte
+	counter uint64
+	plain   []byte
+	sealed  []byte
+	pending []byte
+	done    bool
+}
+
+/*
+ * Returns a reader producing the encrypted form of src and records the
+ * wrapped data key and algorithm in metadata.
+ */
+func newEncryptingReader(src io.Reader, masterKey []byte, metadata map[string]string) (io.Reader, error) {
+	dataKey := make([]byte, cseMasterKeyLength)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	wrappedKey, err := wrapDataKey(masterKey, dataKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata[cseMetaAlgorithm] = cseAlgorithm
+	metadata[cseMetaWrappedKey] = wrappedKey
+	metadata[cseMetaKeyId] = keyFingerprint(masterKey)
+	metadata[cseMetaChunkSize] = strconv.Itoa(cseChunkSize)
+
+	return &encryptingReader{
+		src:    bufio.NewReaderSize(src, cseChunkSize),
+		aead:   aead,
+		nonce:  make([]byte, aead.NonceSize()),
+		plain:  make([]byte, cseChunkSize),
+		sealed: make([]byte, 0, cseChunkSize+aead.Overhead()),
+	}, nil
+}
+
+func (r *encryptingReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.sealNextChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+func (r *encryptingReader) sealNextChunk() error {
+	final := false
+	n, err := io.ReadFull(r.src, r.plain)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		final = true
+	} else if err != nil {
+		return err
+	} else if _, err = r.src.Peek(1); err == io.EOF {
+		final = true
+	} else if err != nil {
+		return err
+	}
+
+	r.pending = r.aead.Seal(r.sealed[:0], chunkNonce(r.nonce, r.counter, final), r.plain[:n], nil)
+	r.counter++
+	r.done = final
+	return nil
+}
+
+type decryptingWriter struct {
+	dst        io.Writer
+	aead       cipher.AEAD
+	fileKey    string
+	nonce      []byte
+	counter    uint64
+	sealedSize int
+	buffer     []byte
+	plain      []byte
+}
+
+/*
+ * Returns a writer that decrypts the stream written to it into dst. Close
+ * must be called once the whole object was written to verify the final chunk.
+ */
+func newDecryptingWriter(masterKey []byte, fileKey string, metadata map[string]string,
+	dst io.Writer) (io.WriteCloser, error) {
+
+	algorithm := getMetadataValue(metadata, cseMetaAlgorithm)
+	if algorithm != cseAlgorithm {
+		return nil, fmt.Errorf("Object %s is encrypted with unsupported client-side encryption algorithm %s", fileKey, algorithm)
+	}
+	if len(masterKey) == 0 {
+		return nil, fmt.Errorf("Object %s is client-side encrypted, but no client_side_encryption_keyfile is configured", fileKey)
+	}
+	keyId := getMetadataValue(metadata, cseMetaKeyId)
+	if keyId != keyFingerprint(masterKey) {
+		return nil, fmt.Errorf("Object %s was encrypted with master key %s, but the configured master key is %s",
+			fileKey, keyId, keyFingerprint(masterKey))
+	}
+	chunkSize, err := strconv.Atoi(getMetadataValue(metadata, cseMetaChunkSize))
+	if err != nil || chunkSize <= 0 {
+		return nil, fmt.Errorf("Object %s has an invalid client-side encryption chunk size", fileKey)
+	}
+	dataKey, err := unwrapDataKey(masterKey, getMetadataValue(metadata, cseMetaWrappedKey))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to unwrap the data key of object %s: %s", fileKey, err)
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	sealedSize := chunkSize + aead.Overhead()
+	return &decryptingWriter{
+		dst:        dst,
+		aead:       aead,
+		fileKey:    fileKey,
+		nonce:      make([]byte, aead.NonceSize()),
+		sealedSize: sealedSize,
+		buffer:     make([]byte, 0, sealedSize),
+		plain:      make([]byte, 0, chunkSize),
+	}, nil
+}
+
+func (w *decryptingWriter) Write(p []byte) (int, error) {
+	written := len(p)
+	for len(p) > 0 {
+		// A full chunk is only known not to be the final one once more data
+		// arrives after it
+		if len(w.buffer) == w.sealedSize {
+			if err := w.openChunk(false); err != nil {
+				return 0, err
+			}
+		}
+		n := copy(w.buffer[len(w.buffer):w.sealedSize], p)
+		w.buffer = w.buffer[:len(w.buffer)+n]
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (w *decryptingWriter) Close() error {
+	return w.openChunk(true)
+}
+
+func (w *decryptingWriter) openChunk(final bool) error {
+	plain, err := w.aead.Open(w.plain[:0], chunkNonce(w.nonce, w.counter, final), w.buffer, nil)
+	if err != nil {
+		return fmt.Errorf("Client-side decryption of %s failed at chunk %d. "+
+			"The object is truncated or has been tampered with", w.fileKey, w.counter)
+	}
+	w.counter++
+	w.buffer = w.buffer[:0]
+	_, err = w.dst.Write(plain)
+	return err
+}
+
+func wrapDataKey(masterKey []byte, dataKey []byte) (string, error) {
+	aead, err := newGCM(masterKey)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return "", err
+	}
+	wrapped := aead.Seal(nonce, nonce, dataKey, []byte(cseDataKeyWrapAAD))
+	return base64.StdEncoding.EncodeToString(wrapped), nil
+}
+
+func unwrapDataKey(masterKey []byte, encoded string) ([]byte, error) {
+	aead, err := newGCM(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, errors.New("wrapped key is too short")
+	}
+	nonce, sealed := wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():]
+	dataKey, err := aead.Open(nil, nonce, sealed, []byte(cseDataKeyWrapAAD))
+	if err != nil {
+		return nil, errors.New("wrapped key failed authentication")
+	}
+	return dataKey, nil
+}
@@ -0,0 +1,86 @@
+package s3plugin
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("client-side encryption", func() {
+	var masterKey []byte
+	var metadata map[string]string
+
+	encrypt := func(plaintext []byte) []byte {
+		reader, err := newEncryptingReader(bytes.NewReader(plaintext), masterKey, metadata)
+		Expect(err).ToNot(HaveOccurred())
+		ciphertext, err := ioutil.ReadAll(reader)
+		Expect(err).ToNot(HaveOccurred())
+		return ciphertext
+	}
+	decrypt := func(key []byte, ciphertext []byte) ([]byte, error) {
+		output := &bytes.Buffer{}
+		writer, err := newDecryptingWriter(key, "backups/20180101/20180101082233/file", metadata, output)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = writer.Write(ciphertext); err != nil {
+			return nil, err
+		}
+		err = writer.Close()
+		return output.Bytes(), err
+	}
+
+	BeforeEach(func() {
+		masterKey = make([]byte, cseMasterKeyLength)
+		_, _ = rand.Read(masterKey)
+		metadata = make(map[string]string)
+	})
+	DescribeTable("round trips streams of different lengths",
+		func(length int) {
+			plaintext := make([]byte, length)
+			_, _ = rand.Read(plaintext)
+			ciphertext := encrypt(plaintext)
+			Expect(len(ciphertext)).To(BeNumerically(">", length))
+
+			result, err := decrypt(masterKey, ciphertext)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result).To(Equal(plaintext))
+		},
+		Entry("empty stream", 0),
+		Entry("less than a chunk", 100),
+		Entry("exactly one chunk", cseChunkSize),
+		Entry("several chunks", 3*cseChunkSize+17),
+	)
+	It("records the algorithm and wrapped key in the metadata", func() {
+		_ = encrypt([]byte("data"))
+		Expect(getMetadataValue(metadata, "Gpbackup-Cse-Algorithm")).To(Equal(cseAlgorithm))
+		Expect(getMetadataValue(metadata, cseMetaWrappedKey)).ToNot(BeEmpty())
+		Expect(getMetadataValue(metadata, cseMetaKeyId)).To(Equal(keyFingerprint(masterKey)))
+	})
+	It("fails when the ciphertext has been modified", func() {
+		ciphertext := encrypt(make([]byte, 2*cseChunkSize))
+		ciphertext[cseChunkSize/2] ^= 0xff
+		_, err := decrypt(masterKey, ciphertext)
+		Expect(err).To(MatchError(ContainSubstring("tampered with")))
+	})
+	It("fails when the ciphertext has been truncated at a chunk boundary", func() {
+		ciphertext := encrypt(make([]byte, 2*cseChunkSize+10))
+		_, err := decrypt(masterKey, ciphertext[:2*(cseChunkSize+16)])
+		Expect(err).To(MatchError(ContainSubstring("truncated")))
+	})
+	It("fails with a clear error when the master key is wrong", func() {
+		ciphertext := encrypt([]byte("data"))
+		otherKey := make([]byte, cseMasterKeyLength)
+		_, _ = rand.Read(otherKey)
+		_, err := decrypt(otherKey, ciphertext)
+		Expect(err).To(MatchError(ContainSubstring("was encrypted with master key")))
+	})
+	It("fails when the object is encrypted but no master key is configured", func() {
+		ciphertext := encrypt([]byte("data"))
+		_, err := decrypt(nil, ciphertext)
+		Expect(err).To(MatchError(ContainSubstring("no client_side_encryption_keyfile is configured")))
+	})
+})
@@ -0,0 +1,755 @@
+package s3plugin_test
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * An in-process stand-in for S3 that implements just enough of the REST API
+ * for the plugin: single and multipart uploads, ranged GETs, HEAD, paginated
+ * ListObjects (v1 and v2), batch deletes, restores of archived objects, object
+ * lock and tags. Requests are path-style
+ * (/<bucket>/<key>) and are not authenticated.
+ */
+
+const s3Namespace = "http://s3.amazonaws.com/doc/2006-03-01/"
+
+const standardStorageClass = "STANDARD"
+
+type fakeS3Object struct {
+	Data         []byte
+	Metadata     map[string]string
+	LastModified time.Time
+	ETag         string
+	StorageClass string
+	// The x-amz-restore status of an archived object, empty until a restore
+	// is requested, and the tier and days of the last request
+	Restore     string
+	RestoreTier string
+	RestoreDays int
+	Lock        fakeS3Lock
+	Tags        map[string]string
+}
+
+// The object lock headers of an upload as sent
+type fakeS3Lock struct {
+	Mode        string
+	RetainUntil string
+	LegalHold   string
+}
+
+type fakeS3Upload struct {
+	Key          string
+	Metadata     map[string]string
+	StorageClass string
+	Lock         fakeS3Lock
+	Tags         map[string]string
+	Parts        map[int][]byte
+	Initiated    time.Time
+}
+
+type fakeS3Failure struct {
+	method    string
+	keyPart   string
+	status    int
+	code      string
+	remaining int
+}
+
+type fakeS3Server struct {
+	*httptest.Server
+	Bucket   string
+	PageSize int
+	// Whether the bucket was created with object lock enabled
+	ObjectLockEnabled bool
+
+	mutex        sync.Mutex
+	objects      map[string]*fakeS3Object
+	uploads      map[string]*fakeS3Upload
+	failures     []*fakeS3Failure
+	nextUploadId int
+	Requests     []string
+	// The access key ids requests were signed with
+	AccessKeyIds []string
+}
+
+func newFakeS3Server(bucket string) *fakeS3Server {
+	server := &fakeS3Server{
+		Bucket:   bucket,
+		PageSize: 1000,
+		objects:  make(map[string]*fakeS3Object),
+		uploads:  make(map[string]*fakeS3Upload),
+	}
+	server.Server = httptest.NewServer(http.HandlerFunc(server.handle))
+	return server
+}
+
+/*
+ * Makes the next count requests with the given method (any method if empty)
+ * fail with status if keyPart is contained in their "<key>?<query>". A
+ * negative count fails them forever.
+ */
+func (s *fakeS3Server) InjectFailure(method string, keyPart string, status int, count int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	code := "InternalError"
+	switch status {
+	case http.StatusForbidden:
+		code = "AccessDenied"
+	case http.StatusServiceUnavailable:
+		code = "SlowDown"
+	}
+	s.failures = append(s.failures, &fakeS3Failure{method, keyPart, status, code, count})
+}
+
+// Starts a multipart upload of key holding a single part, as if started at initiated
+func (s *fakeS3Server) StartUpload(key string, initiated time.Time, part []byte) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.nextUploadId++
+	uploadId := fmt.Sprintf("upload-%d", s.nextUploadId)
+	s.uploads[uploadId] = &fakeS3Upload{Key: key, Metadata: map[string]string{},
+		Parts: map[int][]byte{1: part}, Initiated: initiated.UTC().Truncate(time.Second)}
+	return uploadId
+}
+
+func (s *fakeS3Server) ClearFailures() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.failures = nil
+}
+
+func (s *fakeS3Server) PutObject(key string, data []byte, metadata map[string]string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.storeObject(key, data, metadata)
+}
+
+func (s *fakeS3Server) DeleteObject(key string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.objects, key)
+}
+
+// Returns the multipart uploads in progress by upload id
+func (s *fakeS3Server) Uploads() map[string]*fakeS3Upload {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	uploads := make(map[string]*fakeS3Upload, len(s.uploads))
+	for uploadId, upload := range s.uploads {
+		uploads[uploadId] = upload
+	}
+	return uploads
+}
+
+// Moves key to an archive storage class, dropping any restored copy
+func (s *fakeS3Server) ArchiveObject(key string, storageClass string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.objects[key].StorageClass = storageClass
+	s.objects[key].Restore = ""
+}
+
+// Finishes a requested restore of key, keeping the copy until expiry
+func (s *fakeS3Server) CompleteRestore(key string, expiry time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.objects[key].Restore = fmt.Sprintf(`ongoing-request="false", expiry-date="%s"`,
+		expiry.UTC().Format(http.TimeFormat))
+}
+
+func (s *fakeS3Server) GetObject(key string) (*fakeS3Object, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	object, ok := s.objects[key]
+	return object, ok
+}
+
+func (s *fakeS3Server) Keys() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.sortedKeys()
+}
+
+func (s *fakeS3Server) storeObject(key string, data []byte, metadata map[string]string) {
+	sum := md5.Sum(data)
+	s.objects[key] = &fakeS3Object{
+		Data:         data,
+		Metadata:     metadata,
+		LastModified: time.Now().UTC().Truncate(time.Second),
+		ETag:         fmt.Sprintf(`"%s"`, hex.EncodeToString(sum[:])),
+		StorageClass: standardStorageClass,
+	}
+}
+
+func (s *fakeS3Server) sortedKeys() []string {
+	keys := make([]string, 0, len(s.objects))
+	for key := range s.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (s *fakeS3Server) handle(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	bucket, key := path, ""
+	if i := strings.Index(path, "/"); i >= 0 {
+		bucket, key = path[:i], path[i+1:]
+	}
+	s.Requests = append(s.Requests, fmt.Sprintf("%s %s?%s", r.Method, key, r.URL.RawQuery))
+	if _, credential, ok := strings.Cut(r.Header.Get("Authorization"), "Credential="); ok {
+		accessKeyId, _, _ := strings.Cut(credential, "/")
+		s.AccessKeyIds = append(s.AccessKeyIds, accessKeyId)
+	}
+	if bucket != s.Bucket {
+		writeS3Error(w, r, http.StatusNotFound, "NoSuchBucket", bucket)
+		return
+	}
+	if s.shouldFail(w, r, key) {
+		return
+	}
+
+	query := r.URL.Query()
+	switch {
+	case key == "" && r.Method == http.MethodGet && hasQuery(r, "object-lock"):
+		s.getObjectLockConfiguration(w, r)
+	case key == "" && r.Method == http.MethodGet && query.Get("list-type") == "2":
+		s.listObjectsV2(w, r)
+	case key == "" && r.Method == http.MethodGet:
+		s.listObjects(w, r)
+	case key == "" && r.Method == http.MethodGet && hasQuery(r, "uploads"):
+		s.listMultipartUploads(w, r)
+	case key == "" && r.Method == http.MethodPost && hasQuery(r, "delete"):
+		s.deleteObjects(w, r)
+	case r.Method == http.MethodGet && hasQuery(r, "tagging"):
+		s.getObjectTagging(w, r, key)
+	case r.Method == http.MethodPost && hasQuery(r, "restore"):
+		s.restoreObject(w, r, key)
+	case r.Method == http.MethodPost && hasQuery(r, "uploads"):
+		s.createMultipartUpload(w, r, key)
+	case r.Method == http.MethodPut && query.Get("uploadId") != "":
+		s.uploadPart(w, r)
+	case r.Method == http.MethodGet && query.Get("uploadId") != "":
+		s.listParts(w, r, key)
+	case r.Method == http.MethodPost && query.Get("uploadId") != "":
+		s.completeMultipartUpload(w, r, key)
+	case r.Method == http.MethodDelete && query.Get("uploadId") != "":
+		if _, ok := s.uploads[query.Get("uploadId")]; !ok {
+			writeS3Error(w, r, http.StatusNotFound, "NoSuchUpload", query.Get("uploadId"))
+			return
+		}
+		delete(s.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut:
+		body, _ := ioutil.ReadAll(r.Body)
+		lock := requestLock(r)
+		if !s.acceptsLock(w, r, key, lock) {
+			return
+		}
+		s.storeObject(key, body, requestMetadata(r))
+		s.objects[key].StorageClass = requestStorageClass(r)
+		s.objects[key].Lock = lock
+		s.objects[key].Tags = requestTags(r)
+		w.Header().Set("ETag", s.objects[key].ETag)
+	case r.Method == http.MethodHead || r.Method == http.MethodGet:
+		s.getObject(w, r, key)
+	case r.Method == http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeS3Error(w, r, http.StatusNotImplemented, "NotImplemented", key)
+	}
+}
+
+func (s *fakeS3Server) shouldFail(w http.ResponseWriter, r *http.Request, key string) bool {
+	for _, failure := range s.failures {
+		if failure.remaining == 0 || (failure.method != "" && failure.method != r.Method) ||
+			!strings.Contains(key+"?"+r.URL.RawQuery, failure.keyPart) {
+			continue
+		}
+		failure.remaining--
+		_, _ = ioutil.ReadAll(r.Body)
+		writeS3Error(w, r, failure.status, failure.code, key)
+		return true
+	}
+	return false
+}
+
+func hasQuery(r *http.Request, name string) bool {
+	_, ok := r.URL.Query()[name]
+	return ok
+}
+
+// S3 stores objects uploaded without a storage class as STANDARD
+func requestStorageClass(r *http.Request) string {
+	if storageClass := r.Header.Get("X-Amz-Storage-Class"); storageClass != "" {
+		return storageClass
+	}
+	return standardStorageClass
+}
+
+func requestTags(r *http.Request) map[string]string {
+	tags := make(map[string]string)
+	values, _ := url.ParseQuery(r.Header.Get("X-Amz-Tagging"))
+	for key := range values {
+		tags[key] = values.Get(key)
+	}
+	return tags
+}
+
+func requestLock(r *http.Request) fakeS3Lock {
+	return fakeS3Lock{
+		Mode:        r.Header.Get("X-Amz-Object-Lock-Mode"),
+		RetainUntil: r.Header.Get("X-Amz-Object-Lock-Retain-Until-Date"),
+		LegalHold:   r.Header.Get("X-Amz-Object-Lock-Legal-Hold"),
+	}
+}
+
+// S3 rejects object lock headers for buckets without object lock and
+// retention without a Content-MD5 header
+func (s *fakeS3Server) acceptsLock(w http.ResponseWriter, r *http.Request, key string, lock fakeS3Lock) bool {
+	if lock == (fakeS3Lock{}) {
+		return true
+	}
+	if !s.ObjectLockEnabled || (lock.Mode != "" && r.Header.Get("Content-Md5") == "") {
+		writeS3Error(w, r, http.StatusBadRequest, "InvalidRequest", key)
+		return false
+	}
+	return true
+}
+
+func isArchived(object *fakeS3Object) bool {
+	return object.StorageClass == "GLACIER" || object.StorageClass == "DEEP_ARCHIVE"
+}
+
+func isRestored(object *fakeS3Object) bool {
+	return strings.Contains(object.Restore, `ongoing-request="false"`)
+}
+
+func requestMetadata(r *http.Request) map[string]string {
+	metadata := make(map[string]string)
+	for name, values := range r.Header {
+		if strings.HasPrefix(strings.ToLower(name), "x-amz-meta-") {
+			metadata[strings.ToLower(name[len("x-amz-meta-"):])] = values[0]
+		}
+	}
+	return metadata
+}
+
+func writeS3Error(w http.ResponseWriter, r *http.Request, status int, code string, resource string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	if r.Method == http.MethodHead {
+		return
+	}
+	_, _ = fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>`+
+		`<Error><Code>%s</Code><Message>%s</Message><Resource>%s</Resource></Error>`,
+		code, http.StatusText(status), resource)
+}
+
+func writeXML(w http.ResponseWriter, response interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	contents, _ := xml.Marshal(response)
+	_, _ = w.Write([]byte(xml.Header))
+	_, _ = w.Write(contents)
+}
+
+func (s *fakeS3Server) getObject(w http.ResponseWriter, r *http.Request, key string) {
+	object, ok := s.objects[key]
+	if !ok {
+		writeS3Error(w, r, http.StatusNotFound, "NoSuchKey", key)
+		return
+	}
+	for name, value := range object.Metadata {
+		w.Header().Set("X-Amz-Meta-"+name, value)
+	}
+	w.Header().Set("ETag", object.ETag)
+	w.Header().Set("Last-Modified", object.LastModified.Format(http.TimeFormat))
+	if object.StorageClass != standardStorageClass {
+		w.Header().Set("X-Amz-Storage-Class", object.StorageClass)
+	}
+	if object.Restore != "" {
+		w.Header().Set("X-Amz-Restore", object.Restore)
+	}
+	if object.Lock.Mode != "" {
+		w.Header().Set("X-Amz-Object-Lock-Mode", object.Lock.Mode)
+		w.Header().Set("X-Amz-Object-Lock-Retain-Until-Date", object.Lock.RetainUntil)
+	}
+	if object.Lock.LegalHold != "" {
+		w.Header().Set("X-Amz-Object-Lock-Legal-Hold", object.Lock.LegalHold)
+	}
+	if r.Method == http.MethodGet && isArchived(object) && !isRestored(object) {
+		writeS3Error(w, r, http.StatusForbidden, "InvalidObjectState", key)
+		return
+	}
+
+	data := object.Data
+	status := http.StatusOK
+	if byteRange := r.Header.Get("Range"); byteRange != "" {
+		var start, end int
+		if _, err := fmt.Sscanf(byteRange, "bytes=%d-%d", &start, &end); err != nil || start >= len(data) {
+			writeS3Error(w, r, http.StatusRequestedRangeNotSatisfiable, "InvalidRange", key)
+			return
+		}
+		if end >= len(data) {
+			end = len(data) - 1
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+		data = data[start : end+1]
+		status = http.StatusPartialContent
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(status)
+	if r.Method == http.MethodGet {
+		_, _ = w.Write(data)
+	}
+}
+
+func (s *fakeS3Server) restoreObject(w http.ResponseWriter, r *http.Request, key string) {
+	object, ok := s.objects[key]
+	if !ok {
+		writeS3Error(w, r, http.StatusNotFound, "NoSuchKey", key)
+		return
+	}
+	request := struct {
+		Days int
+		Tier string `xml:"GlacierJobParameters>Tier"`
+	}{}
+	body, _ := ioutil.ReadAll(r.Body)
+	if err := xml.Unmarshal(body, &request); err != nil {
+		writeS3Error(w, r, http.StatusBadRequest, "MalformedXML", key)
+		return
+	}
+	switch {
+	case !isArchived(object):
+		writeS3Error(w, r, http.StatusForbidden, "InvalidObjectState", key)
+		return
+	case object.Restore != "" && !isRestored(object):
+		writeS3Error(w, r, http.StatusConflict, "RestoreAlreadyInProgress", key)
+		return
+	}
+	object.RestoreTier, object.RestoreDays = request.Tier, request.Days
+	if isRestored(object) {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	object.Restore = `ongoing-request="true"`
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (s *fakeS3Server) getObjectTagging(w http.ResponseWriter, r *http.Request, key string) {
+	object, ok := s.objects[key]
+	if !ok {
+		writeS3Error(w, r, http.StatusNotFound, "NoSuchKey", key)
+		return
+	}
+	type tag struct {
+		Key   string
+		Value string
+	}
+	tags := make([]tag, 0, len(object.Tags))
+	for key, value := range object.Tags {
+		tags = append(tags, tag{key, value})
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		return tags[i].Key < tags[j].Key
+	})
+	writeXML(w, struct {
+		XMLName xml.Name `xml:"Tagging"`
+		Xmlns   string   `xml:"xmlns,attr"`
+		Tags    []tag    `xml:"TagSet>Tag"`
+	}{Xmlns: s3Namespace, Tags: tags})
+}
+
+func (s *fakeS3Server) getObjectLockConfiguration(w http.ResponseWriter, r *http.Request) {
+	if !s.ObjectLockEnabled {
+		writeS3Error(w, r, http.StatusNotFound, "ObjectLockConfigurationNotFoundError", s.Bucket)
+		return
+	}
+	writeXML(w, struct {
+		XMLName           xml.Name `xml:"ObjectLockConfiguration"`
+		Xmlns             string   `xml:"xmlns,attr"`
+		ObjectLockEnabled string
+	}{Xmlns: s3Namespace, ObjectLockEnabled: "Enabled"})
+}
+
+func (s *fakeS3Server) createMultipartUpload(w http.ResponseWriter, r *http.Request, key string) {
+	lock := requestLock(r)
+	if !s.ObjectLockEnabled && lock != (fakeS3Lock{}) {
+		writeS3Error(w, r, http.StatusBadRequest, "InvalidRequest", key)
+		return
+	}
+	s.nextUploadId++
+	uploadId := fmt.Sprintf("upload-%d", s.nextUploadId)
+	s.uploads[uploadId] = &fakeS3Upload{Key: key, Metadata: requestMetadata(r), StorageClass: requestStorageClass(r),
+		Lock: lock, Tags: requestTags(r), Parts: make(map[int][]byte), Initiated: time.Now().UTC().Truncate(time.Second)}
+	writeXML(w, struct {
+		XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+		Xmlns    string   `xml:"xmlns,attr"`
+		Bucket   string
+		Key      string
+		UploadId string
+	}{Xmlns: s3Namespace, Bucket: s.Bucket, Key: key, UploadId: uploadId})
+}
+
+func (s *fakeS3Server) uploadPart(w http.ResponseWriter, r *http.Request) {
+	upload, ok := s.uploads[r.URL.Query().Get("uploadId")]
+	if !ok {
+		writeS3Error(w, r, http.StatusNotFound, "NoSuchUpload", r.URL.Query().Get("uploadId"))
+		return
+	}
+	partNumber, _ := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	body, _ := ioutil.ReadAll(r.Body)
+	if upload.Lock.Mode != "" && r.Header.Get("Content-Md5") == "" {
+		writeS3Error(w, r, http.StatusBadRequest, "InvalidRequest", upload.Key)
+		return
+	}
+	upload.Parts[partNumber] = body
+	sum := md5.Sum(body)
+	w.Header().Set("ETag", fmt.Sprintf(`"%s"`, hex.EncodeToString(sum[:])))
+}
+
+func (s *fakeS3Server) completeMultipartUpload(w http.ResponseWriter, r *http.Request, key string) {
+	uploadId := r.URL.Query().Get("uploadId")
+	upload, ok := s.uploads[uploadId]
+	if !ok {
+		writeS3Error(w, r, http.StatusNotFound, "NoSuchUpload", uploadId)
+		return
+	}
+	request := struct {
+		Parts []struct {
+			PartNumber int
+		} `xml:"Part"`
+	}{}
+	body, _ := ioutil.ReadAll(r.Body)
+	if err := xml.Unmarshal(body, &request); err != nil {
+		writeS3Error(w, r, http.StatusBadRequest, "MalformedXML", key)
+		return
+	}
+	data := make([]byte, 0)
+	for _, part := range request.Parts {
+		partData, ok := upload.Parts[part.PartNumber]
+		if !ok {
+			writeS3Error(w, r, http.StatusBadRequest, "InvalidPart", key)
+			return
+		}
+		data = append(data, partData...)
+	}
+	s.storeObject(key, data, upload.Metadata)
+	s.objects[key].StorageClass = upload.StorageClass
+	s.objects[key].Lock = upload.Lock
+	s.objects[key].Tags = upload.Tags
+	delete(s.uploads, uploadId)
+	writeXML(w, struct {
+		XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+		Xmlns   string   `xml:"xmlns,attr"`
+		Bucket  string
+		Key     string
+		ETag    string
+	}{Xmlns: s3Namespace, Bucket: s.Bucket, Key: key, ETag: s.objects[key].ETag})
+}
+
+func (s *fakeS3Server) listParts(w http.ResponseWriter, r *http.Request, key string) {
+	uploadId := r.URL.Query().Get("uploadId")
+	upload, ok := s.uploads[uploadId]
+	if !ok {
+		writeS3Error(w, r, http.StatusNotFound, "NoSuchUpload", uploadId)
+		return
+	}
+	type part struct {
+		PartNumber int
+		ETag       string
+		Size       int
+	}
+	response := struct {
+		XMLName     xml.Name `xml:"ListPartsResult"`
+		Xmlns       string   `xml:"xmlns,attr"`
+		Bucket      string
+		Key         string
+		UploadId    string
+		IsTruncated bool
+		Parts       []part `xml:"Part"`
+	}{Xmlns: s3Namespace, Bucket: s.Bucket, Key: key, UploadId: uploadId}
+	numbers := make([]int, 0, len(upload.Parts))
+	for number := range upload.Parts {
+		numbers = append(numbers, number)
+	}
+	sort.Ints(numbers)
+	for _, number := range numbers {
+		sum := md5.Sum(upload.Parts[number])
+		response.Parts = append(response.Parts, part{number, fmt.Sprintf(`"%s"`, hex.EncodeToString(sum[:])), len(upload.Parts[number])})
+	}
+	writeXML(w, response)
+}
+
+func (s *fakeS3Server) listMultipartUploads(w http.ResponseWriter, r *http.Request) {
+	type upload struct {
+		Key       string
+		UploadId  string
+		Initiated string
+	}
+	response := struct {
+		XMLName     xml.Name `xml:"ListMultipartUploadsResult"`
+		Xmlns       string   `xml:"xmlns,attr"`
+		Bucket      string
+		Prefix      string
+		IsTruncated bool
+		Uploads     []upload `xml:"Upload"`
+	}{Xmlns: s3Namespace, Bucket: s.Bucket, Prefix: r.URL.Query().Get("prefix")}
+	uploadIds := make([]string, 0, len(s.uploads))
+	for uploadId := range s.uploads {
+		uploadIds = append(uploadIds, uploadId)
+	}
+	sort.Strings(uploadIds)
+	for _, uploadId := range uploadIds {
+		if strings.HasPrefix(s.uploads[uploadId].Key, response.Prefix) {
+			response.Uploads = append(response.Uploads, upload{s.uploads[uploadId].Key, uploadId,
+				s.uploads[uploadId].Initiated.Format(time.RFC3339)})
+		}
+	}
+	writeXML(w, response)
+}
+
+func (s *fakeS3Server) deleteObjects(w http.ResponseWriter, r *http.Request) {
+	request := struct {
+		Objects []struct {
+			Key string
+		} `xml:"Object"`
+	}{}
+	body, _ := ioutil.ReadAll(r.Body)
+	if err := xml.Unmarshal(body, &request); err != nil {
+		writeS3Error(w, r, http.StatusBadRequest, "MalformedXML", "")
+		return
+	}
+	type deleted struct {
+		Key string
+	}
+	response := struct {
+		XMLName xml.Name  `xml:"DeleteResult"`
+		Xmlns   string    `xml:"xmlns,attr"`
+		Deleted []deleted `xml:"Deleted"`
+	}{Xmlns: s3Namespace}
+	for _, object := range request.Objects {
+		delete(s.objects, object.Key)
+		response.Deleted = append(response.Deleted, deleted{object.Key})
+	}
+	writeXML(w, response)
+}
+
+type fakeS3ListEntry struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int
+	StorageClass string
+}
+
+type fakeS3CommonPrefix struct {
+	Prefix string
+}
+
+/*
+ * Returns the keys and common prefixes under prefix that sort after marker,
+ * at most PageSize (or maxKeys if smaller) of them, and whether more remain
+ */
+func (s *fakeS3Server) listPage(r *http.Request, marker string) ([]fakeS3ListEntry, []fakeS3CommonPrefix, string, bool) {
+	query := r.URL.Query()
+	prefix, delimiter := query.Get("prefix"), query.Get("delimiter")
+	pageSize := s.PageSize
+	if maxKeys, err := strconv.Atoi(query.Get("max-keys")); err == nil && maxKeys < pageSize {
+		pageSize = maxKeys
+	}
+
+	entries := make([]fakeS3ListEntry, 0)
+	prefixes := make([]fakeS3CommonPrefix, 0)
+	last := ""
+	for _, key := range s.sortedKeys() {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		name := key
+		if i := strings.Index(key[len(prefix):], delimiter); delimiter != "" && i >= 0 {
+			name = key[:len(prefix)+i+len(delimiter)]
+		}
+		if name <= marker || name == last {
+			continue
+		}
+		if len(entries)+len(prefixes) == pageSize {
+			return entries, prefixes, last, true
+		}
+		last = name
+		if name != key {
+			prefixes = append(prefixes, fakeS3CommonPrefix{name})
+			continue
+		}
+		object := s.objects[key]
+		entries = append(entries, fakeS3ListEntry{key, object.LastModified.Format(time.RFC3339),
+			object.ETag, len(object.Data), object.StorageClass})
+	}
+	return entries, prefixes, last, false
+}
+
+func (s *fakeS3Server) listObjectsV2(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	marker := query.Get("continuation-token")
+	if marker == "" {
+		marker = query.Get("start-after")
+	}
+	entries, prefixes, last, truncated := s.listPage(r, marker)
+	response := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Xmlns                 string   `xml:"xmlns,attr"`
+		Name                  string
+		Prefix                string
+		Delimiter             string `xml:",omitempty"`
+		KeyCount              int
+		IsTruncated           bool
+		ContinuationToken     string               `xml:",omitempty"`
+		NextContinuationToken string               `xml:",omitempty"`
+		Contents              []fakeS3ListEntry    `xml:"Contents"`
+		CommonPrefixes        []fakeS3CommonPrefix `xml:"CommonPrefixes"`
+	}{Xmlns: s3Namespace, Name: s.Bucket, Prefix: query.Get("prefix"), Delimiter: query.Get("delimiter"),
+		KeyCount: len(entries) + len(prefixes), IsTruncated: truncated,
+		ContinuationToken: query.Get("continuation-token"), Contents: entries, CommonPrefixes: prefixes}
+	if truncated {
+		response.NextContinuationToken = last
+	}
+	writeXML(w, response)
+}
+
+func (s *fakeS3Server) listObjects(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	entries, prefixes, last, truncated := s.listPage(r, query.Get("marker"))
+	response := struct {
+		XMLName        xml.Name `xml:"ListBucketResult"`
+		Xmlns          string   `xml:"xmlns,attr"`
+		Name           string
+		Prefix         string
+		Marker         string
+		NextMarker     string `xml:",omitempty"`
+		IsTruncated    bool
+		Contents       []fakeS3ListEntry    `xml:"Contents"`
+		CommonPrefixes []fakeS3CommonPrefix `xml:"CommonPrefixes"`
+	}{Xmlns: s3Namespace, Name: s.Bucket, Prefix: query.Get("prefix"), Marker: query.Get("marker"),
+		IsTruncated: truncated, Contents: entries, CommonPrefixes: prefixes}
+	if truncated {
+		response.NextMarker = last
+	}
+	writeXML(w, response)
+}
@@ -0,0 +1,335 @@
+package s3plugin
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/greenplum-db/gp-common-go-libs/gplog"
+)
+
+/*
+ * Host-wide coordination of transfers.
+ *
+ * With host_max_concurrent_requests or host_max_bandwidth set, the plugin
+ * processes of a host share those limits through lock files in the host
+ * directory of upload_state_dir. A process that transfers data registers with
+ * a file it keeps locked until it finishes, so the processes taking part are
+ * the ones whose registration is locked. Every request to S3 holds one of
+ * host_max_concurrent_requests slot files locked while it runs, and a process
+ * holds no more than its fair share of the slots, so a single segment cannot
+ * starve the others. Bandwidth is shared the same way, each process throttles
+ * itself to host_max_bandwidth divided by the number of processes. The kernel
+ * drops the locks of a process that dies, so a killed backup does not keep its
+ * share.
+ */
+
+var hostCoordinationPollInterval = 20 * time.Millisecond
+
+// How long the number of processes on the host is reused before counting again
+const hostProcessesRefreshInterval = time.Second
+
+type hostCoordinator struct {
+	dir          string
+	maxRequests  int
+	maxBandwidth int64
+	registration *os.File
+	// The file keeps the name it was opened with when it is renamed
+	registrationPath string
+
+	slotsMutex sync.Mutex
+	slots      map[int]*os.File
+
+	processesMutex sync.Mutex
+	processes      int
+	processesAt    time.Time
+}
+
+func validateHostCoordination(opt *PluginOptions) string {
+	var errTxt string
+	var err error
+	if opt.HostMaxConcurrentRequests != "" {
+		opt.HostMaxRequests, err = strconv.Atoi(opt.HostMaxConcurrentRequests)
+		if err != nil || opt.HostMaxRequests < 1 {
+			errTxt += fmt.Sprintf("Invalid host_max_concurrent_requests. It must be a positive number\n")
+		}
+	}
+	if opt.HostMaxBandwidth != "" {
+		opt.HostMaxBandwidthBytes, err = parseBandwidth(opt.HostMaxBandwidth)
+		if err != nil {
+			errTxt += fmt.Sprintf("Invalid host_max_bandwidth. Err: %s\n", err)
+		}
+	}
+	return errTxt
+}
+
+func isHostCoordinated(opt *PluginOptions) bool {
+	return opt.HostMaxRequests > 0 || opt.HostMaxBandwidthBytes > 0
+}
+
+func hostCoordinationDir(config *PluginConfig) string {
+	return filepath.Join(config.Options.UploadStateDir, "host")
+}
+
+// Locks path without waiting. It returns nil if another process holds the lock.
+func tryLockFile(path string, flags int) (*os.File, error) {
+	file, err := os.OpenFile(path, flags|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		file.Close()
+		return nil, nil
+	} else if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("Unable to lock %s: %s", path, err)
+	}
+	return file, nil
+}
+
+/*
+ * Returns the number of processes registered in dir, counting the registration
+ * own without locking it, and removes the registrations of processes that
+ * died. It is at least 1.
+ */
+func countHostProcesses(dir string, own string) int {
+	processesDir := filepath.Join(dir, "processes")
+	entries, err := ioutil.ReadDir(processesDir)
+	if err != nil {
+		gplog.Verbose("Unable to list plugin processes in %s: %s", processesDir, err)
+	}
+	count := 0
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		path := filepath.Join(processesDir, entry.Name())
+		if path == own {
+			count++
+			continue
+		}
+		file, err := tryLockFile(path, 0)
+		if err != nil {
+			continue
+		}
+		if file == nil {
+			count++
+			continue
+		}
+		// Registrations only appear by being renamed into place once locked,
+		// so this one cannot be taken over while it is removed
+		if err = os.Remove(path); err == nil {
+			gplog.Verbose("Removed registration %s of a plugin process that ended", path)
+		}
+		file.Close()
+	}
+	if count < 1 {
+		count = 1
+	}
+	return count
+}
+
+/*
+ * Prepares the host directory when a backup or restore starts and removes what
+ * processes that were killed left behind.
+ */
+func prepareHostCoordination(config *PluginConfig) error {
+	opt := &config.Options
+	if !isHostCoordinated(opt) {
+		return nil
+	}
+	dir := hostCoordinationDir(config)
+	for _, subdir := range []string{"processes", "slots"} {
+		if err := os.MkdirAll(filepath.Join(dir, subdir), 0700); err != nil {
+			return fmt.Errorf("Unable to prepare host coordination in %s: %s", dir, err)
+		}
+	}
+	numProcesses := countHostProcesses(dir, "")
+	gplog.Verbose("Plugin processes on this host share host_max_concurrent_requests %d and host_max_bandwidth %d "+
+		"bytes/s, %d processes are transferring", opt.HostMaxRequests, opt.HostMaxBandwidthBytes, numProcesses)
+	return nil
+}
+
+/*
+ * Registers this process with the other plugin processes of the host. Without
+ * host limits it returns nil, which coordinates nothing.
+ */
+func joinHostCoordination(config *PluginConfig) (*hostCoordinator, error) {
+	opt := &config.Options
+	if !isHostCoordinated(opt) {
+		return nil, nil
+	}
+	if err := prepareHostCoordination(config); err != nil {
+		return nil, err
+	}
+	dir := hostCoordinationDir(config)
+	processesDir := filepath.Join(dir, "processes")
+	pending := filepath.Join(processesDir, fmt.Sprintf(".%d.pending", os.Getpid()))
+	registration, err := tryLockFile(pending, os.O_CREATE)
+	if err == nil && registration == nil {
+		err = fmt.Errorf("%s is locked by another process", pending)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to register with the plugin processes of this host: %s", err)
+	}
+	registered := filepath.Join(processesDir, fmt.Sprintf("%d.lock", os.Getpid()))
+	if err = os.Rename(pending, registered); err != nil {
+		registration.Close()
+		return nil, fmt.Errorf("Unable to register with the plugin processes of this host: %s", err)
+	}
+
+	h := &hostCoordinator{
+		dir:              dir,
+		maxRequests:      opt.HostMaxRequests,
+		maxBandwidth:     opt.HostMaxBandwidthBytes,
+		registration:     registration,
+		slots:            make(map[int]*os.File),
+		registrationPath: registered,
+	}
+	gplog.Verbose("Registered with %d plugin processes transferring on this host", h.activeProcesses())
+	return h, nil
+}
+
+// Ends the registration of this process and frees any slots it still holds
+func (h *hostCoordinator) leave() {
+	if h == nil {
+		return
+	}
+	h.slotsMutex.Lock()
+	for slot, file := range h.slots {
+		file.Close()
+		delete(h.slots, slot)
+	}
+	h.slotsMutex.Unlock()
+	_ = os.Remove(h.registrationPath)
+	h.registration.Close()
+}
+
+func (h *hostCoordinator) activeProcesses() int {
+	h.processesMutex.Lock()
+	defer h.processesMutex.Unlock()
+	if time.Since(h.processesAt) >= hostProcessesRefreshInterval {
+		h.processes = countHostProcesses(h.dir, h.registrationPath)
+		h.processesAt = time.Now()
+	}
+	return h.processes
+}
+
+// The number of requests this process may run at once
+func (h *hostCoordinator) requestShare() int {
+	share := h.maxRequests / h.activeProcesses()
+	if share < 1 {
+		share = 1
+	}
+	return share
+}
+
+/*
+ * Blocks until this process may send another request and returns the function
+ * that ends it. Without host_max_concurrent_requests it returns at once. If the
+ * slot files cannot be used the request is sent anyway, as failing the backup
+ * would be worse than exceeding the limit.
+ */
+func (h *hostCoordinator) acquireRequest() func() {
+	if h == nil || h.maxRequests == 0 {
+		return func() {}
+	}
+	for {
+		share := h.requestShare()
+		h.slotsMutex.Lock()
+		for slot := 0; slot < h.maxRequests && len(h.slots) < share; slot++ {
+			if _, held := h.slots[slot]; held {
+				continue
+			}
+			file, err := tryLockFile(filepath.Join(h.dir, "slots", fmt.Sprintf("%d.lock", slot)), os.O_CREATE)
+			if err != nil {
+				h.slotsMutex.Unlock()
+				gplog.Warn("Sending request without host_max_concurrent_requests: %s", err)
+				return func() {}
+			}
+			if file != nil {
+				h.slots[slot] = file
+				h.slotsMutex.Unlock()
+				return func() { h.releaseRequest(slot) }
+			}
+		}
+		h.slotsMutex.Unlock()
+		time.Sleep(hostCoordinationPollInterval)
+	}
+}
+
+func (h *hostCoordinator) releaseRequest(slot int) {
+	h.slotsMutex.Lock()
+	defer h.slotsMutex.Unlock()
+	if file, held := h.slots[slot]; held {
+		file.Close()
+		delete(h.slots, slot)
+	}
+}
+
+/*
+ * Makes every attempt of a request made by the SDK, including retries, hold a
+ * request slot while it is sent.
+ */
+func (h *hostCoordinator) requestOption() request.Option {
+	return func(r *request.Request) {
+		var release func()
+		r.Handlers.Send.PushFront(func(r *request.Request) {
+			release = h.acquireRequest()
+		})
+		r.Handlers.CompleteAttempt.PushBack(func(r *request.Request) {
+			if release != nil {
+				release()
+				release = nil
+			}
+		})
+	}
+}
+
+// The part of host_max_bandwidth this process may use, 0 without a limit
+func (h *hostCoordinator) bandwidthShare() float64 {
+	if h == nil || h.maxBandwidth == 0 {
+		return 0
+	}
+	return float64(h.maxBandwidth) / float64(h.activeProcesses())
+}
+
+/*
+ * Prepares this process for the given number of simultaneous transfers in
+ * direction. It reserves their memory in the host memory budget, registers
+ * with the host coordination of requests and bandwidth and limits the
+ * bandwidth of the transfers. The returned function undoes it all.
+ */
+func beginTransfers(config *PluginConfig, storage Storage, direction string, transfers int) (func(), error) {
+	release, err := reserveTransferMemory(config, direction, transfers)
+	if err != nil {
+		return nil, err
+	}
+	host, err := joinHostCoordination(config)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	// The primary and the replica share the requests and bandwidth of the process
+	limiter := newTransferLimiter(&config.Options, direction, host)
+	for _, s3 := range bucketStorages(storage) {
+		s3.host = host
+		s3.limiter = limiter
+	}
+	if filesystem, ok := primaryStorage(storage).(*filesystemStorage); ok {
+		filesystem.host = host
+		filesystem.limiter = limiter
+	}
+	return func() {
+		host.leave()
+		release()
+	}, nil
+}
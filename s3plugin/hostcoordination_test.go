@@ -0,0 +1,142 @@
+package s3plugin
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("host coordination", func() {
+	var config *PluginConfig
+	var stateDir string
+
+	// Registers another process the way joinHostCoordination does, the lock
+	// of a separately opened file conflicts like one of another process
+	registerOther := func(name string) *os.File {
+		path := filepath.Join(hostCoordinationDir(config), "processes", name)
+		file, err := tryLockFile(path, os.O_CREATE)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(file).ToNot(BeNil())
+		return file
+	}
+
+	BeforeEach(func() {
+		var err error
+		stateDir, err = ioutil.TempDir("", "s3plugin_host")
+		Expect(err).ToNot(HaveOccurred())
+		config = &PluginConfig{Options: PluginOptions{UploadStateDir: stateDir}}
+	})
+	AfterEach(func() {
+		_ = os.RemoveAll(stateDir)
+	})
+
+	It("validates the host limits", func() {
+		opt := &PluginOptions{HostMaxConcurrentRequests: "8", HostMaxBandwidth: "200MB/s"}
+		Expect(validateHostCoordination(opt)).To(BeEmpty())
+		Expect(opt.HostMaxRequests).To(Equal(8))
+		Expect(opt.HostMaxBandwidthBytes).To(Equal(int64(200 * Mebibyte)))
+
+		opt = &PluginOptions{HostMaxConcurrentRequests: "0", HostMaxBandwidth: "fast"}
+		errTxt := validateHostCoordination(opt)
+		Expect(errTxt).To(ContainSubstring("Invalid host_max_concurrent_requests"))
+		Expect(errTxt).To(ContainSubstring("Invalid host_max_bandwidth"))
+	})
+	It("does not coordinate without host limits", func() {
+		host, err := joinHostCoordination(config)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(host).To(BeNil())
+		host.acquireRequest()()
+		host.leave()
+	})
+	It("shares the request slots fairly among the processes of the host", func() {
+		config.Options.HostMaxRequests = 4
+		Expect(prepareHostCoordination(config)).To(Succeed())
+		other := registerOther("1.lock")
+		defer other.Close()
+
+		host, err := joinHostCoordination(config)
+		Expect(err).ToNot(HaveOccurred())
+		defer host.leave()
+		Expect(host.activeProcesses()).To(Equal(2))
+
+		var mutex sync.Mutex
+		running, mostRunning := 0, 0
+		var wg sync.WaitGroup
+		for i := 0; i < 6; i++ {
+			wg.Add(1)
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+				release := host.acquireRequest()
+				mutex.Lock()
+				running++
+				if running > mostRunning {
+					mostRunning = running
+				}
+				mutex.Unlock()
+				time.Sleep(50 * time.Millisecond)
+				mutex.Lock()
+				running--
+				mutex.Unlock()
+				release()
+			}()
+		}
+		wg.Wait()
+		Expect(mostRunning).To(Equal(2))
+	})
+	It("waits for slots held by other processes", func() {
+		config.Options.HostMaxRequests = 1
+		host, err := joinHostCoordination(config)
+		Expect(err).ToNot(HaveOccurred())
+		defer host.leave()
+		slot, err := tryLockFile(filepath.Join(hostCoordinationDir(config), "slots", "0.lock"), os.O_CREATE)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(slot).ToNot(BeNil())
+
+		acquired := make(chan bool)
+		go func() {
+			host.acquireRequest()()
+			close(acquired)
+		}()
+		Consistently(acquired, 200*time.Millisecond).ShouldNot(BeClosed())
+		slot.Close()
+		Eventually(acquired).Should(BeClosed())
+	})
+	It("drops the registrations of processes that ended", func() {
+		config.Options.HostMaxRequests = 2
+		Expect(prepareHostCoordination(config)).To(Succeed())
+		registerOther("1.lock").Close()
+		living := registerOther("2.lock")
+		defer living.Close()
+
+		Expect(countHostProcesses(hostCoordinationDir(config), "")).To(Equal(1))
+		Expect(filepath.Join(hostCoordinationDir(config), "processes", "1.lock")).ToNot(BeAnExistingFile())
+		Expect(filepath.Join(hostCoordinationDir(config), "processes", "2.lock")).To(BeAnExistingFile())
+	})
+	It("divides host_max_bandwidth among the processes of the host", func() {
+		config.Options.HostMaxBandwidthBytes = 2 * Mebibyte
+		Expect(prepareHostCoordination(config)).To(Succeed())
+		other := registerOther("1.lock")
+		defer other.Close()
+		host, err := joinHostCoordination(config)
+		Expect(err).ToNot(HaveOccurred())
+		defer host.leave()
+
+		Expect(host.bandwidthShare()).To(Equal(float64(Mebibyte)))
+	})
+	It("removes its registration when it leaves", func() {
+		config.Options.HostMaxRequests = 1
+		host, err := joinHostCoordination(config)
+		Expect(err).ToNot(HaveOccurred())
+		registration := filepath.Join(hostCoordinationDir(config), "processes", fmt.Sprintf("%d.lock", os.Getpid()))
+		Expect(registration).To(BeAnExistingFile())
+		host.leave()
+		Expect(registration).ToNot(BeAnExistingFile())
+	})
+})
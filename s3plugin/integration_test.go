@@ -0,0 +1,1111 @@
+package s3plugin_test
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/greenplum-db/gp-common-go-libs/operating"
+	"github.com/greenplum-db/gp-common-go-libs/testhelper"
+	"github.com/greenplum-db/gpbackup-s3-plugin/s3plugin"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+)
+
+var _ = Describe("plugin commands against an S3 compatible server", func() {
+	const timestamp = "20180101082233"
+	var server *fakeS3Server
+	var localDir, configPath, backupDir string
+
+	writeConfig := func(extraOptions string) {
+		contents := fmt.Sprintf(`executablepath: /tmp/location
+options:
+  endpoint: %s
+  region: us-east-1
+  aws_access_key_id: "12345"
+  aws_secret_access_key: "6789"
+  bucket: testbucket
+  folder: folder_name
+  encryption: "off"
+  backup_multipart_chunksize: 5MB
+  backup_max_concurrent_requests: "2"
+  restore_multipart_chunksize: 1MB
+  restore_max_concurrent_requests: "2"
+  upload_state_dir: %s
+%s`, server.URL, filepath.Join(localDir, "upload_state"), extraOptions)
+		Expect(ioutil.WriteFile(configPath, []byte(contents), 0644)).To(Succeed())
+	}
+	randomData := func(size int) []byte {
+		data := make([]byte, size)
+		_, _ = rand.New(rand.NewSource(int64(size))).Read(data)
+		return data
+	}
+	dataFile := func(segment int) string {
+		return filepath.Join(backupDir, fmt.Sprintf("gpbackup_%d_%s", segment, timestamp))
+	}
+	dataKey := func(segment int) string {
+		return fmt.Sprintf("folder_name/backups/20180101/%s/gpbackup_%d_%s", timestamp, segment, timestamp)
+	}
+	backupData := func(segment int, data []byte) error {
+		stdinFile := filepath.Join(localDir, "stdin")
+		Expect(ioutil.WriteFile(stdinFile, data, 0644)).To(Succeed())
+		stdin, err := os.Open(stdinFile)
+		Expect(err).ToNot(HaveOccurred())
+		defer stdin.Close()
+		operating.System.Stdin = stdin
+		defer func() { operating.System.Stdin = os.Stdin }()
+		return s3plugin.BackupData(contextWithArgs(configPath, dataFile(segment)))
+	}
+	restoreData := func(segment int) ([]byte, error) {
+		stdout := captureStdout()
+		err := s3plugin.RestoreData(contextWithArgs(configPath, dataFile(segment)))
+		return stdout.Contents(), err
+	}
+
+	BeforeEach(func() {
+		_, _, _ = testhelper.SetupTestLogger()
+		server = newFakeS3Server("testbucket")
+		var err error
+		localDir, err = ioutil.TempDir("", "s3plugin_local")
+		Expect(err).ToNot(HaveOccurred())
+		backupDir = filepath.Join(localDir, "backups/20180101", timestamp)
+		Expect(os.MkdirAll(backupDir, 0755)).To(Succeed())
+		configPath = filepath.Join(localDir, "plugin_config.yaml")
+		writeConfig("")
+	})
+	AfterEach(func() {
+		server.Close()
+		_ = os.RemoveAll(localDir)
+	})
+
+	Describe("setup_plugin_for_backup", func() {
+		It("uploads an empty probe file for the report", func() {
+			err := s3plugin.SetupPluginForBackup(contextWithArgs(configPath, backupDir, "coordinator"))
+			Expect(err).ToNot(HaveOccurred())
+
+			object, ok := server.GetObject(fmt.Sprintf("folder_name/backups/20180101/%s/gpbackup_%s_report", timestamp, timestamp))
+			Expect(ok).To(BeTrue())
+			Expect(object.Data).To(BeEmpty())
+		})
+		It("does nothing for segment scope", func() {
+			err := s3plugin.SetupPluginForBackup(contextWithArgs(configPath, backupDir, "segment"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(server.Keys()).To(BeEmpty())
+		})
+		It("fails if the bucket does not accept uploads", func() {
+			server.InjectFailure(http.MethodPut, "_report", http.StatusForbidden, -1)
+			err := s3plugin.SetupPluginForBackup(contextWithArgs(configPath, backupDir, "coordinator"))
+			Expect(err).To(MatchError(ContainSubstring("AccessDenied")))
+		})
+	})
+
+	Describe("backup_data and restore_data", func() {
+		It("round trips a small data file", func() {
+			data := []byte("1\tfoo\n2\tbar\n")
+			Expect(backupData(0, data)).To(Succeed())
+
+			object, ok := server.GetObject(dataKey(0))
+			Expect(ok).To(BeTrue())
+			Expect(object.Data).To(Equal(data))
+			Expect(server.Keys()).To(ContainElement(dataKey(0) + ".sha256"))
+
+			restored, err := restoreData(0)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(restored).To(Equal(data))
+		})
+		It("round trips a data file that needs a multipart upload and a parallel download", func() {
+			data := randomData(11*1024*1024 + 17)
+			Expect(backupData(1, data)).To(Succeed())
+			Expect(server.Requests).To(ContainElement(ContainSubstring("partNumber=3")))
+
+			restored, err := restoreData(1)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(bytes.Equal(restored, data)).To(BeTrue())
+		})
+		It("encrypts the stored object when client-side encryption is configured", func() {
+			keyfile := filepath.Join(localDir, "master.key")
+			Expect(ioutil.WriteFile(keyfile, randomData(32), 0600)).To(Succeed())
+			writeConfig(fmt.Sprintf("  client_side_encryption_keyfile: %s\n", keyfile))
+			data := bytes.Repeat([]byte("secret row\n"), 10000)
+			Expect(backupData(0, data)).To(Succeed())
+
+			object, _ := server.GetObject(dataKey(0))
+			Expect(bytes.Contains(object.Data, []byte("secret row"))).To(BeFalse())
+
+			restored, err := restoreData(0)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(bytes.Equal(restored, data)).To(BeTrue())
+		})
+		It("compresses the stored object when configured and restores it with a parallel download", func() {
+			writeConfig("  compression: gzip\n  compression_level: \"1\"\n")
+			data := append(randomData(2*1024*1024), bytes.Repeat([]byte("1\tfoo\n"), 1024*1024)...)
+			Expect(backupData(0, data)).To(Succeed())
+
+			object, _ := server.GetObject(dataKey(0))
+			Expect(len(object.Data)).To(BeNumerically(">", 1024*1024))
+			Expect(len(object.Data)).To(BeNumerically("<", len(data)*3/4))
+			Expect(object.Metadata).To(HaveKeyWithValue("gpbackup-compression", "gzip"))
+
+			// Restore does not depend on the configuration of the backup
+			writeConfig("")
+			restored, err := restoreData(0)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(bytes.Equal(restored, data)).To(BeTrue())
+		})
+		It("retries an upload part that failed transiently", func() {
+			server.InjectFailure(http.MethodPut, dataKey(2), http.StatusInternalServerError, 1)
+			data := randomData(6 * 1024 * 1024)
+			Expect(backupData(2, data)).To(Succeed())
+
+			restored, err := restoreData(2)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(bytes.Equal(restored, data)).To(BeTrue())
+		})
+		It("fails the backup when uploads are rejected", func() {
+			server.InjectFailure(http.MethodPut, dataKey(0), http.StatusForbidden, -1)
+			err := backupData(0, []byte("data"))
+			Expect(err).To(MatchError(ContainSubstring("AccessDenied")))
+		})
+		It("fails the restore when downloads are rejected", func() {
+			Expect(backupData(0, []byte("data"))).To(Succeed())
+			server.InjectFailure(http.MethodGet, dataKey(0), http.StatusForbidden, -1)
+			_, err := restoreData(0)
+			Expect(err).To(MatchError(ContainSubstring("AccessDenied")))
+		})
+		It("fails the restore when the stored object was modified", func() {
+			Expect(backupData(0, []byte("1\tfoo\n"))).To(Succeed())
+			object, _ := server.GetObject(dataKey(0))
+			server.PutObject(dataKey(0), []byte("1\tbar\n"), object.Metadata)
+
+			_, err := restoreData(0)
+			Expect(err).To(MatchError(ContainSubstring("Checksum mismatch")))
+		})
+	})
+
+	Describe("credentials", func() {
+		writeConfigWithoutKeys := func(extraOptions string) {
+			writeConfig(extraOptions)
+			contents, err := ioutil.ReadFile(configPath)
+			Expect(err).ToNot(HaveOccurred())
+			keys := "  aws_access_key_id: \"12345\"\n  aws_secret_access_key: \"6789\"\n"
+			Expect(ioutil.WriteFile(configPath, bytes.Replace(contents, []byte(keys), nil, 1), 0644)).To(Succeed())
+		}
+
+		It("signs requests with the credentials of aws_credential_process", func() {
+			marker := filepath.Join(localDir, "credential_process_ran")
+			script := filepath.Join(localDir, "credentials.sh")
+			Expect(ioutil.WriteFile(script, []byte(fmt.Sprintf(`#!/bin/sh
+touch %s
+echo '{"Version": 1, "AccessKeyId": "PROCESSKEY", "SecretAccessKey": "processsecret"}'
+`, marker)), 0700)).To(Succeed())
+			writeConfigWithoutKeys(fmt.Sprintf("  aws_credential_process: %s\n", script))
+
+			Expect(backupData(0, []byte("1\tfoo\n"))).To(Succeed())
+			Expect(marker).To(BeAnExistingFile())
+			Expect(server.AccessKeyIds).To(ContainElement("PROCESSKEY"))
+			Expect(server.AccessKeyIds).ToNot(ContainElement("12345"))
+		})
+		It("fails with a clear error when aws_credential_process fails", func() {
+			writeConfigWithoutKeys("  aws_credential_process: /bin/false\n")
+
+			Expect(backupData(0, []byte("1\tfoo\n"))).To(MatchError(ContainSubstring("ProcessProviderExecutionError")))
+		})
+	})
+
+	Describe("backup_directory_parallel and restore_directory_parallel", func() {
+		It("round trips every file of a directory", func() {
+			files := map[string][]byte{
+				"gpbackup_" + timestamp + "_config.yaml": []byte("compressed: false\n"),
+				"gpbackup_" + timestamp + "_toc.yaml":    randomData(2*1024*1024 + 5),
+			}
+			for name, contents := range files {
+				Expect(ioutil.WriteFile(filepath.Join(backupDir, name), contents, 0644)).To(Succeed())
+			}
+			Expect(s3plugin.BackupDirectoryParallel(contextWithArgs(configPath, backupDir, "2"))).To(Succeed())
+			Expect(os.RemoveAll(backupDir)).To(Succeed())
+
+			Expect(s3plugin.RestoreDirectoryParallel(contextWithArgs(configPath, backupDir, "2"))).To(Succeed())
+			for name, contents := range files {
+				restored, err := ioutil.ReadFile(filepath.Join(backupDir, name))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(bytes.Equal(restored, contents)).To(BeTrue())
+			}
+			restoredFiles, _ := ioutil.ReadDir(backupDir)
+			Expect(restoredFiles).To(HaveLen(len(files)))
+		})
+		It("restores files ending in .sha256 that are not checksum files", func() {
+			files := map[string][]byte{
+				"gpbackup_" + timestamp + "_toc.yaml": []byte("toc"),
+				"tables.sha256":                       []byte("checksums of the user"),
+			}
+			for name, contents := range files {
+				Expect(ioutil.WriteFile(filepath.Join(backupDir, name), contents, 0644)).To(Succeed())
+			}
+			Expect(s3plugin.BackupDirectoryParallel(contextWithArgs(configPath, backupDir, "2"))).To(Succeed())
+			Expect(os.RemoveAll(backupDir)).To(Succeed())
+
+			Expect(s3plugin.RestoreDirectoryParallel(contextWithArgs(configPath, backupDir, "2"))).To(Succeed())
+			restoredFiles, _ := ioutil.ReadDir(backupDir)
+			Expect(restoredFiles).To(HaveLen(len(files)))
+			restored, err := ioutil.ReadFile(filepath.Join(backupDir, "tables.sha256"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(restored)).To(Equal("checksums of the user"))
+		})
+		It("restores directories listed over several pages", func() {
+			server.PageSize = 2
+			for i := 0; i < 7; i++ {
+				Expect(ioutil.WriteFile(filepath.Join(backupDir, fmt.Sprintf("file%d", i)), []byte("data"), 0644)).To(Succeed())
+			}
+			Expect(s3plugin.BackupDirectoryParallel(contextWithArgs(configPath, backupDir, "2"))).To(Succeed())
+			Expect(os.RemoveAll(backupDir)).To(Succeed())
+
+			Expect(s3plugin.RestoreDirectoryParallel(contextWithArgs(configPath, backupDir, "3"))).To(Succeed())
+			restoredFiles, _ := ioutil.ReadDir(backupDir)
+			Expect(restoredFiles).To(HaveLen(7))
+
+			Expect(os.RemoveAll(backupDir)).To(Succeed())
+			Expect(s3plugin.RestoreDirectory(contextWithArgs(configPath, backupDir))).To(Succeed())
+			restoredFiles, _ = ioutil.ReadDir(backupDir)
+			Expect(restoredFiles).To(HaveLen(7))
+		})
+		It("fails the restore if the directory cannot be listed", func() {
+			Expect(ioutil.WriteFile(filepath.Join(backupDir, "file"), []byte("data"), 0644)).To(Succeed())
+			Expect(s3plugin.BackupDirectoryParallel(contextWithArgs(configPath, backupDir, "2"))).To(Succeed())
+			server.InjectFailure(http.MethodGet, "", http.StatusForbidden, -1)
+
+			err := s3plugin.RestoreDirectoryParallel(contextWithArgs(configPath, backupDir, "2"))
+			Expect(err).To(MatchError(ContainSubstring("AccessDenied")))
+			err = s3plugin.RestoreDirectory(contextWithArgs(configPath, backupDir))
+			Expect(err).To(MatchError(ContainSubstring("AccessDenied")))
+		})
+	})
+
+	Describe("delete_backup", func() {
+		It("deletes every object of the timestamp and nothing else", func() {
+			server.PageSize = 2
+			for segment := 0; segment < 3; segment++ {
+				Expect(backupData(segment, []byte("data"))).To(Succeed())
+			}
+			otherKey := "folder_name/backups/20180102/20180102082233/gpbackup_0_20180102082233"
+			server.PutObject(otherKey, []byte("data"), nil)
+
+			Expect(s3plugin.DeleteBackup(contextWithArgs(configPath, timestamp))).To(Succeed())
+			Expect(server.Keys()).To(Equal([]string{otherKey}))
+		})
+		It("fails if the objects cannot be deleted", func() {
+			Expect(backupData(0, []byte("data"))).To(Succeed())
+			server.InjectFailure(http.MethodPost, "", http.StatusForbidden, -1)
+			err := s3plugin.DeleteBackup(contextWithArgs(configPath, timestamp))
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("object lock", func() {
+		const retentionDays = 36500
+		BeforeEach(func() {
+			writeConfig(fmt.Sprintf("  object_lock_mode: governance\n  object_lock_retention_days: \"%d\"\n"+
+				"  object_lock_legal_hold: \"on\"\n", retentionDays))
+		})
+		It("fails setup if the bucket does not have object lock enabled", func() {
+			err := s3plugin.SetupPluginForBackup(contextWithArgs(configPath, backupDir, "coordinator"))
+			Expect(err).To(MatchError("Bucket testbucket does not have object lock enabled, " +
+				"which object_lock_mode and object_lock_legal_hold require"))
+			Expect(server.Keys()).To(BeEmpty())
+		})
+		It("retains every uploaded object until the backup is object_lock_retention_days old", func() {
+			server.ObjectLockEnabled = true
+			Expect(s3plugin.SetupPluginForBackup(contextWithArgs(configPath, backupDir, "coordinator"))).To(Succeed())
+			Expect(backupData(0, []byte("data for segment 0"))).To(Succeed())
+			Expect(backupData(1, randomData(6*1024*1024))).To(Succeed())
+
+			backupStart, _ := time.ParseInLocation("20060102150405", timestamp, time.Local)
+			for _, key := range server.Keys() {
+				object, _ := server.GetObject(key)
+				Expect(object.Lock.Mode).To(Equal("GOVERNANCE"), key)
+				retainUntil, err := time.Parse(time.RFC3339, object.Lock.RetainUntil)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(retainUntil.Equal(backupStart.AddDate(0, 0, retentionDays))).To(BeTrue(), key)
+				Expect(object.Lock.LegalHold).To(Equal("ON"), key)
+			}
+			Expect(server.Keys()).To(ContainElement(dataKey(1)))
+		})
+		It("refuses to delete a backup with locked objects and names them", func() {
+			server.ObjectLockEnabled = true
+			Expect(backupData(0, []byte("data for segment 0"))).To(Succeed())
+			keys := server.Keys()
+
+			err := s3plugin.DeleteBackup(contextWithArgs(configPath, timestamp))
+			Expect(err).To(MatchError(ContainSubstring("because 2 of its 2 objects are locked by object lock")))
+			Expect(err).To(MatchError(ContainSubstring(dataKey(0) + " (GOVERNANCE retention until")))
+			Expect(err).To(MatchError(ContainSubstring("and legal hold)")))
+			err = s3plugin.DeleteDirectory(contextWithArgs(configPath, "folder_name/backups"))
+			Expect(err).To(MatchError(ContainSubstring("are locked by object lock")))
+			Expect(server.Keys()).To(Equal(keys))
+		})
+		It("deletes objects that are not locked from a bucket with object lock", func() {
+			writeConfig("")
+			Expect(backupData(0, []byte("data for segment 0"))).To(Succeed())
+			server.ObjectLockEnabled = true
+			Expect(s3plugin.DeleteBackup(contextWithArgs(configPath, timestamp))).To(Succeed())
+			Expect(server.Keys()).To(BeEmpty())
+		})
+	})
+
+	Describe("list_directory", func() {
+		var stdout *gbytes.Buffer
+		BeforeEach(func() {
+			stdout = captureStdout()
+		})
+		It("lists the objects under the configured folder without their checksum files", func() {
+			Expect(backupData(0, []byte("abc"))).To(Succeed())
+			server.PutObject("other_folder/backups/20180101/20180101082233/file", []byte("abcdef"), nil)
+
+			Expect(s3plugin.ListDirectory(contextWithArgs(configPath))).To(Succeed())
+			Expect(stdout).To(gbytes.Say(dataKey(0) + " +3"))
+			Expect(string(stdout.Contents())).ToNot(ContainSubstring(".sha256"))
+			Expect(string(stdout.Contents())).ToNot(ContainSubstring("other_folder"))
+		})
+		It("lists the given directory", func() {
+			server.PutObject("other_folder/file", []byte("abcdef"), nil)
+
+			Expect(s3plugin.ListDirectory(contextWithArgs(configPath, "other_folder"))).To(Succeed())
+			Expect(stdout).To(gbytes.Say("other_folder/file +6"))
+			Expect(string(stdout.Contents())).ToNot(ContainSubstring("folder_name"))
+		})
+		It("lists every object of a prefix spanning several pages", func() {
+			server.PageSize = 2
+			for i := 0; i < 5; i++ {
+				server.PutObject(fmt.Sprintf("other_folder/file%d", i), []byte("abcdef"), nil)
+			}
+
+			Expect(s3plugin.ListDirectory(contextWithArgs(configPath, "other_folder"))).To(Succeed())
+			for i := 0; i < 5; i++ {
+				Expect(stdout).To(gbytes.Say(fmt.Sprintf("other_folder/file%d +6", i)))
+			}
+		})
+		It("writes one JSON document per object using the sizes from the listing", func() {
+			Expect(backupData(0, []byte("abc"))).To(Succeed())
+			object, _ := server.GetObject(dataKey(0))
+			requestsBefore := len(server.Requests)
+
+			Expect(s3plugin.ListDirectory(contextWithArgs("--format", "jsonl", configPath))).To(Succeed())
+			lines := strings.Split(strings.TrimSpace(string(stdout.Contents())), "\n")
+			Expect(lines).To(HaveLen(1))
+			entry := make(map[string]interface{})
+			Expect(json.Unmarshal([]byte(lines[0]), &entry)).To(Succeed())
+			Expect(entry["key"]).To(Equal(dataKey(0)))
+			Expect(entry["type"]).To(Equal("object"))
+			Expect(entry["size"]).To(BeNumerically("==", 3))
+			Expect(entry["etag"]).To(Equal(strings.Trim(object.ETag, `"`)))
+			Expect(entry["storage_class"]).To(Equal("STANDARD"))
+			Expect(entry["last_modified"]).To(Equal(object.LastModified.Format(time.RFC3339)))
+			Expect(entry).ToNot(HaveKey("metadata"))
+			for _, request := range server.Requests[requestsBefore:] {
+				Expect(request).ToNot(HavePrefix("HEAD"))
+			}
+		})
+		It("uploads data and metadata files with their storage classes and lists them", func() {
+			writeConfig("  data_storage_class: standard_ia\n  metadata_storage_class: GLACIER_IR\n")
+			Expect(backupData(0, []byte("abc"))).To(Succeed())
+			tableFile := fmt.Sprintf("%s_16384.gz", dataFile(1))
+			Expect(ioutil.WriteFile(tableFile, randomData(6*1024*1024), 0644)).To(Succeed())
+			Expect(s3plugin.BackupFile(contextWithArgs(configPath, tableFile))).To(Succeed())
+			tocFile := filepath.Join(backupDir, fmt.Sprintf("gpbackup_%s_toc.yaml", timestamp))
+			Expect(ioutil.WriteFile(tocFile, []byte("toc"), 0644)).To(Succeed())
+			Expect(s3plugin.BackupFile(contextWithArgs(configPath, tocFile))).To(Succeed())
+
+			object, _ := server.GetObject(dataKey(0))
+			Expect(object.StorageClass).To(Equal("STANDARD_IA"))
+			object, _ = server.GetObject(dataKey(1) + "_16384.gz")
+			Expect(object.StorageClass).To(Equal("STANDARD_IA"))
+			object, _ = server.GetObject(dataKey(0) + ".sha256")
+			Expect(object.StorageClass).To(Equal("GLACIER_IR"))
+			tocKey := fmt.Sprintf("folder_name/backups/20180101/%s/gpbackup_%s_toc.yaml", timestamp, timestamp)
+			object, _ = server.GetObject(tocKey)
+			Expect(object.StorageClass).To(Equal("GLACIER_IR"))
+
+			Expect(s3plugin.ListDirectory(contextWithArgs(configPath))).To(Succeed())
+			Expect(stdout).To(gbytes.Say(dataKey(0) + " +3 +STANDARD_IA"))
+			Expect(stdout).To(gbytes.Say(tocKey + " +3 +GLACIER_IR"))
+		})
+		It("includes the object metadata when asked to", func() {
+			Expect(backupData(0, []byte("abc"))).To(Succeed())
+
+			Expect(s3plugin.ListDirectory(contextWithArgs("--format", "jsonl", "--metadata", configPath))).To(Succeed())
+			Expect(stdout).To(gbytes.Say(`"metadata":{"gpbackup-checksum":"sha256","gpbackup-content-id":"0",` +
+				`"gpbackup-timestamp":"` + timestamp + `"}`))
+		})
+		It("labels and tags every uploaded object and lists the tags when asked to", func() {
+			defer func(version string) { s3plugin.Version = version }(s3plugin.Version)
+			s3plugin.Version = "1.2.3"
+			writeConfig("  tags:\n    cluster: prod\n    cost center: dba\n  automatic_tags: \"on\"\n" +
+				"  backup_plugin_version: 1.10.0\n")
+			Expect(backupData(0, []byte("abc"))).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(backupDir, fmt.Sprintf("gpbackup_%s_config.yaml", timestamp)),
+				[]byte("backupdir: \"\"\ndatabasename: sales db\n"), 0644)).To(Succeed())
+			tocFile := filepath.Join(backupDir, fmt.Sprintf("gpbackup_%s_toc.yaml", timestamp))
+			Expect(ioutil.WriteFile(tocFile, []byte("toc"), 0644)).To(Succeed())
+			Expect(s3plugin.BackupFile(contextWithArgs(configPath, tocFile))).To(Succeed())
+
+			tocKey := fmt.Sprintf("folder_name/backups/20180101/%s/gpbackup_%s_toc.yaml", timestamp, timestamp)
+			object, _ := server.GetObject(tocKey)
+			Expect(object.Tags).To(Equal(map[string]string{
+				"cluster":                        "prod",
+				"cost center":                    "dba",
+				"gpbackup-timestamp":             timestamp,
+				"gpbackup-content-id":            "-1",
+				"gpbackup-database":              "sales db",
+				"gpbackup-s3-plugin-version":     "1.2.3",
+				"gpbackup-backup-plugin-version": "1.10.0",
+			}))
+			Expect(object.Metadata).To(HaveKeyWithValue("gpbackup-database", "sales db"))
+			object, _ = server.GetObject(dataKey(0))
+			Expect(object.Tags).To(HaveKeyWithValue("gpbackup-content-id", "0"))
+			Expect(object.Tags).ToNot(HaveKey("gpbackup-database"))
+			Expect(object.Metadata).To(HaveKeyWithValue("gpbackup-s3-plugin-version", "1.2.3"))
+			object, _ = server.GetObject(dataKey(0) + ".sha256")
+			Expect(object.Tags).To(HaveKeyWithValue("gpbackup-content-id", "0"))
+
+			Expect(s3plugin.ListDirectory(contextWithArgs("--format", "jsonl", "--tags", configPath))).To(Succeed())
+			Expect(stdout).To(gbytes.Say(`"key":"` + dataKey(0) + `".*"tags":{"cluster":"prod","cost center":"dba",` +
+				`"gpbackup-backup-plugin-version":"1.10.0","gpbackup-content-id":"0",`))
+		})
+		It("writes a CSV document with a header", func() {
+			server.PutObject("other_folder/file,1", []byte("abcdef"), nil)
+
+			Expect(s3plugin.ListDirectory(contextWithArgs("--format", "csv", configPath, "other_folder"))).To(Succeed())
+			records, err := csv.NewReader(bytes.NewReader(stdout.Contents())).ReadAll()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(records).To(HaveLen(2))
+			Expect(records[0]).To(Equal([]string{"key", "type", "size", "last_modified", "etag", "storage_class", "metadata", "tags"}))
+			Expect(records[1][:3]).To(Equal([]string{"other_folder/file,1", "object", "6"}))
+		})
+		It("lists only the immediate contents of a directory in the directory view", func() {
+			server.PutObject("other_folder/file", []byte("abcdef"), nil)
+			server.PutObject("other_folder/sub/file1", []byte("a"), nil)
+			server.PutObject("other_folder/sub/file2", []byte("a"), nil)
+
+			Expect(s3plugin.ListDirectory(contextWithArgs("--format", "jsonl", "--view", "directory", configPath, "other_folder"))).To(Succeed())
+			Expect(stdout).To(gbytes.Say(`{"key":"other_folder/file","type":"object","size":6,`))
+			Expect(stdout).To(gbytes.Say(`{"key":"other_folder/sub/","type":"prefix","size":0}`))
+			Expect(string(stdout.Contents())).ToNot(ContainSubstring("file1"))
+		})
+		It("rejects an unknown format", func() {
+			err := s3plugin.ListDirectory(contextWithArgs("--format", "xml", configPath))
+			Expect(err).To(MatchError("Invalid --format xml. Valid choices are table, jsonl or csv."))
+		})
+		It("fails if the directory cannot be listed", func() {
+			server.InjectFailure(http.MethodGet, "", http.StatusForbidden, -1)
+			err := s3plugin.ListDirectory(contextWithArgs(configPath))
+			Expect(err).To(MatchError(ContainSubstring("AccessDenied")))
+		})
+	})
+
+	Describe("list_backups", func() {
+		var stdout *gbytes.Buffer
+		BeforeEach(func() {
+			stdout = captureStdout()
+		})
+		It("summarizes every backup timestamp under the folder", func() {
+			server.PageSize = 2
+			prefix := "folder_name/backups/20180101/20180101082233/"
+			server.PutObject(prefix+"gpbackup_20180101082233_report", []byte("report"), nil)
+			server.PutObject(prefix+"gpbackup_20180101082233_toc.yaml", []byte("toc"), nil)
+			server.PutObject(prefix+"gpbackup_20180101082233_toc.yaml.sha256", []byte("checksum"), nil)
+			server.PutObject(prefix+"gpbackup_0_20180101082233", []byte("segment data"), nil)
+			server.PutObject("folder_name/backups/20180102/20180102010101/gpbackup_0_20180102010101", []byte("data"), nil)
+			server.PutObject("folder_name/backups/notadate/20180102010101/file", []byte("data"), nil)
+			server.PutObject("folder_name/backups/20180103/notatimestamp/file", []byte("data"), nil)
+
+			Expect(s3plugin.ListBackups(contextWithArgs("--format", "jsonl", configPath))).To(Succeed())
+			lines := strings.Split(strings.TrimSpace(string(stdout.Contents())), "\n")
+			Expect(lines).To(HaveLen(2))
+
+			backups := make([]map[string]interface{}, len(lines))
+			for i, line := range lines {
+				Expect(json.Unmarshal([]byte(line), &backups[i])).To(Succeed())
+			}
+			Expect(backups[0]["timestamp"]).To(Equal("20180101082233"))
+			Expect(backups[0]["prefix"]).To(Equal(prefix))
+			Expect(backups[0]["objects"]).To(BeNumerically("==", 3))
+			Expect(backups[0]["bytes"]).To(BeNumerically("==", len("report")+len("toc")+len("segment data")))
+			Expect(backups[0]["has_report"]).To(BeTrue())
+			Expect(backups[0]["has_toc"]).To(BeTrue())
+			Expect(backups[0]["oldest_object"]).ToNot(BeEmpty())
+			Expect(backups[1]["timestamp"]).To(Equal("20180102010101"))
+			Expect(backups[1]["objects"]).To(BeNumerically("==", 1))
+			Expect(backups[1]["has_report"]).To(BeFalse())
+			Expect(backups[1]["has_toc"]).To(BeFalse())
+		})
+		It("renders a table by default", func() {
+			server.PutObject("folder_name/backups/20180102/20180102010101/gpbackup_20180102010101_report", []byte("data"), nil)
+
+			Expect(s3plugin.ListBackups(contextWithArgs(configPath))).To(Succeed())
+			Expect(stdout).To(gbytes.Say("20180102010101 +1 +4 +\\S+ +\\S+ +yes +no"))
+		})
+		It("fails if the folder cannot be listed", func() {
+			server.InjectFailure(http.MethodGet, "", http.StatusForbidden, -1)
+			err := s3plugin.ListBackups(contextWithArgs(configPath))
+			Expect(err).To(MatchError(ContainSubstring("AccessDenied")))
+		})
+	})
+
+	Describe("prune_backups", func() {
+		var stdout *gbytes.Buffer
+		putBackup := func(timestamp string) {
+			prefix := fmt.Sprintf("folder_name/backups/%s/%s/", timestamp[:8], timestamp)
+			server.PutObject(prefix+fmt.Sprintf("gpbackup_%s_report", timestamp), []byte("report"), nil)
+			server.PutObject(prefix+fmt.Sprintf("gpbackup_%s_toc.yaml", timestamp), []byte("toc"), nil)
+		}
+		BeforeEach(func() {
+			stdout = captureStdout()
+			putBackup("20180101010101")
+			putBackup("20180102010101")
+			putBackup("20180103010101")
+		})
+		It("only reports what would be deleted in a dry run", func() {
+			writeConfig("  retention_keep_last: \"1\"\n")
+			keys := server.Keys()
+
+			Expect(s3plugin.PruneBackups(contextWithArgs("--dry-run", "--format", "csv", configPath))).To(Succeed())
+			Expect(string(stdout.Contents())).To(Equal(`timestamp,action,bytes,reasons
+20180103010101,keep,9,newest complete backup;last 1
+20180102010101,delete,9,
+20180101010101,delete,9,
+`))
+			Expect(server.Keys()).To(Equal(keys))
+		})
+		It("deletes the backups the retention rules do not keep", func() {
+			writeConfig("  retention_keep_last: \"2\"\n")
+
+			Expect(s3plugin.PruneBackups(contextWithArgs(configPath))).To(Succeed())
+			Expect(server.Keys()).To(HaveLen(4))
+			for _, key := range server.Keys() {
+				Expect(key).ToNot(ContainSubstring("20180101010101"))
+			}
+		})
+		It("keeps the backups a kept incremental backup depends on", func() {
+			writeConfig("  retention_keep_last: \"1\"\n")
+			server.PutObject("folder_name/backups/20180103/20180103010101/gpbackup_20180103010101_config.yaml",
+				[]byte("incremental: true\nrestoreplan:\n- timestamp: \"20180102010101\"\n"+
+					"- timestamp: \"20180103010101\"\n"), nil)
+
+			Expect(s3plugin.PruneBackups(contextWithArgs("--format", "csv", configPath))).To(Succeed())
+			Expect(stdout).To(gbytes.Say("20180102010101,keep,9,needed by 20180103010101\n20180101010101,delete,9,"))
+			for _, key := range server.Keys() {
+				Expect(key).ToNot(ContainSubstring("20180101010101"))
+			}
+			Expect(server.Keys()).To(HaveLen(5))
+		})
+		It("refuses to run without a retention rule", func() {
+			err := s3plugin.PruneBackups(contextWithArgs(configPath))
+			Expect(err).To(MatchError(ContainSubstring("prune_backups requires at least one of retention_keep_last")))
+			Expect(server.Keys()).To(HaveLen(6))
+		})
+	})
+
+	Describe("resumable uploads", func() {
+		var dataPath, fileKey string
+		var data []byte
+		stateFiles := func() []string {
+			files, _ := filepath.Glob(filepath.Join(localDir, "upload_state", "*.json"))
+			return files
+		}
+		BeforeEach(func() {
+			dataPath = filepath.Join(backupDir, fmt.Sprintf("gpbackup_%s_metadata.sql", timestamp))
+			fileKey = fmt.Sprintf("folder_name/backups/20180101/%s/gpbackup_%s_metadata.sql", timestamp, timestamp)
+			data = randomData(11*1024*1024 + 3)
+			Expect(ioutil.WriteFile(dataPath, data, 0644)).To(Succeed())
+		})
+		It("resumes an interrupted upload of a file without sending the uploaded parts again", func() {
+			server.InjectFailure(http.MethodPut, "partNumber=2&", http.StatusForbidden, -1)
+			err := s3plugin.BackupFile(contextWithArgs(configPath, dataPath))
+			Expect(err).To(MatchError(ContainSubstring("Unable to upload part 2")))
+			Expect(stateFiles()).To(HaveLen(1))
+			Expect(server.Uploads()).To(HaveLen(1))
+
+			server.ClearFailures()
+			requestsBefore := len(server.Requests)
+			Expect(s3plugin.BackupFile(contextWithArgs(configPath, dataPath))).To(Succeed())
+			resumedParts := make([]string, 0)
+			for _, request := range server.Requests[requestsBefore:] {
+				if strings.HasPrefix(request, "PUT") && strings.Contains(request, "partNumber=") {
+					resumedParts = append(resumedParts, request)
+				}
+			}
+			// Part 3 may or may not have been uploaded before the failure of
+			// part 2 stopped the first attempt
+			Expect(resumedParts).To(ContainElement(ContainSubstring("partNumber=2&")))
+			Expect(resumedParts).ToNot(ContainElement(ContainSubstring("partNumber=1&")))
+
+			object, ok := server.GetObject(fileKey)
+			Expect(ok).To(BeTrue())
+			Expect(bytes.Equal(object.Data, data)).To(BeTrue())
+			Expect(stateFiles()).To(BeEmpty())
+			Expect(server.Uploads()).To(BeEmpty())
+
+			Expect(os.Remove(dataPath)).To(Succeed())
+			Expect(s3plugin.RestoreFile(contextWithArgs(configPath, dataPath))).To(Succeed())
+			restored, err := ioutil.ReadFile(dataPath)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(bytes.Equal(restored, data)).To(BeTrue())
+		})
+		It("resumes an interrupted upload with its part size after the chunk size changed", func() {
+			server.InjectFailure(http.MethodPut, "partNumber=2&", http.StatusForbidden, -1)
+			Expect(s3plugin.BackupFile(contextWithArgs(configPath, dataPath))).ToNot(Succeed())
+			server.ClearFailures()
+			config, err := ioutil.ReadFile(configPath)
+			Expect(err).ToNot(HaveOccurred())
+			config = bytes.Replace(config, []byte("backup_multipart_chunksize: 5MB"),
+				[]byte("backup_multipart_chunksize: 100MB"), 1)
+			Expect(ioutil.WriteFile(configPath, config, 0644)).To(Succeed())
+
+			requestsBefore := len(server.Requests)
+			Expect(s3plugin.BackupFile(contextWithArgs(configPath, dataPath))).To(Succeed())
+			for _, request := range server.Requests[requestsBefore:] {
+				// Neither a new upload nor a single PUT replaces the recorded one
+				Expect(request).ToNot(ContainSubstring("partNumber=1&"))
+				Expect(request).ToNot(HavePrefix("POST " + fileKey + "?uploads"))
+				Expect(request).ToNot(Equal("PUT " + fileKey + "?"))
+			}
+			object, _ := server.GetObject(fileKey)
+			Expect(bytes.Equal(object.Data, data)).To(BeTrue())
+			Expect(stateFiles()).To(BeEmpty())
+			Expect(server.Uploads()).To(BeEmpty())
+		})
+		It("charges every part against the bandwidth limit once", func() {
+			writeConfig("  backup_max_bandwidth: 10MB/s\n")
+			start := time.Now()
+			Expect(s3plugin.BackupFile(contextWithArgs(configPath, dataPath))).To(Succeed())
+			// A second's worth passes at once, the remaining 1MB takes 0.1s.
+			// Reading the parts twice would take more than a second.
+			Expect(time.Since(start)).To(BeNumerically(">=", 50*time.Millisecond))
+			Expect(time.Since(start)).To(BeNumerically("<", 800*time.Millisecond))
+		})
+		It("starts over if the file changed since the interrupted upload", func() {
+			server.InjectFailure(http.MethodPut, "partNumber=2&", http.StatusForbidden, -1)
+			Expect(s3plugin.BackupFile(contextWithArgs(configPath, dataPath))).ToNot(Succeed())
+			server.ClearFailures()
+			data = randomData(11*1024*1024 + 5)
+			Expect(ioutil.WriteFile(dataPath, data, 0644)).To(Succeed())
+
+			Expect(s3plugin.BackupFile(contextWithArgs(configPath, dataPath))).To(Succeed())
+			object, _ := server.GetObject(fileKey)
+			Expect(bytes.Equal(object.Data, data)).To(BeTrue())
+			Expect(server.Uploads()).To(BeEmpty())
+		})
+		It("lists and aborts incomplete uploads under the folder", func() {
+			stdout := captureStdout()
+			server.InjectFailure(http.MethodPut, "partNumber=2&", http.StatusForbidden, -1)
+			Expect(s3plugin.BackupFile(contextWithArgs(configPath, dataPath))).ToNot(Succeed())
+			server.ClearFailures()
+
+			Expect(s3plugin.ListIncompleteUploads(contextWithArgs("--format", "jsonl", configPath))).To(Succeed())
+			upload := make(map[string]interface{})
+			Expect(json.Unmarshal(stdout.Contents(), &upload)).To(Succeed())
+			Expect(upload["key"]).To(Equal(fileKey))
+			Expect(upload["parts"]).To(BeNumerically(">=", 1))
+			Expect(upload["bytes"]).To(BeNumerically(">=", 5*1024*1024))
+
+			Expect(s3plugin.AbortIncompleteUploads(contextWithArgs(configPath, "folder_name/other"))).To(Succeed())
+			Expect(server.Uploads()).To(HaveLen(1))
+			Expect(s3plugin.AbortIncompleteUploads(contextWithArgs(configPath))).To(Succeed())
+			Expect(server.Uploads()).To(BeEmpty())
+		})
+	})
+
+	Describe("cleanup_incomplete_uploads", func() {
+		var stdout *gbytes.Buffer
+		var oldUpload, newUpload, otherUpload string
+		BeforeEach(func() {
+			stdout = captureStdout()
+			oldUpload = server.StartUpload(dataKey(0), time.Now().Add(-48*time.Hour), []byte("old part"))
+			newUpload = server.StartUpload(dataKey(1), time.Now().Add(-time.Hour), []byte("new part"))
+			otherUpload = server.StartUpload("folder_name/other/file", time.Now().Add(-48*time.Hour), []byte("other"))
+		})
+		It("reports which uploads under the backups would be aborted in a dry run", func() {
+			Expect(s3plugin.CleanupIncompleteUploads(contextWithArgs("--dry-run", "--format", "jsonl", configPath))).To(Succeed())
+			Expect(stdout).To(gbytes.Say(fmt.Sprintf(`"key":"%s","upload_id":"%s",.*"parts":1,"bytes":8,"action":"abort"`, dataKey(0), oldUpload)))
+			Expect(stdout).To(gbytes.Say(fmt.Sprintf(`"key":"%s","upload_id":"%s",.*"action":"keep"`, dataKey(1), newUpload)))
+			Expect(string(stdout.Contents())).ToNot(ContainSubstring(otherUpload))
+			Expect(server.Uploads()).To(HaveLen(3))
+		})
+		It("aborts the uploads under the backups older than incomplete_upload_max_age", func() {
+			writeConfig("  incomplete_upload_max_age: 36h\n")
+			Expect(s3plugin.CleanupIncompleteUploads(contextWithArgs(configPath))).To(Succeed())
+			Expect(server.Uploads()).To(HaveKey(newUpload))
+			Expect(server.Uploads()).To(HaveKey(otherUpload))
+			Expect(server.Uploads()).ToNot(HaveKey(oldUpload))
+		})
+		It("aborts the uploads older than --older-than", func() {
+			Expect(s3plugin.CleanupIncompleteUploads(contextWithArgs("--older-than", "30m", configPath))).To(Succeed())
+			Expect(server.Uploads()).To(HaveLen(1))
+			Expect(server.Uploads()).To(HaveKey(otherUpload))
+		})
+		It("runs from cleanup_plugin_for_backup on the coordinator if configured", func() {
+			writeConfig("  cleanup_incomplete_uploads: \"on\"\n")
+			Expect(s3plugin.CleanupPluginForBackup(contextWithArgs(configPath, backupDir, "segment_host"))).To(Succeed())
+			Expect(server.Uploads()).To(HaveLen(3))
+
+			Expect(s3plugin.CleanupPluginForBackup(contextWithArgs(configPath, backupDir, "coordinator"))).To(Succeed())
+			Expect(server.Uploads()).To(HaveLen(2))
+			Expect(server.Uploads()).ToNot(HaveKey(oldUpload))
+		})
+		It("does not run from cleanup_plugin_for_backup by default", func() {
+			Expect(s3plugin.CleanupPluginForBackup(contextWithArgs(configPath, backupDir, "coordinator"))).To(Succeed())
+			Expect(server.Uploads()).To(HaveLen(3))
+		})
+	})
+
+	Describe("cleanup_plugin_for_backup and cleanup_plugin_for_restore", func() {
+		var logfile *gbytes.Buffer
+		reportPath := func() string {
+			return filepath.Join(backupDir, fmt.Sprintf("gpbackup_%s_report", timestamp))
+		}
+		statsFiles := func() []string {
+			files, _ := filepath.Glob(filepath.Join(localDir, "upload_state", "stats", "*"))
+			return files
+		}
+		BeforeEach(func() {
+			_, _, logfile = testhelper.SetupTestLogger()
+		})
+		It("removes the probe file of setup_plugin_for_backup", func() {
+			Expect(s3plugin.SetupPluginForBackup(contextWithArgs(configPath, backupDir, "coordinator"))).To(Succeed())
+			probeFile := fmt.Sprintf("/tmp/gpbackup_%s_report", timestamp)
+			Expect(probeFile).To(BeAnExistingFile())
+			Expect(s3plugin.CleanupPluginForBackup(contextWithArgs(configPath, backupDir, "coordinator"))).To(Succeed())
+			Expect(probeFile).ToNot(BeAnExistingFile())
+		})
+		It("aborts the interrupted uploads this host recorded for the timestamp", func() {
+			dataPath := filepath.Join(backupDir, fmt.Sprintf("gpbackup_%s_metadata.sql", timestamp))
+			Expect(ioutil.WriteFile(dataPath, randomData(11*1024*1024), 0644)).To(Succeed())
+			server.InjectFailure(http.MethodPut, "partNumber=2&", http.StatusForbidden, -1)
+			Expect(s3plugin.BackupFile(contextWithArgs(configPath, dataPath))).ToNot(Succeed())
+			server.ClearFailures()
+			otherUpload := server.StartUpload("folder_name/backups/20180102/20180102010101/file", time.Now(), []byte("other"))
+			Expect(server.Uploads()).To(HaveLen(2))
+
+			Expect(s3plugin.CleanupPluginForBackup(contextWithArgs(configPath, backupDir, "segment_host"))).To(Succeed())
+			Expect(server.Uploads()).To(HaveLen(1))
+			Expect(server.Uploads()).To(HaveKey(otherUpload))
+			stateFiles, _ := filepath.Glob(filepath.Join(localDir, "upload_state", "*.json"))
+			Expect(stateFiles).To(BeEmpty())
+		})
+		It("logs and removes the transfer statistics of the backup and the restore", func() {
+			Expect(backupData(0, []byte("data for segment 0"))).To(Succeed())
+			Expect(backupData(1, []byte("data for segment 1"))).To(Succeed())
+			_, err := restoreData(0)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(statsFiles()).To(HaveLen(2))
+
+			Expect(s3plugin.CleanupPluginForBackup(contextWithArgs(configPath, backupDir, "segment_host"))).To(Succeed())
+			Expect(logfile).To(gbytes.Say(fmt.Sprintf("Transferred 2 files \\(36 bytes\\) for backup %s", timestamp)))
+			Expect(statsFiles()).To(HaveLen(1))
+
+			Expect(s3plugin.CleanupPluginForRestore(contextWithArgs(configPath, backupDir, "coordinator"))).To(Succeed())
+			Expect(logfile).To(gbytes.Say(fmt.Sprintf("Transferred 1 files \\(18 bytes\\) for restore %s", timestamp)))
+			Expect(statsFiles()).To(BeEmpty())
+		})
+		It("keeps a failed backup by default", func() {
+			Expect(backupData(0, []byte("partial"))).To(Succeed())
+			Expect(ioutil.WriteFile(reportPath(), []byte("Backup Status: Failure\n"), 0644)).To(Succeed())
+			Expect(s3plugin.CleanupPluginForBackup(contextWithArgs(configPath, backupDir, "coordinator"))).To(Succeed())
+			Expect(server.Keys()).To(ContainElement(dataKey(0)))
+			Expect(server.Keys()).ToNot(ContainElement(HaveSuffix("_failed")))
+		})
+		It("marks a failed backup so that it is not counted as complete", func() {
+			writeConfig("  failed_backup_action: mark\n")
+			Expect(backupData(0, []byte("partial"))).To(Succeed())
+			Expect(ioutil.WriteFile(reportPath(), []byte("Backup Status: Failure\n"), 0644)).To(Succeed())
+			Expect(s3plugin.CleanupPluginForBackup(contextWithArgs(configPath, backupDir, "segment_host"))).To(Succeed())
+			markerKey := fmt.Sprintf("folder_name/backups/20180101/%s/gpbackup_%s_failed", timestamp, timestamp)
+			Expect(server.Keys()).ToNot(ContainElement(markerKey))
+
+			Expect(s3plugin.CleanupPluginForBackup(contextWithArgs(configPath, backupDir, "coordinator"))).To(Succeed())
+			Expect(server.Keys()).To(ContainElement(markerKey))
+			Expect(server.Keys()).To(ContainElement(dataKey(0)))
+		})
+		It("deletes a failed backup if configured", func() {
+			writeConfig("  failed_backup_action: delete\n")
+			Expect(backupData(0, []byte("partial"))).To(Succeed())
+			Expect(ioutil.WriteFile(reportPath(), []byte("Backup Status: Failure\n"), 0644)).To(Succeed())
+			Expect(s3plugin.CleanupPluginForBackup(contextWithArgs(configPath, backupDir, "coordinator"))).To(Succeed())
+			Expect(server.Keys()).To(BeEmpty())
+		})
+		It("does not touch a backup that succeeded", func() {
+			writeConfig("  failed_backup_action: delete\n")
+			Expect(backupData(0, []byte("complete"))).To(Succeed())
+			Expect(ioutil.WriteFile(reportPath(), []byte("Backup Status: Success\n"), 0644)).To(Succeed())
+			Expect(s3plugin.CleanupPluginForBackup(contextWithArgs(configPath, backupDir, "coordinator"))).To(Succeed())
+			Expect(server.Keys()).To(ContainElement(dataKey(0)))
+		})
+	})
+
+	Describe("verify_backup", func() {
+		var stdout *gbytes.Buffer
+		var manifestKey string
+		finishBackup := func(status string) {
+			reportPath := filepath.Join(backupDir, fmt.Sprintf("gpbackup_%s_report", timestamp))
+			Expect(ioutil.WriteFile(reportPath, []byte("backup status:        "+status+"\n"), 0644)).To(Succeed())
+			Expect(s3plugin.BackupFile(contextWithArgs(configPath, reportPath))).To(Succeed())
+			Expect(s3plugin.CleanupPluginForBackup(contextWithArgs(configPath, backupDir, "coordinator"))).To(Succeed())
+		}
+		BeforeEach(func() {
+			stdout = captureStdout()
+			manifestKey = fmt.Sprintf("folder_name/backups/20180101/%s/gpbackup_%s_manifest.json", timestamp, timestamp)
+			Expect(backupData(0, []byte("data for segment 0"))).To(Succeed())
+			Expect(backupData(1, []byte("data for segment 1"))).To(Succeed())
+		})
+		It("writes a manifest of the objects of a successful backup with their checksums", func() {
+			finishBackup("Success")
+			object, ok := server.GetObject(manifestKey)
+			Expect(ok).To(BeTrue())
+			manifest := struct {
+				Timestamp string
+				Objects   []struct {
+					Name   string
+					Size   int64
+					Sha256 string
+				}
+			}{}
+			Expect(json.Unmarshal(object.Data, &manifest)).To(Succeed())
+			Expect(manifest.Timestamp).To(Equal(timestamp))
+			Expect(manifest.Objects).To(HaveLen(3))
+			Expect(manifest.Objects[0].Name).To(Equal(fmt.Sprintf("gpbackup_0_%s", timestamp)))
+			Expect(manifest.Objects[0].Size).To(Equal(int64(18)))
+			Expect(manifest.Objects[0].Sha256).To(HaveLen(64))
+			Expect(manifest.Objects[2].Name).To(Equal(fmt.Sprintf("gpbackup_%s_report", timestamp)))
+		})
+		It("lists the objects that were uploaded but are no longer stored", func() {
+			server.DeleteObject(dataKey(1))
+			finishBackup("Success")
+
+			err := s3plugin.VerifyBackup(contextWithArgs("--format", "csv", configPath, timestamp))
+			Expect(err).To(MatchError(ContainSubstring("does not match its manifest of 3 objects: 1 problems found")))
+			records, err := csv.NewReader(bytes.NewReader(stdout.Contents())).ReadAll()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(records).To(Equal([][]string{
+				{"key", "problem", "expected_size", "actual_size"},
+				{dataKey(1), "missing", "18", "0"},
+			}))
+		})
+		It("does not write a manifest for a failed backup", func() {
+			finishBackup("Failure")
+			Expect(server.Keys()).ToNot(ContainElement(manifestKey))
+			err := s3plugin.VerifyBackup(contextWithArgs(configPath, timestamp))
+			Expect(err).To(MatchError(ContainSubstring("has no manifest")))
+		})
+		It("succeeds for a backup that matches its manifest", func() {
+			finishBackup("Success")
+			Expect(s3plugin.VerifyBackup(contextWithArgs("--format", "jsonl", configPath, timestamp))).To(Succeed())
+			Expect(stdout.Contents()).To(BeEmpty())
+		})
+		It("reports missing, extra and modified objects", func() {
+			finishBackup("Success")
+			server.DeleteObject(dataKey(0))
+			server.PutObject(dataKey(1), []byte("truncated"), nil)
+			server.DeleteObject(dataKey(1) + ".sha256")
+			server.PutObject(fmt.Sprintf("folder_name/backups/20180101/%s/unexpected", timestamp), []byte("extra"), nil)
+
+			err := s3plugin.VerifyBackup(contextWithArgs("--format", "csv", configPath, timestamp))
+			Expect(err).To(MatchError(ContainSubstring("does not match its manifest of 3 objects: 3 problems found")))
+			records, err := csv.NewReader(bytes.NewReader(stdout.Contents())).ReadAll()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(records).To(Equal([][]string{
+				{"key", "problem", "expected_size", "actual_size"},
+				{dataKey(0), "missing", "18", "0"},
+				{dataKey(1), "size mismatch", "18", "9"},
+				{fmt.Sprintf("folder_name/backups/20180101/%s/unexpected", timestamp), "extra", "0", "5"},
+			}))
+		})
+		It("rejects an invalid timestamp", func() {
+			err := s3plugin.VerifyBackup(contextWithArgs(configPath, "2018"))
+			Expect(err).To(MatchError(ContainSubstring("verify_backup requires a <timestamp>")))
+		})
+	})
+
+	Describe("verify_backup_data", func() {
+		var stdout *gbytes.Buffer
+		var data []byte
+		BeforeEach(func() {
+			stdout = captureStdout()
+			data = randomData(3*1024*1024 + 7)
+			Expect(backupData(0, data)).To(Succeed())
+			Expect(backupData(1, []byte("data for segment 1"))).To(Succeed())
+		})
+		It("reads and verifies every object of the backup", func() {
+			Expect(s3plugin.VerifyBackupData(contextWithArgs("--concurrency", "3", "--format", "jsonl", configPath, timestamp))).To(Succeed())
+			results := jsonLines(stdout)
+			Expect(results).To(HaveLen(2))
+			Expect(results[0]["key"]).To(Equal(dataKey(0)))
+			Expect(results[0]["bytes"]).To(BeNumerically("==", len(data)))
+			Expect(results[0]["checksum"]).To(Equal("verified"))
+			Expect(results[0]).ToNot(HaveKey("error"))
+			Expect(results[1]["key"]).To(Equal(dataKey(1)))
+			Expect(results[1]["checksum"]).To(Equal("verified"))
+		})
+		It("reports objects that do not match their checksum or cannot be read and verifies the others", func() {
+			object, _ := server.GetObject(dataKey(0))
+			corrupted := append([]byte{}, data...)
+			corrupted[len(corrupted)-1]++
+			server.PutObject(dataKey(0), corrupted, object.Metadata)
+			server.PutObject("folder_name/backups/20180101/"+timestamp+"/unreadable", []byte("data"), nil)
+			server.InjectFailure(http.MethodGet, "unreadable", http.StatusForbidden, -1)
+
+			err := s3plugin.VerifyBackupData(contextWithArgs("--format", "jsonl", configPath, timestamp))
+			Expect(err).To(MatchError(ContainSubstring("2 of 3 objects of backup " + timestamp + " could not be read or verified")))
+			results := jsonLines(stdout)
+			Expect(results).To(HaveLen(3))
+			Expect(results[0]["checksum"]).To(Equal("present"))
+			Expect(results[0]["error"]).To(ContainSubstring("Checksum mismatch"))
+			Expect(results[1]["checksum"]).To(Equal("verified"))
+			Expect(results[2]["key"]).To(HaveSuffix("unreadable"))
+			Expect(results[2]["checksum"]).To(Equal("missing"))
+			Expect(results[2]["error"]).To(ContainSubstring("AccessDenied"))
+		})
+		It("does not report objects as verified that were not checked against their checksum", func() {
+			// Without the metadata restore does not know the object has a checksum file
+			server.PutObject(dataKey(1), []byte("data for segment 1"), nil)
+
+			Expect(s3plugin.VerifyBackupData(contextWithArgs("--format", "jsonl", configPath, timestamp))).To(Succeed())
+			results := jsonLines(stdout)
+			Expect(results).To(HaveLen(2))
+			Expect(results[0]["checksum"]).To(Equal("verified"))
+			Expect(results[1]["checksum"]).To(Equal("present"))
+			Expect(results[1]).ToNot(HaveKey("error"))
+		})
+		It("fails for a timestamp without objects", func() {
+			err := s3plugin.VerifyBackupData(contextWithArgs(configPath, "20180102010101"))
+			Expect(err).To(MatchError(ContainSubstring("Backup 20180102010101 has no objects")))
+		})
+	})
+
+	Describe("thaw_backup and thaw_status", func() {
+		var stdout *gbytes.Buffer
+		BeforeEach(func() {
+			stdout = captureStdout()
+			Expect(backupData(0, []byte("data for segment 0"))).To(Succeed())
+			Expect(backupData(1, []byte("data for segment 1"))).To(Succeed())
+			server.ArchiveObject(dataKey(0), "GLACIER")
+			server.ArchiveObject(dataKey(0)+".sha256", "GLACIER")
+		})
+		It("refuses to restore an archived object that is not thawed", func() {
+			_, err := restoreData(0)
+			Expect(err).To(MatchError(ContainSubstring(dataKey(0) + " is archived in storage class GLACIER and must be thawed with thaw_backup")))
+			Expect(server.Requests).ToNot(ContainElement(HavePrefix("GET " + dataKey(0) + "?")))
+		})
+		It("thaws the archived objects of a backup and reports when they can be restored", func() {
+			err := s3plugin.ThawBackup(contextWithArgs("--tier", "bulk", "--days", "3", "--format", "jsonl", configPath, timestamp))
+			Expect(err).ToNot(HaveOccurred())
+			results := jsonLines(stdout)
+			Expect(results).To(HaveLen(4))
+			Expect(results[0]).To(Equal(map[string]interface{}{"key": dataKey(0), "storage_class": "GLACIER", "status": "requested"}))
+			Expect(results[1]["key"]).To(Equal(dataKey(0) + ".sha256"))
+			Expect(results[1]["status"]).To(Equal("requested"))
+			Expect(results[2]["status"]).To(Equal("not archived"))
+			Expect(results[3]["status"]).To(Equal("not archived"))
+			object, _ := server.GetObject(dataKey(0))
+			Expect(object.RestoreTier).To(Equal("Bulk"))
+			Expect(object.RestoreDays).To(Equal(3))
+
+			stdout = captureStdout()
+			err = s3plugin.ThawStatus(contextWithArgs("--format", "jsonl", configPath, timestamp))
+			Expect(err).To(MatchError("2 of 2 archived objects of backup " + timestamp + " are not thawed yet"))
+			Expect(jsonLines(stdout)[0]["status"]).To(Equal("in progress"))
+			_, err = restoreData(0)
+			Expect(err).To(MatchError(ContainSubstring("is still being thawed")))
+			stdout = captureStdout()
+			Expect(s3plugin.ThawBackup(contextWithArgs("--format", "jsonl", configPath, timestamp))).To(Succeed())
+			Expect(jsonLines(stdout)[0]["status"]).To(Equal("in progress"))
+
+			expiry := time.Date(2018, 1, 10, 0, 0, 0, 0, time.UTC)
+			server.CompleteRestore(dataKey(0), expiry)
+			server.CompleteRestore(dataKey(0)+".sha256", expiry)
+			stdout = captureStdout()
+			Expect(s3plugin.ThawStatus(contextWithArgs("--format", "jsonl", configPath, timestamp))).To(Succeed())
+			results = jsonLines(stdout)
+			Expect(results[0]["status"]).To(Equal("thawed"))
+			Expect(results[0]["expiry"]).To(Equal("2018-01-10T00:00:00Z"))
+			restored, err := restoreData(0)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(restored)).To(Equal("data for segment 0"))
+		})
+		It("rejects an unknown tier", func() {
+			err := s3plugin.ThawBackup(contextWithArgs("--tier", "Fast", configPath, timestamp))
+			Expect(err).To(MatchError("Invalid --tier Fast. Valid choices are Standard, Bulk, Expedited"))
+		})
+	})
+
+	Describe("replica", func() {
+		var replica *fakeS3Server
+		replicaKey := func(segment int) string {
+			return fmt.Sprintf("replica_folder/backups/20180101/%s/gpbackup_%d_%s", timestamp, segment, timestamp)
+		}
+
+		BeforeEach(func() {
+			replica = newFakeS3Server("replicabucket")
+			writeConfig(fmt.Sprintf(`  replica:
+    endpoint: %s
+    bucket: replicabucket
+    folder: replica_folder
+    encryption: "off"
+    aws_access_key_id: "REPLICAKEY"
+    aws_secret_access_key: "REPLICASECRET"
+`, replica.URL))
+		})
+		AfterEach(func() {
+			replica.Close()
+		})
+
+		It("uploads every file to the primary and the replica", func() {
+			data := randomData(11*1024*1024 + 17)
+			Expect(backupData(0, data)).To(Succeed())
+
+			object, ok := server.GetObject(dataKey(0))
+			Expect(ok).To(BeTrue())
+			Expect(object.Data).To(Equal(data))
+			replicaObject, ok := replica.GetObject(replicaKey(0))
+			Expect(ok).To(BeTrue())
+			Expect(replicaObject.Data).To(Equal(data))
+			Expect(replicaObject.Metadata).To(Equal(object.Metadata))
+			_, ok = replica.GetObject(replicaKey(0) + ".sha256")
+			Expect(ok).To(BeTrue())
+			Expect(replica.AccessKeyIds).To(ContainElement("REPLICAKEY"))
+			Expect(replica.AccessKeyIds).ToNot(ContainElement("12345"))
+			Expect(server.AccessKeyIds).ToNot(ContainElement("REPLICAKEY"))
+		})
+		It("restores from the replica when the primary cannot provide the object", func() {
+			data := randomData(11*1024*1024 + 17)
+			Expect(backupData(0, data)).To(Succeed())
+			server.InjectFailure("", "gpbackup_0_", http.StatusForbidden, -1)
+
+			restored, err := restoreData(0)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(restored).To(Equal(data))
+		})
+		It("fails the backup when the replica fails to store a file", func() {
+			replica.InjectFailure("PUT", "gpbackup_0_", http.StatusForbidden, -1)
+
+			err := backupData(0, []byte("abc"))
+			Expect(err).To(MatchError(ContainSubstring("Unable to upload s3://replicabucket/" + replicaKey(0) +
+				" to the replica")))
+		})
+		It("deletes a backup from both", func() {
+			Expect(backupData(0, []byte("abc"))).To(Succeed())
+
+			Expect(s3plugin.DeleteBackup(contextWithArgs(configPath, timestamp))).To(Succeed())
+			Expect(server.Keys()).To(BeEmpty())
+			Expect(replica.Keys()).To(BeEmpty())
+		})
+	})
+})
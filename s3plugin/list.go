@@ -0,0 +1,207 @@
+package s3plugin
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/olekukonko/tablewriter"
+)
+
+// Output formats accepted by the --format flag of the listing commands
+const (
+	TableFormat     = "table"
+	JSONLinesFormat = "jsonl"
+	CSVFormat       = "csv"
+)
+
+// Views accepted by the --view flag of list_directory
+const (
+	RecursiveView = "recursive"
+	DirectoryView = "directory"
+)
+
+func validateListFormat(format string) error {
+	switch format {
+	case "", TableFormat, JSONLinesFormat, CSVFormat:
+		return nil
+	}
+	return fmt.Errorf("Invalid --format %s. Valid choices are %s, %s or %s.",
+		format, TableFormat, JSONLinesFormat, CSVFormat)
+}
+
+func validateListView(view string) error {
+	switch view {
+	case "", RecursiveView, DirectoryView:
+		return nil
+	}
+	return fmt.Errorf("Invalid --view %s. Valid choices are %s or %s.", view, RecursiveView, DirectoryView)
+}
+
+type listEntry struct {
+	Key          string            `json:"key"`
+	Type         string            `json:"type"`
+	Size         int64             `json:"size"`
+	LastModified string            `json:"last_modified,omitempty"`
+	ETag         string            `json:"etag,omitempty"`
+	StorageClass string            `json:"storage_class,omitempty"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
+	Tags         map[string]string `json:"tags,omitempty"`
+}
+
+func newListEntry(object ObjectInfo) listEntry {
+	if object.IsPrefix {
+		return listEntry{Key: object.Key, Type: "prefix"}
+	}
+	entry := listEntry{
+		Key:          object.Key,
+		Type:         "object",
+		Size:         object.Size,
+		ETag:         object.ETag,
+		StorageClass: object.StorageClass,
+	}
+	if !object.LastModified.IsZero() {
+		entry.LastModified = object.LastModified.UTC().Format(time.RFC3339)
+	}
+	if len(object.Metadata) > 0 {
+		// S3 returns metadata keys in canonical header form
+		entry.Metadata = make(map[string]string, len(object.Metadata))
+		for key, value := range object.Metadata {
+			entry.Metadata[strings.ToLower(key)] = value
+		}
+	}
+	return entry
+}
+
+// The rows a record contributes to the table and CSV output formats
+type listRecord interface {
+	tableRow() []string
+	csvRow() []string
+}
+
+var listEntryTableColumns = []string{"NAME", "SIZE(bytes)", "STORAGE CLASS"}
+var listEntryCSVColumns = []string{"key", "type", "size", "last_modified", "etag", "storage_class", "metadata", "tags"}
+
+func (entry listEntry) tableRow() []string {
+	if entry.Type == "prefix" {
+		return []string{entry.Key, "", ""}
+	}
+	return []string{entry.Key, fmt.Sprint(entry.Size), entry.StorageClass}
+}
+
+func (entry listEntry) csvRow() []string {
+	return []string{entry.Key, entry.Type, fmt.Sprint(entry.Size), entry.LastModified,
+		entry.ETag, entry.StorageClass, csvMap(entry.Metadata), csvMap(entry.Tags)}
+}
+
+// Maps are written to CSV cells as JSON objects
+func csvMap(values map[string]string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	valuesJSON, _ := json.Marshal(values)
+	return string(valuesJSON)
+}
+
+/*
+ * Writes the records of a listing in one of the output formats. The machine
+ * readable formats are streamed, the table is rendered on Flush since its
+ * column widths depend on every row.
+ */
+type listWriter interface {
+	Write(record listRecord) error
+	Flush() error
+}
+
+func newListWriter(format string, out io.Writer, tableColumns []string, csvColumns []string) listWriter {
+	switch format {
+	case JSONLinesFormat:
+		return &jsonListWriter{encoder: json.NewEncoder(out)}
+	case CSVFormat:
+		return &csvListWriter{writer: csv.NewWriter(out), columns: csvColumns}
+	default:
+		return &tableListWriter{out: out, columns: tableColumns, rows: make([][]string, 0)}
+	}
+}
+
+type tableListWriter struct {
+	out     io.Writer
+	columns []string
+	rows    [][]string
+}
+
+func (w *tableListWriter) Write(record listRecord) error {
+	w.rows = append(w.rows, record.tableRow())
+	return nil
+}
+
+func (w *tableListWriter) Flush() error {
+	renderTable(w.out, w.columns, w.rows)
+	return nil
+}
+
+type jsonListWriter struct {
+	encoder *json.Encoder
+}
+
+func (w *jsonListWriter) Write(record listRecord) error {
+	return w.encoder.Encode(record)
+}
+
+func (w *jsonListWriter) Flush() error {
+	return nil
+}
+
+type csvListWriter struct {
+	writer        *csv.Writer
+	columns       []string
+	headerWritten bool
+}
+
+func (w *csvListWriter) writeHeader() error {
+	if w.headerWritten {
+		return nil
+	}
+	w.headerWritten = true
+	return w.writer.Write(w.columns)
+}
+
+func (w *csvListWriter) Write(record listRecord) error {
+	if err := w.writeHeader(); err != nil {
+		return err
+	}
+	return w.writer.Write(record.csvRow())
+}
+
+func (w *csvListWriter) Flush() error {
+	// An empty listing still gets its header
+	if err := w.writeHeader(); err != nil {
+		return err
+	}
+	w.writer.Flush()
+	return w.writer.Error()
+}
+
+func renderTable(out io.Writer, columns []string, rows [][]string) {
+	table := tablewriter.NewWriter(out)
+	table.SetHeader(columns)
+
+	colors := make([]tablewriter.Colors, len(columns))
+	for i := range colors {
+		colors[i] = tablewriter.Colors{tablewriter.Bold}
+	}
+
+	table.SetHeaderColor(colors...)
+	table.SetCenterSeparator(" ")
+	table.SetColumnSeparator(" ")
+	table.SetRowSeparator(" ")
+	table.SetHeaderAlignment(tablewriter.ALIGN_LEFT)
+	table.SetHeaderLine(true)
+	table.SetAutoFormatHeaders(false)
+	table.SetBorders(tablewriter.Border{Left: true, Right: true, Bottom: false, Top: false})
+	table.AppendBulk(rows)
+	table.Render()
+}
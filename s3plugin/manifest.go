@@ -0,0 +1,298 @@
+package s3plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/greenplum-db/gp-common-go-libs/gplog"
+	"github.com/greenplum-db/gp-common-go-libs/operating"
+	"github.com/urfave/cli"
+)
+
+/*
+ * When a backup succeeds, cleanup_plugin_for_backup writes a manifest of the
+ * objects uploaded for its timestamp. The manifest is written last, so its
+ * presence marks a backup that finished, and verify_backup compares the
+ * objects that are stored now against it.
+ *
+ * Checksum files are not listed as objects of their own, their digest is
+ * recorded with the object they belong to.
+ */
+
+type manifestEntry struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	Sha256 string `json:"sha256,omitempty"`
+}
+
+type backupManifest struct {
+	Timestamp string          `json:"timestamp"`
+	Objects   []manifestEntry `json:"objects"`
+}
+
+type manifestProblem struct {
+	Key          string `json:"key"`
+	Problem      string `json:"problem"`
+	ExpectedSize int64  `json:"expected_size"`
+	ActualSize   int64  `json:"actual_size"`
+}
+
+var manifestProblemTableColumns = []string{"KEY", "PROBLEM", "EXPECTED SIZE(bytes)", "ACTUAL SIZE(bytes)"}
+var manifestProblemCSVColumns = []string{"key", "problem", "expected_size", "actual_size"}
+
+func (problem manifestProblem) tableRow() []string {
+	return []string{problem.Key, problem.Problem, fmt.Sprint(problem.ExpectedSize), fmt.Sprint(problem.ActualSize)}
+}
+
+func (problem manifestProblem) csvRow() []string {
+	return problem.tableRow()
+}
+
+func manifestName(timestamp string) string {
+	return fmt.Sprintf("gpbackup_%s_manifest.json", timestamp)
+}
+
+// Objects the plugin itself stores next to the files of a backup
+func isBackupBookkeeping(name string, timestamp string, objects map[string]ObjectInfo) bool {
+	return isChecksumFile(name, objects) || name == manifestName(timestamp) || name == failedMarkerName(timestamp)
+}
+
+// Returns the objects stored under prefix by their name relative to it
+func listBackupObjects(storage Storage, prefix string) (map[string]ObjectInfo, error) {
+	objects := make(map[string]ObjectInfo)
+	// Keys are listed without the leading / a folder may have
+	keyPrefix := strings.TrimLeft(prefix, "/")
+	err := storage.Walk(prefix, func(object ObjectInfo) error {
+		if !strings.HasSuffix(object.Key, "/") {
+			objects[strings.TrimPrefix(strings.TrimLeft(object.Key, "/"), keyPrefix)] = object
+		}
+		return nil
+	})
+	return objects, err
+}
+
+/*
+ * The manifest lists the objects recorded by the sidecars uploaded with them,
+ * rather than the objects that happen to be stored when it is written, so an
+ * object that was uploaded and has since gone missing is still listed and
+ * verify_backup reports it. The hosts of a backup only share the bucket and
+ * the coordinator cleans up before the segment hosts do, which is why the
+ * uploads are not recorded in upload_state_dir.
+ */
+func writeBackupManifest(storage Storage, config *PluginConfig, timestamp string) (int, error) {
+	prefix := backupPrefix(config.Options.Folder, timestamp)
+	objects, err := listBackupObjects(storage, prefix)
+	if err != nil {
+		return 0, err
+	}
+	records, err := readUploadRecords(storage, config, objects)
+	if err != nil {
+		return 0, err
+	}
+
+	manifest := backupManifest{Timestamp: timestamp, Objects: make([]manifestEntry, 0, len(objects))}
+	for name, record := range records {
+		if _, ok := objects[name]; !ok {
+			gplog.Warn("Object %s of backup %s was uploaded but is no longer stored", prefix+name, timestamp)
+		}
+		manifest.Objects = append(manifest.Objects, record)
+	}
+	for name, object := range objects {
+		_, isRecord := records[strings.TrimSuffix(name, checksumSuffix)]
+		if isRecord || isBackupBookkeeping(name, timestamp, objects) {
+			continue
+		}
+		// Objects uploaded by plugin versions that did not record uploads
+		manifest.Objects = append(manifest.Objects, manifestEntry{Name: name, Size: object.Size})
+	}
+	sort.Slice(manifest.Objects, func(i, j int) bool { return manifest.Objects[i].Name < manifest.Objects[j].Name })
+
+	contents, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+	_, err = putObject(storage, config, prefix+manifestName(timestamp), bytes.NewReader(contents),
+		backupMetadata(config, prefix+manifestName(timestamp), ""))
+	return len(manifest.Objects), err
+}
+
+/*
+ * Returns the uploads recorded by the sidecars among objects by the name of
+ * the object they belong to. The sidecars are read DownloadConcurrency at a
+ * time.
+ */
+func readUploadRecords(storage Storage, config *PluginConfig,
+	objects map[string]ObjectInfo) (map[string]manifestEntry, error) {
+
+	jobs := make(chan string, len(objects))
+	for name := range objects {
+		if strings.HasSuffix(name, checksumSuffix) {
+			jobs <- name
+		}
+	}
+	close(jobs)
+
+	records := make(map[string]manifestEntry)
+	var mutex sync.Mutex
+	var finalErr error
+	var wg sync.WaitGroup
+	for i := 0; i < config.Options.DownloadConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for sidecar := range jobs {
+				record, ok, err := readUploadRecord(storage, config, sidecar, objects)
+				mutex.Lock()
+				if err != nil && finalErr == nil {
+					finalErr = err
+				} else if ok {
+					records[record.Name] = record
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return records, finalErr
+}
+
+func readUploadRecord(storage Storage, config *PluginConfig, sidecar string,
+	objects map[string]ObjectInfo) (manifestEntry, bool, error) {
+
+	name := strings.TrimSuffix(sidecar, checksumSuffix)
+	fileKey := strings.TrimSuffix(objects[sidecar].Key, checksumSuffix)
+	info, err := storage.Head(checksumKey(fileKey))
+	if err != nil {
+		return manifestEntry{}, false, err
+	}
+	size, err := strconv.ParseInt(getMetadataValue(info.Metadata, checksumSizeMeta), 10, 64)
+	if err != nil {
+		// Sidecars of older plugin versions do not record the size, and files
+		// ending in .sha256 that are not sidecars record nothing at all
+		object, ok := objects[name]
+		if !ok {
+			return manifestEntry{}, false, nil
+		}
+		size = object.Size
+	}
+	digest, err := downloadChecksum(storage, config, fileKey)
+	if err != nil {
+		return manifestEntry{}, false, err
+	}
+	return manifestEntry{Name: name, Size: size, Sha256: digest}, true, nil
+}
+
+func readBackupManifest(storage Storage, config *PluginConfig, timestamp string) (*backupManifest, error) {
+	buffer := &bytes.Buffer{}
+	manifestKey := backupPrefix(config.Options.Folder, timestamp) + manifestName(timestamp)
+	if _, _, err := downloadFile(storage, config, manifestKey, buffer); err != nil {
+		return nil, fmt.Errorf("Unable to read manifest %s: %s", manifestKey, err)
+	}
+	manifest := &backupManifest{}
+	if err := json.Unmarshal(buffer.Bytes(), manifest); err != nil {
+		return nil, fmt.Errorf("Unable to parse manifest %s: %s", manifestKey, err)
+	}
+	return manifest, nil
+}
+
+/*
+ * Calls fn for every object of the manifest of timestamp that is missing or
+ * has a different size, and for every object stored under the timestamp that
+ * the manifest does not list. It returns the number of objects the manifest
+ * lists.
+ */
+func verifyBackupManifest(storage Storage, config *PluginConfig, timestamp string,
+	fn func(problem manifestProblem) error) (int, error) {
+
+	prefix := backupPrefix(config.Options.Folder, timestamp)
+	objects, err := listBackupObjects(storage, prefix)
+	if err != nil {
+		return 0, err
+	}
+	// Listing first avoids waiting for the retries of a request for a
+	// manifest that does not exist
+	if _, ok := objects[manifestName(timestamp)]; !ok {
+		return 0, fmt.Errorf("Backup %s has no manifest. It did not finish, failed, "+
+			"or was taken by a plugin version that did not write manifests", timestamp)
+	}
+	manifest, err := readBackupManifest(storage, config, timestamp)
+	if err != nil {
+		return 0, err
+	}
+
+	listed := make(map[string]bool)
+	for _, entry := range manifest.Objects {
+		listed[entry.Name] = true
+		if entry.Sha256 != "" {
+			listed[checksumKey(entry.Name)] = true
+		}
+		object, ok := objects[entry.Name]
+		if !ok {
+			err = fn(manifestProblem{Key: prefix + entry.Name, Problem: "missing", ExpectedSize: entry.Size})
+		} else if object.Size != entry.Size {
+			err = fn(manifestProblem{Key: object.Key, Problem: "size mismatch", ExpectedSize: entry.Size,
+				ActualSize: object.Size})
+		} else if _, ok := objects[checksumKey(entry.Name)]; entry.Sha256 != "" && !ok {
+			err = fn(manifestProblem{Key: prefix + checksumKey(entry.Name), Problem: "missing checksum",
+				ExpectedSize: entry.Size, ActualSize: object.Size})
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	names := make([]string, 0, len(objects))
+	for name := range objects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if listed[name] || isBackupBookkeeping(name, timestamp, objects) {
+			continue
+		}
+		object := objects[name]
+		if err = fn(manifestProblem{Key: object.Key, Problem: "extra", ActualSize: object.Size}); err != nil {
+			return 0, err
+		}
+	}
+	return len(manifest.Objects), nil
+}
+
+func VerifyBackup(c *cli.Context) error {
+	format := c.String("format")
+	if err := validateListFormat(format); err != nil {
+		return err
+	}
+	timestamp := c.Args().Get(1)
+	if !IsValidTimestamp(timestamp) {
+		return fmt.Errorf("verify_backup requires a <timestamp> with format "+
+			"YYYYMMDDHHMMSS, but received: %s", timestamp)
+	}
+	config, storage, err := readConfigAndOpenStorage(c)
+	if err != nil {
+		return err
+	}
+
+	writer := newListWriter(format, operating.System.Stdout, manifestProblemTableColumns, manifestProblemCSVColumns)
+	numProblems := 0
+	numObjects, err := verifyBackupManifest(storage, config, timestamp, func(problem manifestProblem) error {
+		numProblems++
+		return writer.Write(problem)
+	})
+	if err != nil {
+		return err
+	}
+	if err = writer.Flush(); err != nil {
+		return err
+	}
+	if numProblems > 0 {
+		return fmt.Errorf("Backup %s does not match its manifest of %d objects: %d problems found",
+			timestamp, numObjects, numProblems)
+	}
+	gplog.Info("Backup %s matches its manifest of %d objects", timestamp, numObjects)
+	return nil
+}
@@ -0,0 +1,226 @@
+package s3plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/greenplum-db/gp-common-go-libs/gplog"
+	"github.com/inhies/go-bytesize"
+)
+
+/*
+ * Host memory budget.
+ *
+ * Every segment runs its own plugin process, and each of them buffers up to
+ * chunk size times concurrency bytes per transfer. With host_memory_budget
+ * set, a process reserves the memory it is going to buffer in a ledger in
+ * upload_state_dir that all plugin processes of the host share, under an
+ * exclusive file lock. If the budget left is too small for the configured
+ * chunk size and concurrency, the concurrency is lowered first and then the
+ * chunk size, down to the smallest part size S3 accepts. A process that cannot
+ * get even that waits for others to finish. Reservations of processes that
+ * died are dropped, so a killed backup does not shrink the budget for good.
+ */
+
+// S3 rejects multipart upload parts smaller than this, except the last one
+const minTransferChunkSize = int64(5 * Mebibyte)
+
+var memoryBudgetPollInterval = time.Second
+
+type memoryReservation struct {
+	Bytes     int64     `json:"bytes"`
+	Direction string    `json:"direction"`
+	Started   time.Time `json:"started"`
+}
+
+type memoryLedger struct {
+	Reservations map[string]memoryReservation `json:"reservations"`
+}
+
+func validateMemoryBudget(opt *PluginOptions) string {
+	if opt.HostMemoryBudget == "" {
+		return ""
+	}
+	budget, err := bytesize.Parse(opt.HostMemoryBudget)
+	if err != nil {
+		return fmt.Sprintf("Invalid host_memory_budget. Err: %s\n", err)
+	}
+	// Converted from uint64 like the chunk sizes
+	opt.HostMemoryBudgetBytes = int64(budget)
+	if opt.HostMemoryBudgetBytes < transferMemory(BackupTransfer, minTransferChunkSize, 1) {
+		return fmt.Sprintf("host_memory_budget must be at least %s\n",
+			bytesize.New(float64(transferMemory(BackupTransfer, minTransferChunkSize, 1))))
+	}
+	return ""
+}
+
+/*
+ * The memory a single transfer buffers. An upload buffers its input in front
+ * of the uploader in addition to the parts the uploader holds, a download
+ * only holds its chunks.
+ */
+func transferMemory(direction string, chunkSize int64, concurrency int) int64 {
+	if direction == BackupTransfer {
+		return 2 * chunkSize * int64(concurrency)
+	}
+	return chunkSize * int64(concurrency)
+}
+
+/*
+ * Returns the largest chunk size and concurrency up to the configured ones
+ * whose memory fits into available, or false if not even a single chunk of
+ * the smallest size fits.
+ */
+func fitTransferMemory(direction string, chunkSize int64, concurrency int, available int64) (int64, int, bool) {
+	if transferMemory(direction, chunkSize, concurrency) <= available {
+		return chunkSize, concurrency, true
+	}
+	if fitting := available / transferMemory(direction, chunkSize, 1); fitting >= 1 {
+		return chunkSize, int(fitting), true
+	}
+	fittingChunkSize := available / transferMemory(direction, 1, 1)
+	if fittingChunkSize < minTransferChunkSize {
+		return 0, 0, false
+	}
+	return fittingChunkSize, 1, true
+}
+
+func memoryLedgerPath(config *PluginConfig) string {
+	return filepath.Join(config.Options.UploadStateDir, "memory_budget.json")
+}
+
+// Runs fn while holding an exclusive lock on path, shared by all processes
+func withFileLock(path string, fn func() error) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	lockFile, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer lockFile.Close()
+	if err = syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("Unable to lock %s: %s", path, err)
+	}
+	defer syscall.Flock(int(lockFile.Fd()), syscall.LOCK_UN)
+	return fn()
+}
+
+func isProcessAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+func updateMemoryLedger(config *PluginConfig, fn func(ledger *memoryLedger) error) error {
+	ledgerPath := memoryLedgerPath(config)
+	return withFileLock(ledgerPath+".lock", func() error {
+		ledger := &memoryLedger{}
+		contents, err := ioutil.ReadFile(ledgerPath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if len(contents) > 0 {
+			if err = json.Unmarshal(contents, ledger); err != nil {
+				gplog.Warn("Discarding unreadable memory budget ledger %s: %s", ledgerPath, err)
+			}
+		}
+		if ledger.Reservations == nil {
+			ledger.Reservations = make(map[string]memoryReservation)
+		}
+		for pid := range ledger.Reservations {
+			if number, err := strconv.Atoi(pid); err != nil || !isProcessAlive(number) {
+				delete(ledger.Reservations, pid)
+			}
+		}
+		if err = fn(ledger); err != nil {
+			return err
+		}
+		contents, err = json.Marshal(ledger)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(ledgerPath, contents, 0600)
+	})
+}
+
+/*
+ * Reserves the memory for the given number of simultaneous transfers of this
+ * process in the host memory budget, lowering the chunk size and concurrency
+ * of the direction in config to fit into it. The returned function releases
+ * the reservation. Without a budget nothing is reserved or changed.
+ */
+func reserveTransferMemory(config *PluginConfig, direction string, transfers int) (func(), error) {
+	opt := &config.Options
+	if opt.HostMemoryBudgetBytes == 0 {
+		return func() {}, nil
+	}
+	if transfers < 1 {
+		transfers = 1
+	}
+	if opt.ReplicaConfig != nil && direction == BackupTransfer {
+		// Every upload to the replica buffers as much as the one to the primary
+		transfers *= 2
+	}
+	chunkSize, concurrency := &opt.DownloadChunkSize, &opt.DownloadConcurrency
+	if direction == BackupTransfer {
+		chunkSize, concurrency = &opt.UploadChunkSize, &opt.UploadConcurrency
+	}
+	pid := strconv.Itoa(os.Getpid())
+
+	waiting := false
+	for {
+		reserved := false
+		err := updateMemoryLedger(config, func(ledger *memoryLedger) error {
+			available := opt.HostMemoryBudgetBytes
+			for _, reservation := range ledger.Reservations {
+				available -= reservation.Bytes
+			}
+			fittingChunkSize, fittingConcurrency, ok := fitTransferMemory(direction, *chunkSize, *concurrency,
+				available/int64(transfers))
+			if !ok {
+				return nil
+			}
+			if fittingChunkSize != *chunkSize || fittingConcurrency != *concurrency {
+				gplog.Info("Lowered chunk size from %d to %d bytes and concurrency from %d to %d "+
+					"to stay within host_memory_budget", *chunkSize, fittingChunkSize, *concurrency, fittingConcurrency)
+			}
+			*chunkSize, *concurrency = fittingChunkSize, fittingConcurrency
+			ledger.Reservations[pid] = memoryReservation{
+				Bytes:     int64(transfers) * transferMemory(direction, fittingChunkSize, fittingConcurrency),
+				Direction: direction,
+				Started:   time.Now(),
+			}
+			reserved = true
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Unable to reserve memory in host_memory_budget: %s", err)
+		}
+		if reserved {
+			break
+		}
+		if !waiting {
+			gplog.Info("Waiting for other plugin processes on this host to release memory of host_memory_budget")
+			waiting = true
+		}
+		time.Sleep(memoryBudgetPollInterval)
+	}
+	gplog.Verbose("Transferring with chunk size %d bytes and concurrency %d within host_memory_budget",
+		*chunkSize, *concurrency)
+
+	return func() {
+		err := updateMemoryLedger(config, func(ledger *memoryLedger) error {
+			delete(ledger.Reservations, pid)
+			return nil
+		})
+		if err != nil {
+			gplog.Warn("Unable to release memory in host_memory_budget: %s", err)
+		}
+	}, nil
+}
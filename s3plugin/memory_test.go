@@ -0,0 +1,124 @@
+package s3plugin
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("host memory budget", func() {
+	var config *PluginConfig
+	var stateDir string
+
+	reserveFor := func(pid int, bytes int64) {
+		Expect(updateMemoryLedger(config, func(ledger *memoryLedger) error {
+			ledger.Reservations[strconv.Itoa(pid)] = memoryReservation{Bytes: bytes, Direction: BackupTransfer}
+			return nil
+		})).To(Succeed())
+	}
+	reservations := func() map[string]memoryReservation {
+		ledger := memoryLedger{}
+		contents, err := ioutil.ReadFile(memoryLedgerPath(config))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(json.Unmarshal(contents, &ledger)).To(Succeed())
+		return ledger.Reservations
+	}
+
+	BeforeEach(func() {
+		var err error
+		stateDir, err = ioutil.TempDir("", "s3plugin_memory")
+		Expect(err).ToNot(HaveOccurred())
+		config = &PluginConfig{Options: PluginOptions{
+			UploadStateDir:        stateDir,
+			UploadChunkSize:       500 * Mebibyte,
+			UploadConcurrency:     6,
+			DownloadChunkSize:     100 * Mebibyte,
+			DownloadConcurrency:   6,
+			HostMemoryBudgetBytes: 1000 * Mebibyte,
+		}}
+	})
+	AfterEach(func() {
+		_ = os.RemoveAll(stateDir)
+	})
+
+	It("lowers the concurrency first and then the chunk size", func() {
+		chunkSize, concurrency, ok := fitTransferMemory(RestoreTransfer, 100*Mebibyte, 6, 350*Mebibyte)
+		Expect(ok).To(BeTrue())
+		Expect(chunkSize).To(Equal(int64(100 * Mebibyte)))
+		Expect(concurrency).To(Equal(3))
+
+		chunkSize, concurrency, ok = fitTransferMemory(BackupTransfer, 100*Mebibyte, 6, 50*Mebibyte)
+		Expect(ok).To(BeTrue())
+		Expect(chunkSize).To(Equal(int64(25 * Mebibyte)))
+		Expect(concurrency).To(Equal(1))
+
+		_, _, ok = fitTransferMemory(BackupTransfer, 100*Mebibyte, 6, 9*Mebibyte)
+		Expect(ok).To(BeFalse())
+	})
+	It("keeps the configured values if they fit", func() {
+		release, err := reserveTransferMemory(config, RestoreTransfer, 1)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(config.Options.DownloadChunkSize).To(Equal(int64(100 * Mebibyte)))
+		Expect(config.Options.DownloadConcurrency).To(Equal(6))
+		Expect(reservations()).To(HaveKeyWithValue(strconv.Itoa(os.Getpid()),
+			HaveField("Bytes", int64(600*Mebibyte))))
+
+		release()
+		Expect(reservations()).To(BeEmpty())
+	})
+	It("fits into what other processes on the host left of the budget", func() {
+		reserveFor(os.Getppid(), 900*Mebibyte)
+		release, err := reserveTransferMemory(config, BackupTransfer, 2)
+		Expect(err).ToNot(HaveOccurred())
+		defer release()
+		Expect(config.Options.UploadChunkSize).To(Equal(int64(25 * Mebibyte)))
+		Expect(config.Options.UploadConcurrency).To(Equal(1))
+		Expect(reservations()[strconv.Itoa(os.Getpid())].Bytes).To(Equal(int64(100 * Mebibyte)))
+	})
+	It("drops the reservations of processes that no longer run", func() {
+		reserveFor(1<<30, 1000*Mebibyte)
+		release, err := reserveTransferMemory(config, RestoreTransfer, 1)
+		Expect(err).ToNot(HaveOccurred())
+		defer release()
+		Expect(config.Options.DownloadConcurrency).To(Equal(6))
+		Expect(reservations()).To(HaveLen(1))
+	})
+	It("waits until enough of the budget is released", func() {
+		memoryBudgetPollInterval = 10 * time.Millisecond
+		defer func() { memoryBudgetPollInterval = time.Second }()
+		reserveFor(os.Getppid(), 1000*Mebibyte)
+		go func() {
+			defer GinkgoRecover()
+			time.Sleep(100 * time.Millisecond)
+			reserveFor(os.Getppid(), 400*Mebibyte)
+		}()
+
+		start := time.Now()
+		release, err := reserveTransferMemory(config, RestoreTransfer, 1)
+		Expect(err).ToNot(HaveOccurred())
+		defer release()
+		Expect(time.Since(start)).To(BeNumerically(">=", 100*time.Millisecond))
+		Expect(config.Options.DownloadConcurrency).To(Equal(6))
+	})
+	It("does nothing without a budget", func() {
+		config.Options.HostMemoryBudgetBytes = 0
+		release, err := reserveTransferMemory(config, BackupTransfer, 1)
+		Expect(err).ToNot(HaveOccurred())
+		release()
+		Expect(config.Options.UploadChunkSize).To(Equal(int64(500 * Mebibyte)))
+		_, err = os.Stat(memoryLedgerPath(config))
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+	It("rejects a budget too small for a single part", func() {
+		opt := &PluginOptions{HostMemoryBudget: "8MB"}
+		Expect(validateMemoryBudget(opt)).To(ContainSubstring("host_memory_budget must be at least"))
+		opt = &PluginOptions{HostMemoryBudget: "2GB"}
+		Expect(validateMemoryBudget(opt)).To(BeEmpty())
+		Expect(opt.HostMemoryBudgetBytes).To(Equal(int64(2 * 1024 * Mebibyte)))
+	})
+})
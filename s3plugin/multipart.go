@@ -0,0 +1,441 @@
+package s3plugin
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/greenplum-db/gp-common-go-libs/gplog"
+	"github.com/greenplum-db/gp-common-go-libs/operating"
+	"github.com/urfave/cli"
+)
+
+/*
+ * Resumable multipart uploads.
+ *
+ * When the source of an upload is a local file, the plugin runs the multipart
+ * upload itself rather than through s3manager, and records the upload id and
+ * every completed part in a state file in upload_state_dir. If the process
+ * dies, the next upload of the same unchanged file to the same key picks the
+ * upload up again and only sends the parts S3 does not have yet. Streams such
+ * as the data piped to backup_data cannot be re-read and are uploaded as
+ * before.
+ */
+
+const DefaultUploadStateDir = "/tmp/gpbackup_s3_plugin_uploads"
+
+// Implemented by storage backends that can resume the upload of a local file
+type resumableStorage interface {
+	PutFile(key string, file *os.File, metadata map[string]string) error
+}
+
+type uploadState struct {
+	Bucket   string           `json:"bucket"`
+	Key      string           `json:"key"`
+	UploadId string           `json:"upload_id"`
+	Size     int64            `json:"size"`
+	ModTime  time.Time        `json:"mod_time"`
+	PartSize int64            `json:"part_size"`
+	Parts    map[int64]string `json:"parts"`
+}
+
+func uploadStatePath(stateDir string, bucket string, key string) string {
+	name := sha256.Sum256([]byte(bucket + "/" + key))
+	return filepath.Join(stateDir, hex.EncodeToString(name[:])+".json")
+}
+
+func loadUploadState(path string) (*uploadState, error) {
+	contents, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	state := &uploadState{}
+	if err = json.Unmarshal(contents, state); err != nil {
+		return nil, fmt.Errorf("Unable to parse upload state file %s: %s", path, err)
+	}
+	return state, nil
+}
+
+// Replaces the state file atomically so a crash never leaves it half written
+func (state *uploadState) save(path string) error {
+	contents, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tempPath := path + ".tmp"
+	if err = ioutil.WriteFile(tempPath, contents, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tempPath, path)
+}
+
+func (state *uploadState) numParts() int64 {
+	return (state.Size + state.PartSize - 1) / state.PartSize
+}
+
+func (state *uploadState) partRange(partNumber int64) (int64, int64) {
+	offset := (partNumber - 1) * state.PartSize
+	length := state.PartSize
+	if offset+length > state.Size {
+		length = state.Size - offset
+	}
+	return offset, length
+}
+
+func canResumeUpload(storage Storage, config *PluginConfig, file io.Reader) (resumableStorage, *os.File) {
+	resumable, ok := storage.(resumableStorage)
+	if !ok || len(config.Options.ClientSideEncryptionKey) > 0 {
+		// The ciphertext of an object differs on every upload, so parts
+		// uploaded by an earlier attempt cannot be reused
+		return nil, nil
+	}
+	if config.Options.Compression != CompressionNone && config.Options.Compression != "" {
+		// Parts are sections of the local file, which is stored as is
+		return nil, nil
+	}
+	localFile, ok := file.(*os.File)
+	if !ok {
+		return nil, nil
+	}
+	info, err := localFile.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		return nil, nil
+	}
+	return resumable, localFile
+}
+
+func (s *s3Storage) PutFile(key string, file *os.File, metadata map[string]string) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	partSize := s.options.UploadChunkSize
+	if (info.Size()+partSize-1)/partSize > s3manager.MaxUploadParts {
+		partSize = info.Size()/s3manager.MaxUploadParts + 1
+	}
+
+	statePath := uploadStatePath(s.options.UploadStateDir, s.bucket, key)
+	state := &uploadState{Bucket: s.bucket, Key: key, Size: info.Size(), ModTime: info.ModTime(),
+		PartSize: partSize, Parts: make(map[int64]string)}
+	resumed, err := s.resumeUpload(statePath, state)
+	if err != nil {
+		return err
+	}
+	if !resumed && info.Size() <= partSize {
+		return s.Put(key, file, metadata)
+	}
+	if resumed {
+		gplog.Info("Resuming upload of %s with %d of %d parts already uploaded",
+			filepath.Base(key), len(state.Parts), state.numParts())
+	} else {
+		input := &s3.CreateMultipartUploadInput{Bucket: aws.String(s.bucket), Key: aws.String(key)}
+		if len(metadata) > 0 {
+			input.Metadata = aws.StringMap(metadata)
+		}
+		if storageClass := objectStorageClass(s.options, key); storageClass != "" {
+			input.StorageClass = aws.String(storageClass)
+		}
+		if tagging := objectTagging(s.options, metadata); tagging != "" {
+			input.Tagging = aws.String(tagging)
+		}
+		setCreateMultipartEncryption(input, s.options)
+		setCreateMultipartObjectLock(input, s.options)
+		output, err := s.client.CreateMultipartUpload(input)
+		if err != nil {
+			return err
+		}
+		state.UploadId = aws.StringValue(output.UploadId)
+		if err = state.save(statePath); err != nil {
+			return fmt.Errorf("Unable to save upload state of %s: %s", key, err)
+		}
+	}
+
+	if err = s.uploadParts(statePath, state, file); err != nil {
+		return err
+	}
+	if err = s.completeUpload(state); err != nil {
+		return err
+	}
+	if err = os.Remove(statePath); err != nil && !os.IsNotExist(err) {
+		gplog.Warn("Unable to remove upload state file %s: %s", statePath, err)
+	}
+	return nil
+}
+
+/*
+ * Fills state with the upload recorded in statePath if it is an upload of the
+ * same file and S3 still has it. Any other recorded upload is aborted. The
+ * recorded upload keeps its part size, which the chunk size may no longer
+ * match once the memory budget lowered it.
+ */
+func (s *s3Storage) resumeUpload(statePath string, state *uploadState) (bool, error) {
+	saved, err := loadUploadState(statePath)
+	if err != nil || saved == nil {
+		return false, err
+	}
+	if saved.Bucket != state.Bucket || saved.Key != state.Key || saved.Size != state.Size ||
+		!saved.ModTime.Equal(state.ModTime) || saved.PartSize <= 0 {
+		gplog.Verbose("Discarding upload %s of %s, the file changed since it was started", saved.UploadId, saved.Key)
+		_ = s.abortUpload(saved.Key, saved.UploadId)
+		return false, os.Remove(statePath)
+	}
+
+	// Trust S3 rather than the state file about which parts it has, the
+	// process may have died between a part completing and the file being saved
+	state.UploadId = saved.UploadId
+	state.PartSize = saved.PartSize
+	err = s.client.ListPartsPages(&s3.ListPartsInput{
+		Bucket:   aws.String(s.bucket),
+		Key:      aws.String(state.Key),
+		UploadId: aws.String(state.UploadId),
+	}, func(page *s3.ListPartsOutput, lastPage bool) bool {
+		for _, part := range page.Parts {
+			partNumber := aws.Int64Value(part.PartNumber)
+			if partNumber < 1 || partNumber > state.numParts() {
+				continue
+			}
+			if _, length := state.partRange(partNumber); aws.Int64Value(part.Size) == length {
+				state.Parts[partNumber] = aws.StringValue(part.ETag)
+			}
+		}
+		return true
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchUpload {
+		gplog.Verbose("Upload %s of %s no longer exists, starting over", state.UploadId, state.Key)
+		state.UploadId = ""
+		return false, os.Remove(statePath)
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *s3Storage) uploadParts(statePath string, state *uploadState, file *os.File) error {
+	jobs := make(chan int64, state.numParts())
+	for partNumber := int64(1); partNumber <= state.numParts(); partNumber++ {
+		if _, ok := state.Parts[partNumber]; !ok {
+			jobs <- partNumber
+		}
+	}
+	close(jobs)
+	gplog.Debug("Uploading %d parts of %s with partsize %d and concurrency %d",
+		len(jobs), filepath.Base(state.Key), state.PartSize, s.options.UploadConcurrency)
+
+	var mutex sync.Mutex
+	var finalErr error
+	var wg sync.WaitGroup
+	for i := 0; i < s.options.UploadConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for partNumber := range jobs {
+				mutex.Lock()
+				failed := finalErr != nil
+				mutex.Unlock()
+				if failed {
+					return
+				}
+				offset, length := state.partRange(partNumber)
+				input := &s3.UploadPartInput{
+					Bucket:        aws.String(s.bucket),
+					Key:           aws.String(state.Key),
+					UploadId:      aws.String(state.UploadId),
+					PartNumber:    aws.Int64(partNumber),
+					Body:          io.NewSectionReader(file, offset, length),
+					ContentLength: aws.Int64(length),
+				}
+				if s.options.ServerSideEncryption == SseC {
+					input.SSECustomerAlgorithm, input.SSECustomerKey = sseCustomerKeyParams(s.options)
+				}
+				// The SDK reads the part once for its checksums before sending
+				// it and again on every retry, so it is charged once up front
+				s.limiter.wait(int(length))
+				release := s.host.acquireRequest()
+				output, err := s.client.UploadPart(input)
+				release()
+
+				mutex.Lock()
+				if err == nil {
+					state.Parts[partNumber] = aws.StringValue(output.ETag)
+					err = state.save(statePath)
+				}
+				if err != nil && finalErr == nil {
+					finalErr = fmt.Errorf("Unable to upload part %d of %s: %s", partNumber, state.Key, err)
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return finalErr
+}
+
+func (s *s3Storage) completeUpload(state *uploadState) error {
+	parts := make([]*s3.CompletedPart, 0, len(state.Parts))
+	for partNumber, etag := range state.Parts {
+		parts = append(parts, &s3.CompletedPart{PartNumber: aws.Int64(partNumber), ETag: aws.String(etag)})
+	}
+	sort.Slice(parts, func(i, j int) bool { return *parts[i].PartNumber < *parts[j].PartNumber })
+	_, err := s.client.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.bucket),
+		Key:             aws.String(state.Key),
+		UploadId:        aws.String(state.UploadId),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	return err
+}
+
+func (s *s3Storage) abortUpload(key string, uploadId string) error {
+	_, err := s.client.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(s.bucket),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadId),
+	})
+	return err
+}
+
+type incompleteUpload struct {
+	Key       string    `json:"key"`
+	UploadId  string    `json:"upload_id"`
+	Initiated time.Time `json:"initiated"`
+	Parts     int       `json:"parts"`
+	Bytes     int64     `json:"bytes"`
+}
+
+var incompleteUploadTableColumns = []string{"KEY", "UPLOAD ID", "INITIATED", "PARTS", "SIZE(bytes)"}
+var incompleteUploadCSVColumns = []string{"key", "upload_id", "initiated", "parts", "bytes"}
+
+func (upload incompleteUpload) tableRow() []string {
+	return []string{upload.Key, upload.UploadId, formatCatalogTime(upload.Initiated),
+		fmt.Sprint(upload.Parts), fmt.Sprint(upload.Bytes)}
+}
+
+func (upload incompleteUpload) csvRow() []string {
+	return upload.tableRow()
+}
+
+// Calls fn for every multipart upload under prefix that was started but not completed
+func (s *s3Storage) walkIncompleteUploads(prefix string, fn func(upload incompleteUpload) error) error {
+	var fnErr error
+	err := s.client.ListMultipartUploadsPages(&s3.ListMultipartUploadsInput{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(listPrefix(prefix)),
+	}, func(page *s3.ListMultipartUploadsOutput, lastPage bool) bool {
+		for _, multipartUpload := range page.Uploads {
+			upload := incompleteUpload{
+				Key:       aws.StringValue(multipartUpload.Key),
+				UploadId:  aws.StringValue(multipartUpload.UploadId),
+				Initiated: aws.TimeValue(multipartUpload.Initiated),
+			}
+			fnErr = s.client.ListPartsPages(&s3.ListPartsInput{
+				Bucket:   aws.String(s.bucket),
+				Key:      multipartUpload.Key,
+				UploadId: multipartUpload.UploadId,
+			}, func(parts *s3.ListPartsOutput, lastPage bool) bool {
+				for _, part := range parts.Parts {
+					upload.Parts++
+					upload.Bytes += aws.Int64Value(part.Size)
+				}
+				return true
+			})
+			if aerr, ok := fnErr.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchUpload {
+				// Completed or aborted since it was listed
+				fnErr = nil
+				continue
+			}
+			if fnErr == nil {
+				fnErr = fn(upload)
+			}
+			if fnErr != nil {
+				return false
+			}
+		}
+		return true
+	})
+	if fnErr != nil {
+		return fnErr
+	}
+	return err
+}
+
+func requireS3Storage(storage Storage, command string) (*s3Storage, error) {
+	bucketStorage, ok := primaryS3Storage(storage)
+	if !ok {
+		return nil, fmt.Errorf("%s requires storage_backend s3", command)
+	}
+	return bucketStorage, nil
+}
+
+func ListIncompleteUploads(c *cli.Context) error {
+	format := c.String("format")
+	if err := validateListFormat(format); err != nil {
+		return err
+	}
+	config, storage, err := readConfigAndOpenStorage(c)
+	if err != nil {
+		return err
+	}
+	bucketStorage, err := requireS3Storage(storage, "list_incomplete_uploads")
+	if err != nil {
+		return err
+	}
+
+	writer := newListWriter(format, operating.System.Stdout, incompleteUploadTableColumns, incompleteUploadCSVColumns)
+	err = bucketStorage.walkIncompleteUploads(config.Options.Folder+"/", func(upload incompleteUpload) error {
+		return writer.Write(upload)
+	})
+	if err != nil {
+		return err
+	}
+	return writer.Flush()
+}
+
+func AbortIncompleteUploads(c *cli.Context) error {
+	config, storage, err := readConfigAndOpenStorage(c)
+	if err != nil {
+		return err
+	}
+	bucketStorage, err := requireS3Storage(storage, "abort_incomplete_uploads")
+	if err != nil {
+		return err
+	}
+
+	// Either every upload under the folder or only those of the given key
+	prefix := config.Options.Folder + "/"
+	key := ""
+	if len(c.Args()) == 2 {
+		key = c.Args().Get(1)
+		prefix = key
+	}
+	numAborted := 0
+	err = bucketStorage.walkIncompleteUploads(prefix, func(upload incompleteUpload) error {
+		if key != "" && upload.Key != listPrefix(key) {
+			return nil
+		}
+		if err := bucketStorage.abortUpload(upload.Key, upload.UploadId); err != nil {
+			return fmt.Errorf("Unable to abort upload %s of %s: %s", upload.UploadId, upload.Key, err)
+		}
+		gplog.Info("Aborted upload %s of %s holding %d bytes", upload.UploadId, upload.Key, upload.Bytes)
+		numAborted++
+		return nil
+	})
+	gplog.Info("Aborted %d incomplete uploads", numAborted)
+	return err
+}
@@ -0,0 +1,210 @@
+package s3plugin
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/greenplum-db/gp-common-go-libs/gplog"
+)
+
+/*
+ * S3 Object Lock keeps an object from being deleted or overwritten until its
+ * retention date has passed and its legal hold is released, so that a backup
+ * survives credentials that fall into the wrong hands. Objects are retained
+ * until object_lock_retention_days after the timestamp of their backup, so
+ * that all objects of a backup are released together however long the backup
+ * took. In GOVERNANCE mode users with the s3:BypassGovernanceRetention
+ * permission may still delete them, in COMPLIANCE mode nobody can.
+ *
+ * S3 requires a Content-MD5 header on uploads with a retention date, which
+ * the SDK adds to every PutObject and UploadPart request with a seekable body.
+ */
+
+const objectLockConfigurationNotFound = "ObjectLockConfigurationNotFoundError"
+
+// The most locked objects an error about a refused delete lists
+const maxReportedLockedObjects = 10
+
+func validateObjectLock(opt *PluginOptions) string {
+	var errTxt string
+	if opt.ObjectLockLegalHold == "" {
+		opt.ObjectLockLegalHold = "off"
+	}
+	if opt.ObjectLockLegalHold != "on" && opt.ObjectLockLegalHold != "off" {
+		errTxt += fmt.Sprintf("Invalid object_lock_legal_hold configuration. Valid choices are on or off.\n")
+	}
+	opt.ObjectLockMode = strings.ToUpper(opt.ObjectLockMode)
+	if opt.ObjectLockMode == "" {
+		if opt.ObjectLockRetentionDays != "" {
+			errTxt += fmt.Sprintf("object_lock_retention_days requires object_lock_mode\n")
+		}
+	} else {
+		if opt.ObjectLockMode != s3.ObjectLockModeGovernance && opt.ObjectLockMode != s3.ObjectLockModeCompliance {
+			errTxt += fmt.Sprintf("Invalid object_lock_mode %s. Valid choices are governance or compliance.\n",
+				opt.ObjectLockMode)
+		}
+		days, err := strconv.Atoi(opt.ObjectLockRetentionDays)
+		if err != nil || days < 1 {
+			errTxt += fmt.Sprintf("object_lock_mode requires object_lock_retention_days to be a positive number of days\n")
+		}
+		opt.ObjectLockRetentionDaysValue = days
+	}
+	if isObjectLockConfigured(opt) && opt.StorageBackend != S3Backend {
+		errTxt += fmt.Sprintf("object_lock_mode and object_lock_legal_hold require storage_backend s3\n")
+	}
+	return errTxt
+}
+
+func isObjectLockConfigured(opt *PluginOptions) bool {
+	return opt.ObjectLockMode != "" || opt.ObjectLockLegalHold == "on"
+}
+
+func isObjectLockConfigurationNotFound(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == objectLockConfigurationNotFound
+}
+
+// Objects without a backup timestamp in their key are retained from now
+func objectRetainUntil(opt *PluginOptions, key string, now time.Time) time.Time {
+	start := now
+	if timestamp := timestampOfKey(key); timestamp != "" {
+		start = backupTime(timestamp)
+	}
+	return start.AddDate(0, 0, opt.ObjectLockRetentionDaysValue)
+}
+
+// Returns the object lock mode, retain until date and legal hold to upload key with
+func objectLockParams(opt *PluginOptions, key string, now time.Time) (*string, *time.Time, *string) {
+	var mode, legalHold *string
+	var retainUntil *time.Time
+	if opt.ObjectLockMode != "" {
+		// The retention of an object of a backup older than
+		// object_lock_retention_days has already ended
+		if until := objectRetainUntil(opt, key, now); until.After(now) {
+			mode, retainUntil = aws.String(opt.ObjectLockMode), aws.Time(until)
+		}
+	}
+	if opt.ObjectLockLegalHold == "on" {
+		legalHold = aws.String(s3.ObjectLockLegalHoldStatusOn)
+	}
+	return mode, retainUntil, legalHold
+}
+
+func setUploadObjectLock(input *s3manager.UploadInput, opt *PluginOptions) {
+	input.ObjectLockMode, input.ObjectLockRetainUntilDate, input.ObjectLockLegalHoldStatus =
+		objectLockParams(opt, aws.StringValue(input.Key), time.Now())
+}
+
+func setCreateMultipartObjectLock(input *s3.CreateMultipartUploadInput, opt *PluginOptions) {
+	input.ObjectLockMode, input.ObjectLockRetainUntilDate, input.ObjectLockLegalHoldStatus =
+		objectLockParams(opt, aws.StringValue(input.Key), time.Now())
+}
+
+func (s *s3Storage) isObjectLockEnabled() (bool, error) {
+	output, err := s.client.GetObjectLockConfiguration(&s3.GetObjectLockConfigurationInput{
+		Bucket: aws.String(s.bucket),
+	})
+	if isObjectLockConfigurationNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return output.ObjectLockConfiguration != nil &&
+		aws.StringValue(output.ObjectLockConfiguration.ObjectLockEnabled) == s3.ObjectLockEnabledEnabled, nil
+}
+
+// Uploads with object lock options fail unless the bucket has object lock enabled
+func checkObjectLockEnabled(config *PluginConfig, storage Storage) error {
+	if !isObjectLockConfigured(&config.Options) {
+		return nil
+	}
+	if _, err := requireS3Storage(storage, "object lock"); err != nil {
+		return err
+	}
+	// Both the primary and the replica bucket must have it
+	for _, bucketStorage := range bucketStorages(storage) {
+		enabled, err := bucketStorage.isObjectLockEnabled()
+		if err != nil {
+			return fmt.Errorf("Unable to read the object lock configuration of bucket %s: %s", bucketStorage.bucket, err)
+		}
+		if !enabled {
+			return fmt.Errorf("Bucket %s does not have object lock enabled, which object_lock_mode and "+
+				"object_lock_legal_hold require", bucketStorage.bucket)
+		}
+	}
+	return nil
+}
+
+// Describes what keeps the object under key from being deleted, if anything
+func (s *s3Storage) objectLock(key string, now time.Time) (string, error) {
+	input := &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	}
+	setHeadEncryption(input, s.options)
+	output, err := s.client.HeadObject(input)
+	if err != nil {
+		return "", err
+	}
+	locks := make([]string, 0)
+	if until := aws.TimeValue(output.ObjectLockRetainUntilDate); until.After(now) {
+		locks = append(locks, fmt.Sprintf("%s retention until %s",
+			aws.StringValue(output.ObjectLockMode), formatCatalogTime(until)))
+	}
+	if aws.StringValue(output.ObjectLockLegalHoldStatus) == s3.ObjectLockLegalHoldStatusOn {
+		locks = append(locks, "legal hold")
+	}
+	return strings.Join(locks, " and "), nil
+}
+
+/*
+ * Deleting a locked object from a bucket with object lock only hides it
+ * behind a delete marker, which would leave a backup that looks deleted but
+ * is still stored and billed, or one with only some of its objects hidden.
+ * A prefix is therefore only deleted if none of its objects is locked.
+ */
+func (s *s3Storage) checkUnlocked(prefix string) error {
+	enabled, err := s.isObjectLockEnabled()
+	if err != nil {
+		// S3 compatible stores without object lock may not implement it at all
+		gplog.Verbose("Unable to read the object lock configuration of bucket %s, "+
+			"deleting without checking for locked objects: %s", s.bucket, err)
+		return nil
+	}
+	if !enabled {
+		return nil
+	}
+	now := time.Now()
+	numObjects := 0
+	locked := make([]string, 0)
+	err = s.Walk(prefix, func(object ObjectInfo) error {
+		numObjects++
+		lock, err := s.objectLock(object.Key, now)
+		if err != nil {
+			return fmt.Errorf("Unable to read the object lock of %s: %s", object.Key, err)
+		}
+		if lock != "" {
+			locked = append(locked, fmt.Sprintf("%s (%s)", object.Key, lock))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(locked) == 0 {
+		return nil
+	}
+	numLocked := len(locked)
+	if numLocked > maxReportedLockedObjects {
+		locked = append(locked[:maxReportedLockedObjects], fmt.Sprintf("and %d more", numLocked-maxReportedLockedObjects))
+	}
+	return fmt.Errorf("Refusing to delete %s because %d of its %d objects are locked by object lock: %s",
+		s.URL(prefix), numLocked, numObjects, strings.Join(locked, ", "))
+}
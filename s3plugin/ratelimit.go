@@ -0,0 +1,94 @@
+package s3plugin
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/inhies/go-bytesize"
+)
+
+// Largest amount of data passed on at once, so that throttled transfers
+// proceed smoothly instead of in bursts of whole parts
+const rateLimitReadSize = 64 * 1024
+
+// Parses a bandwidth such as 200MB/s into bytes per second
+func parseBandwidth(value string) (int64, error) {
+	size, err := bytesize.Parse(strings.TrimSuffix(strings.TrimSpace(value), "/s"))
+	if err != nil {
+		return 0, err
+	}
+	if size == 0 {
+		return 0, fmt.Errorf("%s is not a positive bandwidth", value)
+	}
+	return int64(size), nil
+}
+
+/*
+ * A token bucket of bytes shared by the goroutines of a process. The rate is
+ * looked up on every use, so it follows changes such as another process on
+ * the host starting. A rate of 0 or less means no limit. At most a second's
+ * worth of bytes is saved up for a burst.
+ */
+type rateLimiter struct {
+	mutex     sync.Mutex
+	rate      func() float64
+	available float64
+	last      time.Time
+}
+
+func newRateLimiter(rate func() float64) *rateLimiter {
+	return &rateLimiter{rate: rate}
+}
+
+// Blocks until n more bytes may be transferred
+func (l *rateLimiter) wait(n int) {
+	if l == nil {
+		return
+	}
+	rate := l.rate()
+	if rate <= 0 {
+		return
+	}
+	l.mutex.Lock()
+	now := time.Now()
+	if l.last.IsZero() {
+		l.available = rate
+	} else {
+		l.available += now.Sub(l.last).Seconds() * rate
+		if l.available > rate {
+			l.available = rate
+		}
+	}
+	l.last = now
+	l.available -= float64(n)
+	delay := time.Duration(0)
+	if l.available < 0 {
+		delay = time.Duration(-l.available / rate * float64(time.Second))
+	}
+	l.mutex.Unlock()
+	time.Sleep(delay)
+}
+
+type rateLimitedReader struct {
+	reader  io.Reader
+	limiter *rateLimiter
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	if len(p) > rateLimitReadSize {
+		p = p[:rateLimitReadSize]
+	}
+	n, err := r.reader.Read(p)
+	r.limiter.wait(n)
+	return n, err
+}
+
+func (l *rateLimiter) limitReader(reader io.Reader) io.Reader {
+	if l == nil {
+		return reader
+	}
+	return &rateLimitedReader{reader: reader, limiter: l}
+}
@@ -0,0 +1,365 @@
+package s3plugin
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/greenplum-db/gp-common-go-libs/gplog"
+)
+
+/*
+ * A replica keeps a second copy of every backup in another bucket, usually in
+ * another region or on an S3 compatible store on premises. Every upload is
+ * streamed to the primary location and the replica at the same time and only
+ * succeeds once both have stored it. Reads fall back to the replica when the
+ * primary fails to provide an object, whether it is missing or unreachable.
+ *
+ * The replica has its own endpoint, region, bucket, folder and credentials.
+ * Everything else, such as the chunk sizes, storage classes, tags, object
+ * lock and encryption, is shared with the primary, so both hold the same
+ * bytes. Without credentials of its own the replica uses those of the
+ * primary.
+ */
+
+type ReplicaOptions struct {
+	Endpoint                 string `yaml:"endpoint"`
+	Region                   string `yaml:"region"`
+	Bucket                   string `yaml:"bucket"`
+	Folder                   string `yaml:"folder"`
+	Encryption               string `yaml:"encryption"`
+	HttpProxy                string `yaml:"http_proxy"`
+	AwsAccessKeyId           string `yaml:"aws_access_key_id"`
+	AwsSecretAccessKey       string `yaml:"aws_secret_access_key"`
+	AwsProfile               string `yaml:"aws_profile"`
+	AwsSharedCredentialsFile string `yaml:"aws_shared_credentials_file"`
+	AwsCredentialProcess     string `yaml:"aws_credential_process"`
+	AwsWebIdentityTokenFile  string `yaml:"aws_web_identity_token_file"`
+	AwsInstanceMetadata      string `yaml:"aws_instance_metadata"`
+	AwsRoleArn               string `yaml:"aws_role_arn"`
+	AwsRoleExternalId        string `yaml:"aws_role_external_id"`
+	AwsRoleSessionName       string `yaml:"aws_role_session_name"`
+	AwsRoleDuration          string `yaml:"aws_role_duration"`
+}
+
+func (replica *ReplicaOptions) hasCredentials() bool {
+	return replica.AwsAccessKeyId != "" || replica.AwsSecretAccessKey != "" || replica.AwsProfile != "" ||
+		replica.AwsSharedCredentialsFile != "" || replica.AwsCredentialProcess != "" ||
+		replica.AwsWebIdentityTokenFile != "" || replica.AwsInstanceMetadata != "" || replica.AwsRoleArn != "" ||
+		replica.AwsRoleExternalId != "" || replica.AwsRoleSessionName != "" || replica.AwsRoleDuration != ""
+}
+
+/*
+ * Returns the configuration the session of the replica is started with: that
+ * of the primary with the location and, if it has any, the credentials of the
+ * replica.
+ */
+func newReplicaConfig(config *PluginConfig) *PluginConfig {
+	replica := config.Options.Replica
+	opt := config.Options
+	opt.Replica, opt.ReplicaConfig = nil, nil
+	opt.Endpoint, opt.Region, opt.Bucket, opt.Folder = replica.Endpoint, replica.Region, replica.Bucket, replica.Folder
+	opt.Encryption, opt.HttpProxy = replica.Encryption, replica.HttpProxy
+	if opt.Region == "" {
+		opt.Region = "unused"
+	}
+	if opt.Folder == "" {
+		opt.Folder = config.Options.Folder
+	}
+	if opt.Encryption == "" {
+		opt.Encryption = "on"
+	}
+	if replica.hasCredentials() {
+		opt.AwsAccessKeyId, opt.AwsSecretAccessKey = replica.AwsAccessKeyId, replica.AwsSecretAccessKey
+		opt.AwsProfile, opt.AwsSharedCredentialsFile = replica.AwsProfile, replica.AwsSharedCredentialsFile
+		opt.AwsCredentialProcess, opt.AwsWebIdentityTokenFile = replica.AwsCredentialProcess, replica.AwsWebIdentityTokenFile
+		opt.AwsInstanceMetadata, opt.AwsRoleArn = replica.AwsInstanceMetadata, replica.AwsRoleArn
+		opt.AwsRoleExternalId, opt.AwsRoleSessionName = replica.AwsRoleExternalId, replica.AwsRoleSessionName
+		opt.AwsRoleDuration = replica.AwsRoleDuration
+	}
+	return &PluginConfig{ExecutablePath: config.ExecutablePath, Options: opt}
+}
+
+func validateReplica(config *PluginConfig) string {
+	var errTxt string
+	config.Options.ReplicaConfig = nil
+	if config.Options.Replica == nil {
+		return ""
+	}
+	replicaConfig := newReplicaConfig(config)
+	opt := &replicaConfig.Options
+	if opt.Bucket == "" {
+		errTxt += fmt.Sprintf("bucket must exist and cannot be empty in replica\n")
+	}
+	if opt.Region == "unused" && opt.Endpoint == "" {
+		errTxt += fmt.Sprintf("region or endpoint must exist in replica\n")
+	}
+	if opt.Encryption != "on" && opt.Encryption != "off" {
+		errTxt += fmt.Sprintf("Invalid encryption configuration in replica. Valid choices are on or off.\n")
+	}
+	if opt.AwsAccessKeyId == "" {
+		if opt.AwsSecretAccessKey != "" {
+			errTxt += fmt.Sprintf("aws_access_key_id must exist in replica if aws_secret_access_key does\n")
+		}
+	} else if opt.AwsSecretAccessKey == "" {
+		errTxt += fmt.Sprintf("aws_secret_access_key must exist in replica if aws_access_key_id does\n")
+	}
+	for _, line := range strings.SplitAfter(validateCredentials(opt), "\n") {
+		if line != "" {
+			errTxt += "replica: " + line
+		}
+	}
+	if config.Options.StorageBackend == S3Backend && opt.Endpoint == config.Options.Endpoint &&
+		opt.Region == config.Options.Region && opt.Bucket == config.Options.Bucket &&
+		opt.Folder == config.Options.Folder {
+		errTxt += fmt.Sprintf("replica must not be the same location as the primary\n")
+	}
+	if errTxt == "" {
+		config.Options.ReplicaConfig = replicaConfig
+	}
+	return errTxt
+}
+
+func newReplicaStorage(config *PluginConfig) (*s3Storage, error) {
+	sess, err := startSession(config.Options.ReplicaConfig)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to connect to the replica: %s", err)
+	}
+	// The options are shared with the primary, as the chunk sizes and
+	// concurrency are lowered in them to fit into host_memory_budget
+	return &s3Storage{
+		client:  s3.New(sess),
+		bucket:  config.Options.ReplicaConfig.Options.Bucket,
+		options: &config.Options,
+	}, nil
+}
+
+/*
+ * replicatedStorage stores every object in both the primary storage and the
+ * replica. It does not resume uploads of local files, because the parts
+ * uploaded by an earlier attempt may only exist in one of them.
+ */
+type replicatedStorage struct {
+	primary       Storage
+	replica       *s3Storage
+	folder        string
+	replicaFolder string
+	// The keys that are read from the replica, because the primary failed
+	// to provide them
+	fromReplica sync.Map
+}
+
+func newReplicatedStorage(config *PluginConfig, primary Storage) (*replicatedStorage, error) {
+	replica, err := newReplicaStorage(config)
+	if err != nil {
+		return nil, err
+	}
+	return &replicatedStorage{
+		primary:       primary,
+		replica:       replica,
+		folder:        config.Options.Folder,
+		replicaFolder: config.Options.ReplicaConfig.Options.Folder,
+	}, nil
+}
+
+// Keys below the folder of the primary are stored below that of the replica
+func (s *replicatedStorage) replicaKey(key string) string {
+	if key == s.folder || strings.HasPrefix(key, s.folder+"/") {
+		return s.replicaFolder + strings.TrimPrefix(key, s.folder)
+	}
+	return key
+}
+
+func (s *replicatedStorage) primaryKey(replicaKey string) string {
+	if replicaKey == s.replicaFolder || strings.HasPrefix(replicaKey, s.replicaFolder+"/") {
+		return s.folder + strings.TrimPrefix(replicaKey, s.replicaFolder)
+	}
+	return replicaKey
+}
+
+func (s *replicatedStorage) URL(key string) string {
+	return s.primary.URL(key)
+}
+
+/*
+ * Streams body to the primary and the replica at the same time. If either
+ * upload fails the other one is failed as well, so that no backup silently
+ * ends up with a single copy.
+ */
+func (s *replicatedStorage) Put(key string, body io.Reader, metadata map[string]string) error {
+	primaryReader, primaryWriter := io.Pipe()
+	replicaReader, replicaWriter := io.Pipe()
+	var primaryErr, replicaErr error
+	// The first failure fails everything else, so it is the one to report
+	var firstFailure sync.Once
+	replicaFailedFirst := false
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		primaryErr = s.primary.Put(key, primaryReader, metadata)
+		if primaryErr != nil {
+			firstFailure.Do(func() {})
+		}
+		// Fails the copy below if the upload stopped reading early
+		primaryReader.CloseWithError(uploadStopped(primaryErr))
+	}()
+	go func() {
+		defer wg.Done()
+		replicaErr = s.replica.Put(s.replicaKey(key), replicaReader, metadata)
+		if replicaErr != nil {
+			firstFailure.Do(func() { replicaFailedFirst = true })
+		}
+		replicaReader.CloseWithError(uploadStopped(replicaErr))
+	}()
+	_, copyErr := io.Copy(io.MultiWriter(primaryWriter, replicaWriter), body)
+	if copyErr != nil {
+		firstFailure.Do(func() {})
+	}
+	primaryWriter.CloseWithError(copyErr)
+	replicaWriter.CloseWithError(copyErr)
+	wg.Wait()
+
+	if primaryErr != nil && !replicaFailedFirst {
+		return primaryErr
+	}
+	if replicaErr != nil {
+		return fmt.Errorf("Unable to upload %s to the replica: %s", s.replica.URL(s.replicaKey(key)), replicaErr)
+	}
+	return nil
+}
+
+func uploadStopped(err error) error {
+	if err == nil {
+		return io.ErrClosedPipe
+	}
+	return err
+}
+
+func (s *replicatedStorage) readFromReplica(key string, primaryErr error) {
+	if _, loaded := s.fromReplica.LoadOrStore(key, true); !loaded {
+		gplog.Warn("Reading %s from the replica %s, because the primary failed to provide it: %s",
+			s.primary.URL(key), s.replica.URL(s.replicaKey(key)), primaryErr)
+	}
+}
+
+func (s *replicatedStorage) isFromReplica(key string) bool {
+	_, ok := s.fromReplica.Load(key)
+	return ok
+}
+
+func (s *replicatedStorage) Head(key string) (*ObjectInfo, error) {
+	if s.isFromReplica(key) {
+		return s.headReplica(key)
+	}
+	info, err := s.primary.Head(key)
+	if err == nil {
+		return info, nil
+	}
+	replicaInfo, replicaErr := s.headReplica(key)
+	if replicaErr != nil {
+		gplog.Verbose("Unable to read %s from the replica either: %s", key, replicaErr)
+		return nil, err
+	}
+	s.readFromReplica(key, err)
+	return replicaInfo, nil
+}
+
+func (s *replicatedStorage) headReplica(key string) (*ObjectInfo, error) {
+	info, err := s.replica.Head(s.replicaKey(key))
+	if err != nil {
+		return nil, err
+	}
+	info.Key = key
+	return info, nil
+}
+
+func (s *replicatedStorage) GetRange(key string, offset int64, buffer []byte) (int64, error) {
+	if s.isFromReplica(key) {
+		return s.replica.GetRange(s.replicaKey(key), offset, buffer)
+	}
+	n, err := s.primary.GetRange(key, offset, buffer)
+	if err == nil {
+		return n, nil
+	}
+	replicaN, replicaErr := s.replica.GetRange(s.replicaKey(key), offset, buffer)
+	if replicaErr != nil {
+		gplog.Verbose("Unable to read %s from the replica either: %s", key, replicaErr)
+		return n, err
+	}
+	s.readFromReplica(key, err)
+	return replicaN, nil
+}
+
+func (s *replicatedStorage) Walk(prefix string, fn func(object ObjectInfo) error) error {
+	return s.walk(prefix, fn, Storage.Walk)
+}
+
+func (s *replicatedStorage) WalkDirectory(prefix string, fn func(object ObjectInfo) error) error {
+	return s.walk(prefix, fn, Storage.WalkDirectory)
+}
+
+/*
+ * Lists the primary, or the replica if the primary fails before listing
+ * anything. A failure after part of the listing was reported is returned, as
+ * the objects would be reported twice otherwise.
+ */
+func (s *replicatedStorage) walk(prefix string, fn func(object ObjectInfo) error,
+	walk func(storage Storage, prefix string, fn func(object ObjectInfo) error) error) error {
+
+	reported := false
+	err := walk(s.primary, prefix, func(object ObjectInfo) error {
+		reported = true
+		return fn(object)
+	})
+	if err == nil || reported {
+		return err
+	}
+	gplog.Warn("Listing %s on the replica, because listing the primary failed: %s", s.primary.URL(prefix), err)
+	return walk(s.replica, s.replicaKey(prefix), func(object ObjectInfo) error {
+		object.Key = s.primaryKey(object.Key)
+		return fn(object)
+	})
+}
+
+/*
+ * Deletes prefix from the primary first, so that the replica keeps its copy
+ * if the primary refuses to delete it, for example because it is locked
+ */
+func (s *replicatedStorage) DeletePrefix(prefix string) error {
+	if err := s.primary.DeletePrefix(prefix); err != nil {
+		return err
+	}
+	if err := s.replica.DeletePrefix(s.replicaKey(prefix)); err != nil {
+		return fmt.Errorf("Unable to delete %s from the replica: %s", s.replica.URL(s.replicaKey(prefix)), err)
+	}
+	return nil
+}
+
+// The S3 storages behind storage, the primary first
+func bucketStorages(storage Storage) []*s3Storage {
+	storages := make([]*s3Storage, 0, 2)
+	if bucketStorage, ok := primaryS3Storage(storage); ok {
+		storages = append(storages, bucketStorage)
+	}
+	if replicated, ok := storage.(*replicatedStorage); ok {
+		storages = append(storages, replicated.replica)
+	}
+	return storages
+}
+
+// The primary S3 storage behind storage, if it has one
+func primaryS3Storage(storage Storage) (*s3Storage, bool) {
+	bucketStorage, ok := primaryStorage(storage).(*s3Storage)
+	return bucketStorage, ok
+}
+
+// The storage behind storage that holds the primary copy
+func primaryStorage(storage Storage) Storage {
+	if replicated, ok := storage.(*replicatedStorage); ok {
+		return replicated.primary
+	}
+	return storage
+}
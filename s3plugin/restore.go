@@ -2,6 +2,7 @@ package s3plugin
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -9,11 +10,8 @@ import (
 	"sync"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/greenplum-db/gp-common-go-libs/gplog"
+	"github.com/greenplum-db/gp-common-go-libs/operating"
 	"github.com/urfave/cli"
 )
 
@@ -22,24 +20,31 @@ func SetupPluginForRestore(c *cli.Context) error {
 	if scope != Master && scope != Coordinator && scope != SegmentHost {
 		return nil
 	}
-	_, err := readAndValidatePluginConfig(c.Args().Get(0))
-	return err
+	config, err := readAndValidatePluginConfig(c.Args().Get(0))
+	if err != nil {
+		return err
+	}
+	return prepareHostCoordination(config)
 }
 
 func RestoreFile(c *cli.Context) error {
-	config, sess, err := readConfigAndStartSession(c)
+	config, storage, err := readConfigAndOpenStorage(c)
+	if err != nil {
+		return err
+	}
+	release, err := beginTransfers(config, storage, RestoreTransfer, 1)
 	if err != nil {
 		return err
 	}
+	defer release()
 	fileName := c.Args().Get(1)
-	bucket := config.Options.Bucket
 	fileKey := GetS3Path(config.Options.Folder, fileName)
 	file, err := os.Create(fileName)
 	defer file.Close()
 	if err != nil {
 		return err
 	}
-	bytes, elapsed, err := downloadFile(sess, config, bucket, fileKey, file)
+	bytes, elapsed, err := downloadFile(storage, config, fileKey, file)
 	if err != nil {
 		fileErr := os.Remove(fileName)
 		if fileErr != nil {
@@ -47,6 +52,7 @@ func RestoreFile(c *cli.Context) error {
 		}
 		return err
 	}
+	recordTransfer(config, RestoreTransfer, fileKey, bytes, elapsed)
 
 	gplog.Info("Downloaded %d bytes for %s in %v", bytes,
 		filepath.Base(fileKey), elapsed.Round(time.Millisecond))
@@ -56,31 +62,36 @@ func RestoreFile(c *cli.Context) error {
 func RestoreDirectory(c *cli.Context) error {
 	start := time.Now()
 	totalBytes := int64(0)
-	config, sess, err := readConfigAndStartSession(c)
+	config, storage, err := readConfigAndOpenStorage(c)
 	if err != nil {
 		return err
 	}
+	release, err := beginTransfers(config, storage, RestoreTransfer, 1)
+	if err != nil {
+		return err
+	}
+	defer release()
 	dirName := c.Args().Get(1)
-	bucket := config.Options.Bucket
 	gplog.Verbose("Restore Directory '%s' from S3", dirName)
-	gplog.Verbose("S3 Location = s3://%s/%s", bucket, dirName)
+	gplog.Verbose("S3 Location = %s", storage.URL(dirName))
 	gplog.Info("dirKey = %s\n", dirName)
 
 	_ = os.MkdirAll(dirName, 0775)
-	client := s3.New(sess)
-	params := &s3.ListObjectsV2Input{Bucket: &bucket, Prefix: &dirName}
-	bucketObjectsList, _ := client.ListObjectsV2(params)
 
 	numFiles := 0
-	for _, key := range bucketObjectsList.Contents {
+	sidecars := &checksumSidecars{}
+	err = storage.Walk(dirName, func(object ObjectInfo) error {
 		var filename string
-		if strings.HasSuffix(*key.Key, "/") {
+		if strings.HasSuffix(object.Key, "/") {
 			// Got a directory
-			continue
+			return nil
+		}
+		if sidecars.isChecksumFile(object.Key) {
+			return nil
 		}
-		if strings.Contains(*key.Key, "/") {
+		if strings.Contains(object.Key, "/") {
 			// split
-			s3FileFullPathList := strings.Split(*key.Key, "/")
+			s3FileFullPathList := strings.Split(object.Key, "/")
 			filename = s3FileFullPathList[len(s3FileFullPathList)-1]
 		}
 		filePath := dirName + "/" + filename
@@ -89,7 +100,7 @@ func RestoreDirectory(c *cli.Context) error {
 			return err
 		}
 
-		bytes, elapsed, err := downloadFile(sess, config, bucket, *key.Key, file)
+		bytes, elapsed, err := downloadFile(storage, config, object.Key, file)
 		_ = file.Close()
 		if err != nil {
 			fileErr := os.Remove(filename)
@@ -101,8 +112,13 @@ func RestoreDirectory(c *cli.Context) error {
 
 		totalBytes += bytes
 		numFiles++
+		recordTransfer(config, RestoreTransfer, object.Key, bytes, elapsed)
 		gplog.Info("Downloaded %d bytes for %s in %v", bytes,
-			filepath.Base(*key.Key), elapsed.Round(time.Millisecond))
+			filepath.Base(object.Key), elapsed.Round(time.Millisecond))
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
 	gplog.Info("Downloaded %d files (%d bytes) in %v\n",
@@ -114,7 +130,7 @@ func RestoreDirectoryParallel(c *cli.Context) error {
 	start := time.Now()
 	totalBytes := int64(0)
 	parallel := 5
-	config, sess, err := readConfigAndStartSession(c)
+	config, storage, err := readConfigAndOpenStorage(c)
 	if err != nil {
 		return err
 	}
@@ -122,90 +138,124 @@ func RestoreDirectoryParallel(c *cli.Context) error {
 	if len(c.Args()) == 3 {
 		parallel, _ = strconv.Atoi(c.Args().Get(2))
 	}
-	bucket := config.Options.Bucket
+	release, err := beginTransfers(config, storage, RestoreTransfer, parallel)
+	if err != nil {
+		return err
+	}
+	defer release()
 	gplog.Verbose("Restore Directory Parallel '%s' from S3", dirName)
-	gplog.Verbose("S3 Location = s3://%s/%s", bucket, dirName)
+	gplog.Verbose("S3 Location = %s", storage.URL(dirName))
 	fmt.Printf("dirKey = %s\n", dirName)
 
 	_ = os.MkdirAll(dirName, 0775)
-	client := s3.New(sess)
-	params := &s3.ListObjectsV2Input{Bucket: &bucket, Prefix: &dirName}
-	bucketObjectsList, _ := client.ListObjectsV2(params)
 
-	// Create a list of files to be restored
+	// Guards totalBytes and numFiles, which every worker updates
+	var mutex sync.Mutex
 	numFiles := 0
-	fileList := make([]string, 0)
-	for _, key := range bucketObjectsList.Contents {
-		gplog.Verbose("File '%s' = %d bytes", filepath.Base(*key.Key), *key.Size)
-		if strings.HasSuffix(*key.Key, "/") {
-			// Got a directory
-			continue
+	finalErr := downloadInParallel(parallel, func(queue func(fileKey string)) error {
+		sidecars := &checksumSidecars{}
+		return storage.Walk(dirName, func(object ObjectInfo) error {
+			gplog.Verbose("File '%s' = %d bytes", filepath.Base(object.Key), object.Size)
+			if strings.HasSuffix(object.Key, "/") {
+				// Got a directory
+				return nil
+			}
+			if sidecars.isChecksumFile(object.Key) {
+				return nil
+			}
+			queue(object.Key)
+			return nil
+		})
+	}, func(fileKey string) error {
+		fileName := fileKey
+		if strings.Contains(fileKey, "/") {
+			fileName = filepath.Base(fileKey)
 		}
-		fileList = append(fileList, *key.Key)
-	}
+		// construct local file name
+		filePath := dirName + "/" + fileName
+		file, err := os.Create(filePath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		bytes, elapsed, err := downloadFile(storage, config, fileKey, file)
+		if err != nil {
+			gplog.FatalOnError(err)
+			_ = os.Remove(filePath)
+			return err
+		}
+		mutex.Lock()
+		totalBytes += bytes
+		numFiles++
+		mutex.Unlock()
+		recordTransfer(config, RestoreTransfer, fileKey, bytes, elapsed)
+		msg := fmt.Sprintf("Downloaded %d bytes for %s in %v", bytes,
+			filepath.Base(fileKey), elapsed.Round(time.Millisecond))
+		gplog.Verbose(msg)
+		fmt.Println(msg)
+		return nil
+	})
 
-	var wg sync.WaitGroup
+	fmt.Printf("Downloaded %d files (%d bytes) in %v\n",
+		numFiles, totalBytes, time.Since(start).Round(time.Millisecond))
+	return finalErr
+}
+
+/*
+ * Calls download for every key that walk queues, with parallel workers.
+ * Keys are handed to the workers while walk is still listing them, so the
+ * keys of a large directory are never all held in memory. It returns the
+ * error of walk, or else the first error of download.
+ */
+func downloadInParallel(parallel int, walk func(queue func(fileKey string)) error,
+	download func(fileKey string) error) error {
+
+	var mutex sync.Mutex
 	var finalErr error
-	// Create jobs using a channel
-	fileChannel := make(chan string, len(fileList))
-	for _, fileKey := range fileList {
-		wg.Add(1)
-		fileChannel <- fileKey
-	}
-	close(fileChannel)
-	// Process the files in parallel
+	var wg sync.WaitGroup
+	jobs := make(chan string, parallel)
 	for i := 0; i < parallel; i++ {
-		go func(jobs chan string) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
 			for fileKey := range jobs {
-				fileName := fileKey
-				if strings.Contains(fileKey, "/") {
-					fileName = filepath.Base(fileKey)
-				}
-				// construct local file name
-				filePath := dirName + "/" + fileName
-				file, err := os.Create(filePath)
-				if err != nil {
+				err := download(fileKey)
+				mutex.Lock()
+				if err != nil && finalErr == nil {
 					finalErr = err
-					return
 				}
-				bytes, elapsed, err := downloadFile(sess, config, bucket, fileKey, file)
-				if err == nil {
-					totalBytes += bytes
-					numFiles++
-					msg := fmt.Sprintf("Downloaded %d bytes for %s in %v", bytes,
-						filepath.Base(fileKey), elapsed.Round(time.Millisecond))
-					gplog.Verbose(msg)
-					fmt.Println(msg)
-				} else {
-					finalErr = err
-					gplog.FatalOnError(err)
-					_ = os.Remove(filePath)
-				}
-				_ = file.Close()
-				wg.Done()
+				mutex.Unlock()
 			}
-		}(fileChannel)
+		}()
 	}
-	// Wait for jobs to be done
+	err := walk(func(fileKey string) {
+		jobs <- fileKey
+	})
+	close(jobs)
 	wg.Wait()
-
-	fmt.Printf("Downloaded %d files (%d bytes) in %v\n",
-		numFiles, totalBytes, time.Since(start).Round(time.Millisecond))
+	if err != nil {
+		return err
+	}
 	return finalErr
 }
 
 func RestoreData(c *cli.Context) error {
-	config, sess, err := readConfigAndStartSession(c)
+	config, storage, err := readConfigAndOpenStorage(c)
 	if err != nil {
 		return err
 	}
+	release, err := beginTransfers(config, storage, RestoreTransfer, 1)
+	if err != nil {
+		return err
+	}
+	defer release()
 	dataFile := c.Args().Get(1)
-	bucket := config.Options.Bucket
 	fileKey := GetS3Path(config.Options.Folder, dataFile)
-	bytes, elapsed, err := downloadFile(sess, config, bucket, fileKey, os.Stdout)
+	bytes, elapsed, err := downloadFile(storage, config, fileKey, operating.System.Stdout)
 	if err != nil {
 		return err
 	}
+	recordTransfer(config, RestoreTransfer, fileKey, bytes, elapsed)
 
 	gplog.Verbose("Downloaded %d bytes for file %s in %v", bytes,
 		filepath.Base(fileKey), elapsed.Round(time.Millisecond))
@@ -218,45 +268,126 @@ type chunk struct {
 	endByte    int64
 }
 
-func downloadFile(sess *session.Session, config *PluginConfig, bucket string, fileKey string,
-	file *os.File) (int64, time.Duration, error) {
+func downloadFile(storage Storage, config *PluginConfig, fileKey string,
+	file io.Writer) (int64, time.Duration, error) {
 
 	start := time.Now()
-	downloader := s3manager.NewDownloader(sess, func(u *s3manager.Downloader) {
-		u.PartSize = config.Options.DownloadChunkSize
-	})
+	head, err := storage.Head(fileKey)
+	if err != nil {
+		return 0, -1, err
+	}
+	bytes, _, err := downloadObject(storage, config, head, file)
+	if err != nil {
+		return 0, -1, err
+	}
+	return bytes, time.Since(start), nil
+}
 
-	totalBytes, err := getFileSize(downloader.S3, bucket, fileKey)
+// Downloads the object that head describes, for callers that already have it
+func downloadObject(storage Storage, config *PluginConfig, head *ObjectInfo,
+	file io.Writer) (int64, time.Duration, error) {
+
+	start := time.Now()
+	fileKey := head.Key
+	err := checkThawed(head)
 	if err != nil {
 		return 0, -1, err
 	}
+	totalBytes := head.Size
 	gplog.Verbose("File %s size = %d bytes", filepath.Base(fileKey), totalBytes)
+
+	expectedChecksum := ""
+	if hasChecksum(head.Metadata) {
+		expectedChecksum, err = downloadChecksum(storage, config, fileKey)
+		if err != nil {
+			return 0, -1, err
+		}
+	}
+	writer, err := newRestoreWriter(config, fileKey, head.Metadata, expectedChecksum, file)
+	if err != nil {
+		return 0, -1, err
+	}
 	if totalBytes <= config.Options.DownloadChunkSize {
-		buffer := &aws.WriteAtBuffer{}
-		if _, err = downloader.Download(
-			buffer,
-			&s3.GetObjectInput{
-				Bucket: aws.String(bucket),
-				Key:    aws.String(fileKey),
-			}); err != nil {
+		buffer := make([]byte, totalBytes)
+		if _, err = storage.GetRange(fileKey, 0, buffer); err != nil {
 			return 0, -1, err
 		}
-		if _, err = file.Write(buffer.Bytes()); err != nil {
+		if _, err = writer.Write(buffer); err != nil {
 			return 0, -1, err
 		}
 	} else {
-		return downloadFileInParallel(sess, config.Options.DownloadConcurrency, config.Options.DownloadChunkSize, totalBytes, bucket, fileKey, file)
+		if _, _, err = downloadFileInParallel(storage, config, totalBytes, fileKey, writer); err != nil {
+			return 0, -1, err
+		}
+	}
+	if err = writer.Close(); err != nil {
+		return 0, -1, err
 	}
 	return totalBytes, time.Since(start), err
 }
 
+/*
+ * Wraps the destination of a download with whatever is needed to undo the
+ * transformations recorded in the object's metadata during backup and to
+ * verify the result
+ */
+func newRestoreWriter(config *PluginConfig, fileKey string, metadata map[string]string,
+	expectedChecksum string, file io.Writer) (io.WriteCloser, error) {
+
+	writer := &restoreWriter{Writer: file}
+	if expectedChecksum != "" {
+		writer.push(newChecksumWriter(writer.Writer, fileKey, expectedChecksum))
+	}
+	if isCompressed(metadata) {
+		decompressor, err := newDecompressingWriter(fileKey, metadata, writer.Writer)
+		if err != nil {
+			return nil, err
+		}
+		writer.push(decompressor)
+	}
+	if isClientSideEncrypted(metadata) {
+		decrypter, err := newDecryptingWriter(config.Options.ClientSideEncryptionKey, fileKey, metadata, writer.Writer)
+		if err != nil {
+			return nil, err
+		}
+		writer.push(decrypter)
+	}
+	return writer, nil
+}
+
+/*
+ * A stack of writers each feeding the next one. Closing it closes the layers
+ * from the outermost inwards, so every layer can flush into the one below it
+ * before that one is finalized.
+ */
+type restoreWriter struct {
+	io.Writer
+	layers []io.WriteCloser
+}
+
+func (w *restoreWriter) push(layer io.WriteCloser) {
+	w.Writer = layer
+	w.layers = append(w.layers, layer)
+}
+
+func (w *restoreWriter) Close() error {
+	for i := len(w.layers) - 1; i >= 0; i-- {
+		if err := w.layers[i].Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 /*
  * Performs ranged requests for the file while exploiting parallelism between the copy and download tasks
  */
-func downloadFileInParallel(sess *session.Session, downloadConcurrency int, downloadChunkSize int64,
-	totalBytes int64, bucket string, fileKey string, file *os.File) (int64, time.Duration, error) {
+func downloadFileInParallel(storage Storage, config *PluginConfig, totalBytes int64,
+	fileKey string, file io.Writer) (int64, time.Duration, error) {
 
 	var finalErr error
+	downloadConcurrency := config.Options.DownloadConcurrency
+	downloadChunkSize := config.Options.DownloadChunkSize
 	start := time.Now()
 	waitGroup := sync.WaitGroup{}
 	numberOfChunks := int((totalBytes + downloadChunkSize - 1) / downloadChunkSize)
@@ -292,11 +423,6 @@ func downloadFileInParallel(sess *session.Session, downloadConcurrency int, down
 		buffer := make([]byte, downloadChunkSize)
 		downloadBuffers <- buffer
 	}
-	// Download concurrency is handled on our end hence we don't need to set concurrency
-	downloader := s3manager.NewDownloader(sess, func(u *s3manager.Downloader) {
-		u.PartSize = downloadChunkSize
-		u.Concurrency = 1
-	})
 	gplog.Debug("Downloading file %s with chunksize %d and concurrency %d",
 		filepath.Base(fileKey), downloadChunkSize, numberOfWorkers)
 
@@ -305,21 +431,13 @@ func downloadFileInParallel(sess *session.Session, downloadConcurrency int, down
 			for j := range jobs {
 				buffer := <-downloadBuffers
 				chunkStart := time.Now()
-				byteRange := fmt.Sprintf("bytes=%d-%d", j.startByte, j.endByte)
-				if j.endByte-j.startByte+1 != downloadChunkSize {
+				if int64(len(buffer)) != j.endByte-j.startByte+1 {
 					buffer = make([]byte, j.endByte-j.startByte+1)
 				}
 				bufferPointers[j.chunkIndex] = &buffer
-				gplog.Debug("Worker %d (chunk %d) for %s with partsize %d and concurrency %d",
-					id, j.chunkIndex, filepath.Base(fileKey),
-					downloader.PartSize, downloader.Concurrency)
-				chunkBytes, err := downloader.Download(
-					aws.NewWriteAtBuffer(buffer),
-					&s3.GetObjectInput{
-						Bucket: aws.String(bucket),
-						Key:    aws.String(fileKey),
-						Range:  aws.String(byteRange),
-					})
+				gplog.Debug("Worker %d (chunk %d) for %s with partsize %d",
+					id, j.chunkIndex, filepath.Base(fileKey), len(buffer))
+				chunkBytes, err := storage.GetRange(fileKey, j.startByte, buffer)
 				if err != nil {
 					finalErr = err
 				}
@@ -0,0 +1,288 @@
+package s3plugin
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/greenplum-db/gp-common-go-libs/gplog"
+	"github.com/greenplum-db/gp-common-go-libs/operating"
+	"github.com/urfave/cli"
+	"gopkg.in/yaml.v2"
+)
+
+/*
+ * Retention rules are combined: a backup is kept if any rule keeps it.
+ *
+ * Only complete backups, those with both a report and a table of contents
+ * that cleanup_plugin_for_backup did not mark as failed, count towards the
+ * keep last and the daily, weekly and monthly rules. Backups newer than the
+ * newest complete backup may still be running and are never pruned, and
+ * neither is the newest complete backup itself. An incremental backup can
+ * only be restored along with the backups it is based on, so those are kept
+ * whenever it is.
+ */
+type RetentionPolicy struct {
+	KeepLast    int
+	KeepDays    int
+	KeepDaily   int
+	KeepWeekly  int
+	KeepMonthly int
+}
+
+func (policy RetentionPolicy) isEmpty() bool {
+	return policy == RetentionPolicy{}
+}
+
+func parseRetentionOption(name string, value string, result *int) string {
+	if value == "" {
+		return ""
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil || number < 0 {
+		return fmt.Sprintf("Invalid %s. It must be a non-negative integer, but is %s\n", name, value)
+	}
+	*result = number
+	return ""
+}
+
+func validateRetention(opt *PluginOptions) string {
+	var errTxt string
+	errTxt += parseRetentionOption("retention_keep_last", opt.RetentionKeepLast, &opt.Retention.KeepLast)
+	errTxt += parseRetentionOption("retention_keep_days", opt.RetentionKeepDays, &opt.Retention.KeepDays)
+	errTxt += parseRetentionOption("retention_keep_daily", opt.RetentionKeepDaily, &opt.Retention.KeepDaily)
+	errTxt += parseRetentionOption("retention_keep_weekly", opt.RetentionKeepWeekly, &opt.Retention.KeepWeekly)
+	errTxt += parseRetentionOption("retention_keep_monthly", opt.RetentionKeepMonthly, &opt.Retention.KeepMonthly)
+	return errTxt
+}
+
+type retentionDecision struct {
+	Timestamp string   `json:"timestamp"`
+	Keep      bool     `json:"keep"`
+	Reasons   []string `json:"reasons"`
+	Bytes     int64    `json:"bytes"`
+}
+
+var retentionDecisionTableColumns = []string{"TIMESTAMP", "ACTION", "SIZE(bytes)", "REASON"}
+var retentionDecisionCSVColumns = []string{"timestamp", "action", "bytes", "reasons"}
+
+func (decision retentionDecision) action() string {
+	if decision.Keep {
+		return "keep"
+	}
+	return "delete"
+}
+
+func (decision retentionDecision) tableRow() []string {
+	return []string{decision.Timestamp, decision.action(), fmt.Sprint(decision.Bytes), strings.Join(decision.Reasons, ", ")}
+}
+
+func (decision retentionDecision) csvRow() []string {
+	return []string{decision.Timestamp, decision.action(), fmt.Sprint(decision.Bytes), strings.Join(decision.Reasons, ";")}
+}
+
+func backupTime(timestamp string) time.Time {
+	// gpbackup timestamps are in the local time of the coordinator
+	t, _ := time.ParseInLocation("20060102150405", timestamp, time.Local)
+	return t
+}
+
+/*
+ * gpbackup lists every backup an incremental backup is restored from,
+ * including the backup itself, in the restore plan of its configuration
+ */
+type backupRestorePlan struct {
+	RestorePlan []struct {
+		Timestamp string `yaml:"timestamp"`
+	} `yaml:"restoreplan"`
+}
+
+func readBackupDependencies(storage Storage, config *PluginConfig, backup backupInfo) ([]string, error) {
+	if !backup.HasConfig {
+		return nil, nil
+	}
+	buffer := &bytes.Buffer{}
+	configKey := backup.Prefix + backupConfigName(backup.Timestamp)
+	if _, _, err := downloadFile(storage, config, configKey, buffer); err != nil {
+		return nil, fmt.Errorf("Unable to read the configuration of backup %s: %s", backup.Timestamp, err)
+	}
+	plan := backupRestorePlan{}
+	if err := yaml.Unmarshal(buffer.Bytes(), &plan); err != nil {
+		return nil, fmt.Errorf("Unable to parse the configuration of backup %s: %s", backup.Timestamp, err)
+	}
+	dependencies := make([]string, 0)
+	for _, entry := range plan.RestorePlan {
+		if entry.Timestamp != backup.Timestamp {
+			dependencies = append(dependencies, entry.Timestamp)
+		}
+	}
+	return dependencies, nil
+}
+
+func isCompleteBackup(backup backupInfo) bool {
+	return backup.HasReport && backup.HasToc && !backup.Failed
+}
+
+/*
+ * Decides which of backups to keep under policy at time now. The decisions
+ * are returned newest backup first.
+ */
+func evaluateRetention(backups []backupInfo, policy RetentionPolicy, now time.Time) []retentionDecision {
+	sorted := make([]backupInfo, len(backups))
+	copy(sorted, backups)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Timestamp > sorted[j].Timestamp })
+
+	decisions := make([]retentionDecision, len(sorted))
+	keep := func(i int, reason string) {
+		decisions[i].Keep = true
+		decisions[i].Reasons = append(decisions[i].Reasons, reason)
+	}
+	for i, backup := range sorted {
+		decisions[i] = retentionDecision{Timestamp: backup.Timestamp, Reasons: make([]string, 0), Bytes: backup.Bytes}
+	}
+
+	newestComplete := -1
+	for i, backup := range sorted {
+		if isCompleteBackup(backup) {
+			newestComplete = i
+			break
+		}
+	}
+	for i := range sorted {
+		if newestComplete == -1 || i < newestComplete {
+			keep(i, "newer than the newest complete backup")
+		} else if i == newestComplete {
+			keep(i, "newest complete backup")
+		}
+	}
+
+	if policy.KeepDays > 0 {
+		cutoff := now.AddDate(0, 0, -policy.KeepDays)
+		for i, backup := range sorted {
+			if !backupTime(backup.Timestamp).Before(cutoff) {
+				keep(i, fmt.Sprintf("within %d days", policy.KeepDays))
+			}
+		}
+	}
+
+	// The remaining rules keep the newest complete backup of each of the
+	// most recent periods
+	keepPerPeriod := func(count int, reason string, period func(t time.Time) string) {
+		seen := make(map[string]bool)
+		for i, backup := range sorted {
+			if len(seen) == count {
+				return
+			}
+			if !isCompleteBackup(backup) {
+				continue
+			}
+			key := period(backupTime(backup.Timestamp))
+			if !seen[key] {
+				seen[key] = true
+				keep(i, reason)
+			}
+		}
+	}
+	if policy.KeepLast > 0 {
+		keepPerPeriod(policy.KeepLast, fmt.Sprintf("last %d", policy.KeepLast), func(t time.Time) string {
+			return t.Format("20060102150405")
+		})
+	}
+	if policy.KeepDaily > 0 {
+		keepPerPeriod(policy.KeepDaily, "daily", func(t time.Time) string {
+			return t.Format("2006-01-02")
+		})
+	}
+	if policy.KeepWeekly > 0 {
+		keepPerPeriod(policy.KeepWeekly, "weekly", func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-%02d", year, week)
+		})
+	}
+	if policy.KeepMonthly > 0 {
+		keepPerPeriod(policy.KeepMonthly, "monthly", func(t time.Time) string {
+			return t.Format("2006-01")
+		})
+	}
+
+	// The backups a kept backup depends on are older, so they come later in
+	// the order and pass the backups they depend on in turn
+	index := make(map[string]int, len(sorted))
+	for i, backup := range sorted {
+		index[backup.Timestamp] = i
+	}
+	needed := make(map[int]bool)
+	for i, backup := range sorted {
+		if !decisions[i].Keep {
+			continue
+		}
+		for _, dependency := range backup.DependsOn {
+			if j, ok := index[dependency]; ok && j > i && !needed[j] {
+				needed[j] = true
+				keep(j, "needed by "+backup.Timestamp)
+			}
+		}
+	}
+	return decisions
+}
+
+func PruneBackups(c *cli.Context) error {
+	format := c.String("format")
+	if err := validateListFormat(format); err != nil {
+		return err
+	}
+	dryRun := c.Bool("dry-run")
+	config, storage, err := readConfigAndOpenStorage(c)
+	if err != nil {
+		return err
+	}
+	if config.Options.Retention.isEmpty() {
+		return errors.New("prune_backups requires at least one of retention_keep_last, retention_keep_days, " +
+			"retention_keep_daily, retention_keep_weekly or retention_keep_monthly in the plugin configuration file")
+	}
+
+	backups := make([]backupInfo, 0)
+	err = walkBackups(storage, config.Options.Folder, func(backup backupInfo) error {
+		backup.DependsOn, err = readBackupDependencies(storage, config, backup)
+		if err != nil {
+			return err
+		}
+		backups = append(backups, backup)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	decisions := evaluateRetention(backups, config.Options.Retention, operating.System.Now())
+	writer := newListWriter(format, operating.System.Stdout, retentionDecisionTableColumns, retentionDecisionCSVColumns)
+	for _, decision := range decisions {
+		if err = writer.Write(decision); err != nil {
+			return err
+		}
+	}
+	if err = writer.Flush(); err != nil {
+		return err
+	}
+	if dryRun {
+		return nil
+	}
+
+	numDeleted := 0
+	for _, decision := range decisions {
+		if decision.Keep {
+			continue
+		}
+		if err = deleteBackupTimestamp(storage, config, decision.Timestamp); err != nil {
+			return err
+		}
+		gplog.Verbose("Deleted backup %s", decision.Timestamp)
+		numDeleted++
+	}
+	gplog.Info("Deleted %d of %d backups", numDeleted, len(decisions))
+	return nil
+}
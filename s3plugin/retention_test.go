@@ -0,0 +1,116 @@
+package s3plugin
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("retention", func() {
+	complete := func(timestamp string) backupInfo {
+		return backupInfo{Timestamp: timestamp, HasReport: true, HasToc: true}
+	}
+	incomplete := func(timestamp string) backupInfo {
+		return backupInfo{Timestamp: timestamp, HasToc: true}
+	}
+	kept := func(decisions []retentionDecision) []string {
+		timestamps := make([]string, 0)
+		for _, decision := range decisions {
+			if decision.Keep {
+				timestamps = append(timestamps, decision.Timestamp)
+			}
+		}
+		return timestamps
+	}
+	now := time.Date(2018, 3, 1, 12, 0, 0, 0, time.Local)
+
+	It("keeps the last N complete backups", func() {
+		backups := []backupInfo{complete("20180101010101"), complete("20180102010101"),
+			complete("20180103010101"), complete("20180104010101")}
+		decisions := evaluateRetention(backups, RetentionPolicy{KeepLast: 2}, now)
+		Expect(kept(decisions)).To(Equal([]string{"20180104010101", "20180103010101"}))
+		Expect(decisions).To(HaveLen(4))
+		Expect(decisions[3].action()).To(Equal("delete"))
+	})
+	It("does not count incomplete backups towards the last N", func() {
+		backups := []backupInfo{complete("20180101010101"), complete("20180102010101"),
+			incomplete("20180103010101"), complete("20180104010101")}
+		decisions := evaluateRetention(backups, RetentionPolicy{KeepLast: 2}, now)
+		Expect(kept(decisions)).To(Equal([]string{"20180104010101", "20180102010101"}))
+	})
+	It("never deletes the newest complete backup or anything newer", func() {
+		backups := []backupInfo{complete("20180101010101"), complete("20180102010101"),
+			incomplete("20180103010101")}
+		decisions := evaluateRetention(backups, RetentionPolicy{KeepDays: 1}, now)
+		Expect(kept(decisions)).To(Equal([]string{"20180103010101", "20180102010101"}))
+		Expect(decisions[0].Reasons).To(Equal([]string{"newer than the newest complete backup"}))
+		Expect(decisions[1].Reasons).To(Equal([]string{"newest complete backup"}))
+	})
+	It("does not count backups marked as failed as complete", func() {
+		failed := complete("20180103010101")
+		failed.Failed = true
+		backups := []backupInfo{complete("20180101010101"), complete("20180102010101"), failed}
+		decisions := evaluateRetention(backups, RetentionPolicy{KeepLast: 1}, now)
+		Expect(kept(decisions)).To(Equal([]string{"20180103010101", "20180102010101"}))
+		Expect(decisions[0].Reasons).To(Equal([]string{"newer than the newest complete backup"}))
+	})
+	It("keeps every backup if none is complete", func() {
+		backups := []backupInfo{incomplete("20180101010101"), incomplete("20180102010101")}
+		decisions := evaluateRetention(backups, RetentionPolicy{KeepLast: 1}, now)
+		Expect(kept(decisions)).To(Equal([]string{"20180102010101", "20180101010101"}))
+	})
+	It("keeps every backup within the given number of days", func() {
+		backups := []backupInfo{complete("20180225120000"), incomplete("20180226120000"),
+			complete("20180227120000"), complete("20180228120000")}
+		decisions := evaluateRetention(backups, RetentionPolicy{KeepDays: 3}, now)
+		Expect(kept(decisions)).To(Equal([]string{"20180228120000", "20180227120000", "20180226120000"}))
+	})
+	It("keeps the newest complete backup of each of the most recent days, weeks and months", func() {
+		backups := []backupInfo{
+			complete("20180105230000"), // Friday of week 1
+			complete("20180110230000"), // Wednesday of week 2
+			complete("20180111010000"), // Thursday of week 2
+			complete("20180111230000"),
+			complete("20180201010000"),
+			complete("20180201230000"),
+			incomplete("20180202010000"),
+			complete("20180202230000"),
+		}
+		Expect(kept(evaluateRetention(backups, RetentionPolicy{KeepDaily: 3}, now))).To(Equal(
+			[]string{"20180202230000", "20180201230000", "20180111230000"}))
+		Expect(kept(evaluateRetention(backups, RetentionPolicy{KeepWeekly: 3}, now))).To(Equal(
+			[]string{"20180202230000", "20180111230000", "20180105230000"}))
+		Expect(kept(evaluateRetention(backups, RetentionPolicy{KeepMonthly: 1}, now))).To(Equal(
+			[]string{"20180202230000"}))
+	})
+	It("keeps a backup kept by any of the rules", func() {
+		backups := []backupInfo{complete("20180101010101"), complete("20180201010101"),
+			complete("20180226010101"), complete("20180227010101"), complete("20180228010101")}
+		decisions := evaluateRetention(backups, RetentionPolicy{KeepLast: 1, KeepDays: 3, KeepMonthly: 2}, now)
+		Expect(kept(decisions)).To(Equal([]string{"20180228010101", "20180227010101", "20180101010101"}))
+		Expect(decisions[0].Reasons).To(ConsistOf("newest complete backup", "within 3 days", "last 1", "monthly"))
+		Expect(decisions[4].Reasons).To(Equal([]string{"monthly"}))
+	})
+	It("keeps the backups a kept incremental backup depends on", func() {
+		incremental := func(timestamp string, dependsOn ...string) backupInfo {
+			backup := complete(timestamp)
+			backup.DependsOn = dependsOn
+			return backup
+		}
+		backups := []backupInfo{complete("20180101010101"), complete("20180102010101"),
+			incremental("20180103010101", "20180102010101"),
+			incremental("20180104010101", "20180102010101", "20180103010101")}
+		decisions := evaluateRetention(backups, RetentionPolicy{KeepLast: 1}, now)
+		Expect(kept(decisions)).To(Equal([]string{"20180104010101", "20180103010101", "20180102010101"}))
+		Expect(decisions[2].Reasons).To(Equal([]string{"needed by 20180104010101"}))
+	})
+	It("rejects retention options that are not non-negative integers", func() {
+		opt := &PluginOptions{RetentionKeepLast: "3", RetentionKeepDays: "-1", RetentionKeepWeekly: "weekly"}
+		errTxt := validateRetention(opt)
+		Expect(errTxt).To(ContainSubstring("Invalid retention_keep_days"))
+		Expect(errTxt).To(ContainSubstring("Invalid retention_keep_weekly"))
+		Expect(errTxt).ToNot(ContainSubstring("retention_keep_last"))
+		Expect(opt.Retention.KeepLast).To(Equal(3))
+	})
+})
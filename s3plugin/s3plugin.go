@@ -1,6 +1,7 @@
 package s3plugin
 
 import (
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -11,19 +12,15 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/client"
-	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3iface"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/greenplum-db/gp-common-go-libs/gplog"
 	"github.com/greenplum-db/gp-common-go-libs/operating"
 	"github.com/inhies/go-bytesize"
-	"github.com/olekukonko/tablewriter"
 	"github.com/urfave/cli"
 	"gopkg.in/yaml.v2"
 )
@@ -45,6 +42,14 @@ const (
 	Segment     Scope = "segment"
 )
 
+// Server-side encryption modes accepted by the server_side_encryption option
+const (
+	SseNone = "none"
+	SseS3   = "sse-s3"
+	SseKms  = "sse-kms"
+	SseC    = "sse-c"
+)
+
 type PluginConfig struct {
 	ExecutablePath string        `yaml:"executablepath"`
 	Options        PluginOptions `yaml:"options"`
@@ -53,6 +58,15 @@ type PluginConfig struct {
 type PluginOptions struct {
 	AwsAccessKeyId               string `yaml:"aws_access_key_id"`
 	AwsSecretAccessKey           string `yaml:"aws_secret_access_key"`
+	AwsProfile                   string `yaml:"aws_profile"`
+	AwsSharedCredentialsFile     string `yaml:"aws_shared_credentials_file"`
+	AwsCredentialProcess         string `yaml:"aws_credential_process"`
+	AwsWebIdentityTokenFile      string `yaml:"aws_web_identity_token_file"`
+	AwsInstanceMetadata          string `yaml:"aws_instance_metadata"`
+	AwsRoleArn                   string `yaml:"aws_role_arn"`
+	AwsRoleExternalId            string `yaml:"aws_role_external_id"`
+	AwsRoleSessionName           string `yaml:"aws_role_session_name"`
+	AwsRoleDuration              string `yaml:"aws_role_duration"`
 	BackupMaxConcurrentRequests  string `yaml:"backup_max_concurrent_requests"`
 	BackupMultipartChunksize     string `yaml:"backup_multipart_chunksize"`
 	Bucket                       string `yaml:"bucket"`
@@ -63,17 +77,74 @@ type PluginOptions struct {
 	Region                       string `yaml:"region"`
 	RestoreMaxConcurrentRequests string `yaml:"restore_max_concurrent_requests"`
 	RestoreMultipartChunksize    string `yaml:"restore_multipart_chunksize"`
+	BackupMaxBandwidth           string `yaml:"backup_max_bandwidth"`
+	RestoreMaxBandwidth          string `yaml:"restore_max_bandwidth"`
+	BandwidthLimitHours          string `yaml:"bandwidth_limit_hours"`
 	PgPort                       string `yaml:"pgport"`
 	BackupPluginVersion          string `yaml:"backup_plugin_version"`
 
+	ServerSideEncryption    string            `yaml:"server_side_encryption"`
+	SseKmsKeyId             string            `yaml:"sse_kms_key_id"`
+	SseKmsEncryptionContext map[string]string `yaml:"sse_kms_encryption_context"`
+	SseCustomerKey          string            `yaml:"sse_customer_key"`
+
+	ClientSideEncryptionKeyfile string `yaml:"client_side_encryption_keyfile"`
+
+	InlineSecretAction string `yaml:"inline_secret_action"`
+
+	Compression      string `yaml:"compression"`
+	CompressionLevel string `yaml:"compression_level"`
+
+	StorageBackend string `yaml:"storage_backend"`
+	FilesystemPath string `yaml:"filesystem_path"`
+
+	StorageClass         string `yaml:"storage_class"`
+	DataStorageClass     string `yaml:"data_storage_class"`
+	MetadataStorageClass string `yaml:"metadata_storage_class"`
+
+	Tags          map[string]string `yaml:"tags"`
+	AutomaticTags string            `yaml:"automatic_tags"`
+
+	Replica *ReplicaOptions `yaml:"replica"`
+
+	ObjectLockMode          string `yaml:"object_lock_mode"`
+	ObjectLockRetentionDays string `yaml:"object_lock_retention_days"`
+	ObjectLockLegalHold     string `yaml:"object_lock_legal_hold"`
+
+	UploadStateDir            string `yaml:"upload_state_dir"`
+	HostMemoryBudget          string `yaml:"host_memory_budget"`
+	HostMaxConcurrentRequests string `yaml:"host_max_concurrent_requests"`
+	HostMaxBandwidth          string `yaml:"host_max_bandwidth"`
+	IncompleteUploadMaxAge    string `yaml:"incomplete_upload_max_age"`
+	CleanupIncompleteUploads  string `yaml:"cleanup_incomplete_uploads"`
+	FailedBackupAction        string `yaml:"failed_backup_action"`
+
+	RetentionKeepLast    string `yaml:"retention_keep_last"`
+	RetentionKeepDays    string `yaml:"retention_keep_days"`
+	RetentionKeepDaily   string `yaml:"retention_keep_daily"`
+	RetentionKeepWeekly  string `yaml:"retention_keep_weekly"`
+	RetentionKeepMonthly string `yaml:"retention_keep_monthly"`
+
 	UploadChunkSize     int64
 	UploadConcurrency   int
 	DownloadChunkSize   int64
 	DownloadConcurrency int
-}
 
-func CleanupPlugin(c *cli.Context) error {
-	return nil
+	ClientSideEncryptionKey  []byte
+	CompressionLevelValue    int
+	HostMemoryBudgetBytes    int64
+	HostMaxRequests          int
+	HostMaxBandwidthBytes    int64
+	BackupMaxBandwidthBytes  int64
+	RestoreMaxBandwidthBytes int64
+	BandwidthLimitFrom       time.Duration
+	BandwidthLimitUntil      time.Duration
+	AwsRoleDurationValue     time.Duration
+	Retention                RetentionPolicy
+
+	IncompleteUploadMaxAgeDuration time.Duration
+	ObjectLockRetentionDaysValue   int
+	ReplicaConfig                  *PluginConfig
 }
 
 func GetAPIVersion(c *cli.Context) {
@@ -93,9 +164,16 @@ func readAndValidatePluginConfig(configFile string) (*PluginConfig, error) {
 	if err = yaml.UnmarshalStrict(contents, config); err != nil {
 		return nil, fmt.Errorf("Yaml failures encountered reading config file %s. Error: %s", configFile, err.Error())
 	}
+	inlineSecrets, err := resolveSecrets(&config.Options)
+	if err != nil {
+		return nil, err
+	}
 	if err = InitializeAndValidateConfig(config); err != nil {
 		return nil, err
 	}
+	if err = checkInlineSecrets(configFile, &config.Options, inlineSecrets); err != nil {
+		return nil, err
+	}
 	return config, nil
 }
 
@@ -111,6 +189,15 @@ func InitializeAndValidateConfig(config *PluginConfig) error {
 	if opt.Encryption == "" {
 		opt.Encryption = "on"
 	}
+	if opt.ServerSideEncryption == "" {
+		opt.ServerSideEncryption = SseNone
+	}
+	if opt.StorageBackend == "" {
+		opt.StorageBackend = S3Backend
+	}
+	if opt.UploadStateDir == "" {
+		opt.UploadStateDir = DefaultUploadStateDir
+	}
 	opt.UploadChunkSize = DefaultUploadChunkSize
 	opt.UploadConcurrency = DefaultConcurrency
 	opt.DownloadChunkSize = DefaultDownloadChunkSize
@@ -120,9 +207,7 @@ func InitializeAndValidateConfig(config *PluginConfig) error {
 	if config.ExecutablePath == "" {
 		errTxt += fmt.Sprintf("executable_path must exist and cannot be empty in plugin configuration file\n")
 	}
-	if opt.Bucket == "" {
-		errTxt += fmt.Sprintf("bucket must exist and cannot be empty in plugin configuration file\n")
-	}
+	errTxt += validateStorageBackend(config)
 	if opt.Folder == "" {
 		errTxt += fmt.Sprintf("folder must exist and cannot be empty in plugin configuration file\n")
 	}
@@ -133,12 +218,18 @@ func InitializeAndValidateConfig(config *PluginConfig) error {
 	} else if opt.AwsSecretAccessKey == "" {
 		errTxt += fmt.Sprintf("aws_secret_access_key must exist in plugin configuration file if aws_access_key_id does\n")
 	}
-	if opt.Region == "unused" && opt.Endpoint == "" {
-		errTxt += fmt.Sprintf("region or endpoint must exist in plugin configuration file\n")
-	}
+	errTxt += validateCredentials(opt)
+	errTxt += validateInlineSecretAction(opt)
 	if opt.Encryption != "on" && opt.Encryption != "off" {
 		errTxt += fmt.Sprintf("Invalid encryption configuration. Valid choices are on or off.\n")
 	}
+	errTxt += validateServerSideEncryption(opt)
+	if opt.ClientSideEncryptionKeyfile != "" {
+		opt.ClientSideEncryptionKey, err = readMasterKey(opt.ClientSideEncryptionKeyfile)
+		if err != nil {
+			errTxt += fmt.Sprintf("Invalid client_side_encryption_keyfile. Err: %s\n", err)
+		}
+	}
 	if opt.BackupMultipartChunksize != "" {
 		chunkSize, err := bytesize.Parse(opt.BackupMultipartChunksize)
 		if err != nil {
@@ -169,6 +260,20 @@ func InitializeAndValidateConfig(config *PluginConfig) error {
 			errTxt += fmt.Sprintf("Invalid restore_max_concurrent_requests. Err: %s\n", err)
 		}
 	}
+	if !filepath.IsAbs(opt.UploadStateDir) {
+		errTxt += fmt.Sprintf("upload_state_dir must be an absolute path\n")
+	}
+	errTxt += validateMemoryBudget(opt)
+	errTxt += validateHostCoordination(opt)
+	errTxt += validateBandwidth(opt)
+	errTxt += validateCompression(opt)
+	errTxt += validateStorageClasses(opt)
+	errTxt += validateObjectLock(opt)
+	errTxt += validateTags(opt)
+	errTxt += validateReplica(config)
+	errTxt += validateIncompleteUploadCleanup(opt)
+	errTxt += validateFailedBackupAction(opt)
+	errTxt += validateRetention(opt)
 
 	if errTxt != "" {
 		return errors.New(errTxt)
@@ -176,6 +281,33 @@ func InitializeAndValidateConfig(config *PluginConfig) error {
 	return nil
 }
 
+func validateServerSideEncryption(opt *PluginOptions) string {
+	var errTxt string
+	switch opt.ServerSideEncryption {
+	case SseNone, SseS3, SseKms:
+	case SseC:
+		if opt.SseCustomerKey == "" {
+			errTxt += fmt.Sprintf("sse_customer_key must exist in plugin configuration file if server_side_encryption is sse-c\n")
+		} else if key, err := base64.StdEncoding.DecodeString(opt.SseCustomerKey); err != nil {
+			errTxt += fmt.Sprintf("Invalid sse_customer_key. It must be base64 encoded. Err: %s\n", err)
+		} else if len(key) != 32 {
+			errTxt += fmt.Sprintf("Invalid sse_customer_key. It must decode to 32 bytes, but decodes to %d bytes\n", len(key))
+		}
+		if !ShouldEnableEncryption(opt.Encryption) {
+			errTxt += fmt.Sprintf("server_side_encryption sse-c requires encryption to be on\n")
+		}
+	default:
+		errTxt += fmt.Sprintf("Invalid server_side_encryption configuration. Valid choices are none, sse-s3, sse-kms or sse-c.\n")
+	}
+	if opt.ServerSideEncryption != SseKms && (opt.SseKmsKeyId != "" || len(opt.SseKmsEncryptionContext) > 0) {
+		errTxt += fmt.Sprintf("sse_kms_key_id and sse_kms_encryption_context require server_side_encryption to be sse-kms\n")
+	}
+	if opt.ServerSideEncryption != SseC && opt.SseCustomerKey != "" {
+		errTxt += fmt.Sprintf("sse_customer_key requires server_side_encryption to be sse-c\n")
+	}
+	return errTxt
+}
+
 // CustomRetryer wraps the SDK's built in DefaultRetryer
 type CustomRetryer struct {
 	client.DefaultRetryer
@@ -190,11 +322,12 @@ func (r CustomRetryer) ShouldRetry(req *request.Request) bool {
 	willRetry := false
 	if req.Error != nil && strings.Contains(req.Error.Error(), "connection reset by peer") {
 		willRetry = true
-	} else if req.HTTPResponse.StatusCode == 404 {
+	} else if req.HTTPResponse.StatusCode == 404 && !isObjectLockConfigurationNotFound(req.Error) {
 		// 404 NoSuchKey error is possible due to AWS's eventual consistency
 		// when attempting to inspect or get a file too quickly after it was
 		// uploaded. The s3 plugin does exactly this to determine the amount of
-		// bytes uploaded. For this reason we retry 404 errors.
+		// bytes uploaded. For this reason we retry 404 errors, except for
+		// the missing object lock configuration of a bucket without it.
 		willRetry = true
 	} else {
 		willRetry = r.DefaultRetryer.ShouldRetry(req)
@@ -216,13 +349,20 @@ func (r CustomRetryer) ShouldRetry(req *request.Request) bool {
 	return false
 }
 
-func readConfigAndStartSession(c *cli.Context) (*PluginConfig, *session.Session, error) {
+func readConfigAndOpenStorage(c *cli.Context) (*PluginConfig, Storage, error) {
 	configPath := c.Args().Get(0)
 	config, err := readAndValidatePluginConfig(configPath)
 	if err != nil {
 		return nil, nil, err
 	}
+	storage, err := newStorage(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	return config, storage, nil
+}
 
+func startSession(config *PluginConfig) (*session.Session, error) {
 	disableSSL := !ShouldEnableEncryption(config.Options.Encryption)
 
 	awsConfig := request.WithRetryer(aws.NewConfig(), CustomRetryer{DefaultRetryer: client.DefaultRetryer{NumMaxRetries: 10}}).
@@ -232,14 +372,6 @@ func readConfigAndStartSession(c *cli.Context) (*PluginConfig, *session.Session,
 		WithDisableSSL(disableSSL).
 		WithUseDualStack(true)
 
-	// Will use default credential chain if none provided
-	if config.Options.AwsAccessKeyId != "" {
-		awsConfig = awsConfig.WithCredentials(
-			credentials.NewStaticCredentials(
-				config.Options.AwsAccessKeyId,
-				config.Options.AwsSecretAccessKey, ""))
-	}
-
 	if config.Options.HttpProxy != "" {
 		httpclient := &http.Client{
 			Transport: &http.Transport{
@@ -251,11 +383,16 @@ func readConfigAndStartSession(c *cli.Context) (*PluginConfig, *session.Session,
 		awsConfig.WithHTTPClient(httpclient)
 	}
 
-	sess, err := session.NewSession(awsConfig)
+	// Will use default credential chain if none provided
+	creds, err := newCredentials(&config.Options, awsConfig)
 	if err != nil {
-		return nil, nil, err
+		return nil, fmt.Errorf("Unable to set up AWS credentials: %s", err)
 	}
-	return config, sess, nil
+	if creds != nil {
+		awsConfig = awsConfig.WithCredentials(creds)
+	}
+
+	return session.NewSession(awsConfig)
 }
 
 func ShouldEnableEncryption(encryption string) bool {
@@ -278,19 +415,6 @@ func isDirectoryGetSize(path string) (bool, int64) {
 	return false, 0
 }
 
-func getFileSize(S3 s3iface.S3API, bucket string, fileKey string) (int64, error) {
-	req, resp := S3.HeadObjectRequest(&s3.HeadObjectInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(fileKey),
-	})
-	err := req.Send()
-
-	if err != nil {
-		return 0, err
-	}
-	return *resp.ContentLength, nil
-}
-
 func GetS3Path(folder string, path string) string {
 	/*
 			a typical path for an already-backed-up file will be stored in a
@@ -320,35 +444,45 @@ func DeleteBackup(c *cli.Context) error {
 		return fmt.Errorf(msg)
 	}
 
+	config, storage, err := readConfigAndOpenStorage(c)
+	if err != nil {
+		return err
+	}
+	return deleteBackupTimestamp(storage, config, timestamp)
+}
+
+func deleteBackupTimestamp(storage Storage, config *PluginConfig, timestamp string) error {
 	date := timestamp[0:8]
 	// note that "backups" is a directory is a fact of how we save, choosing
 	// to use the 3 parent directories of the source file. That becomes:
 	// <s3folder>/backups/<date>/<timestamp>
-	config, sess, err := readConfigAndStartSession(c)
-	if err != nil {
-		return err
-	}
 	deletePath := filepath.Join(config.Options.Folder, "backups", date, timestamp)
-	bucket := config.Options.Bucket
-	gplog.Debug("Delete location = s3://%s/%s", bucket, deletePath)
-
-	service := s3.New(sess)
-	iter := s3manager.NewDeleteListIterator(service, &s3.ListObjectsInput{
-		Bucket: aws.String(bucket),
-		Prefix: aws.String(deletePath),
-	})
+	gplog.Debug("Delete location = %s", storage.URL(deletePath))
 
-	batchClient := s3manager.NewBatchDeleteWithClient(service)
-	return batchClient.Delete(aws.BackgroundContext(), iter)
+	return storage.DeletePrefix(deletePath)
 }
 
 func ListDirectory(c *cli.Context) error {
-	var err error
-	config, sess, err := readConfigAndStartSession(c)
+	format := c.String("format")
+	if err := validateListFormat(format); err != nil {
+		return err
+	}
+	view := c.String("view")
+	if err := validateListView(view); err != nil {
+		return err
+	}
+	includeMetadata := c.Bool("metadata")
+	includeTags := c.Bool("tags")
+	config, storage, err := readConfigAndOpenStorage(c)
 	if err != nil {
 		return err
 	}
-	bucket := config.Options.Bucket
+	var bucketStorage *s3Storage
+	if includeTags {
+		if bucketStorage, err = requireS3Storage(storage, "list_directory --tags"); err != nil {
+			return err
+		}
+	}
 
 	var listPath string
 	if len(c.Args()) == 2 {
@@ -356,70 +490,56 @@ func ListDirectory(c *cli.Context) error {
 	} else {
 		listPath = config.Options.Folder
 	}
-
-	client := s3.New(sess)
-	params := &s3.ListObjectsV2Input{Bucket: &bucket, Prefix: &listPath}
-	bucketObjectsList, _ := client.ListObjectsV2(params)
-	fileSizes := make([][]string, 0)
-
-	gplog.Verbose("Retrieving file information from directory %s in S3", listPath)
-	for _, key := range bucketObjectsList.Contents {
-		if strings.HasSuffix(*key.Key, "/") {
-			// Got a directory
-			continue
+	walk := storage.Walk
+	if view == DirectoryView {
+		// List the contents of the folder rather than everything below it
+		if listPath != "" && !strings.HasSuffix(listPath, "/") {
+			listPath += "/"
 		}
-
-		downloader := s3manager.NewDownloader(sess, func(u *s3manager.Downloader) {
-			u.PartSize = config.Options.DownloadChunkSize
-		})
-
-		totalBytes, err := getFileSize(downloader.S3, bucket, *key.Key)
-		if err != nil {
-			return err
-		}
-
-		fileSizes = append(fileSizes, []string{*key.Key, fmt.Sprint(totalBytes)})
+		walk = storage.WalkDirectory
 	}
 
-	// Render the data as a table
-	table := tablewriter.NewWriter(operating.System.Stdout)
-	columns := []string{"NAME", "SIZE(bytes)"}
-	table.SetHeader(columns)
-
-	colors := make([]tablewriter.Colors, len(columns))
-	for i := range colors {
-		colors[i] = tablewriter.Colors{tablewriter.Bold}
+	writer := newListWriter(format, operating.System.Stdout, listEntryTableColumns, listEntryCSVColumns)
+	gplog.Verbose("Retrieving file information from directory %s", storage.URL(listPath))
+	sidecars := &checksumSidecars{}
+	err = walk(listPath, func(object ObjectInfo) error {
+		if strings.HasSuffix(object.Key, "/") && !object.IsPrefix {
+			// Got a directory marker object
+			return nil
+		}
+		if !object.IsPrefix && sidecars.isChecksumFile(object.Key) {
+			return nil
+		}
+		if includeMetadata && !object.IsPrefix {
+			// Listings do not return user metadata
+			info, err := storage.Head(object.Key)
+			if err != nil {
+				return err
+			}
+			object.Metadata = info.Metadata
+		}
+		entry := newListEntry(object)
+		if includeTags && !object.IsPrefix {
+			if entry.Tags, err = bucketStorage.objectTags(object.Key); err != nil {
+				return err
+			}
+		}
+		return writer.Write(entry)
+	})
+	if err != nil {
+		return err
 	}
-
-	table.SetHeaderColor(colors...)
-	table.SetCenterSeparator(" ")
-	table.SetColumnSeparator(" ")
-	table.SetRowSeparator(" ")
-	table.SetHeaderAlignment(tablewriter.ALIGN_LEFT)
-	table.SetHeaderLine(true)
-	table.SetAutoFormatHeaders(false)
-	table.SetBorders(tablewriter.Border{Left: true, Right: true, Bottom: false, Top: false})
-	table.AppendBulk(fileSizes)
-	table.Render()
-
-	return err
+	return writer.Flush()
 }
 
 func DeleteDirectory(c *cli.Context) error {
-	config, sess, err := readConfigAndStartSession(c)
+	_, storage, err := readConfigAndOpenStorage(c)
 	if err != nil {
 		return err
 	}
 	deletePath := c.Args().Get(1)
-	bucket := config.Options.Bucket
-	gplog.Verbose("Deleting directory s3://%s/%s", bucket, deletePath)
-	service := s3.New(sess)
-	iter := s3manager.NewDeleteListIterator(service, &s3.ListObjectsInput{
-		Bucket: aws.String(bucket),
-		Prefix: aws.String(deletePath),
-	})
-	batchClient := s3manager.NewBatchDeleteWithClient(service)
-	return batchClient.Delete(aws.BackgroundContext(), iter)
+	gplog.Verbose("Deleting directory %s", storage.URL(deletePath))
+	return storage.DeletePrefix(deletePath)
 }
 
 func IsValidTimestamp(timestamp string) bool {
@@ -2,9 +2,16 @@ package s3plugin_test
 
 import (
 	"flag"
+	"fmt"
+	"io/ioutil"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/client"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/greenplum-db/gp-common-go-libs/testhelper"
@@ -13,6 +20,7 @@ import (
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
 )
 
 func TestCluster(t *testing.T) {
@@ -168,6 +176,212 @@ var _ = Describe("s3_plugin tests", func() {
 			err := s3plugin.InitializeAndValidateConfig(pluginConfig)
 			Expect(err).To(HaveOccurred())
 		})
+		It("defaults incomplete_upload_max_age to a day", func() {
+			err := s3plugin.InitializeAndValidateConfig(pluginConfig)
+			Expect(err).To(BeNil())
+			Expect(opts.IncompleteUploadMaxAgeDuration).To(Equal(24 * time.Hour))
+		})
+		It("returns error when incomplete_upload_max_age is not a duration", func() {
+			opts.IncompleteUploadMaxAge = "2 days"
+			err := s3plugin.InitializeAndValidateConfig(pluginConfig)
+			Expect(err).To(MatchError(ContainSubstring("Invalid incomplete_upload_max_age")))
+		})
+		It("defaults failed_backup_action to keep", func() {
+			err := s3plugin.InitializeAndValidateConfig(pluginConfig)
+			Expect(err).To(BeNil())
+			Expect(opts.FailedBackupAction).To(Equal(s3plugin.KeepFailedBackup))
+		})
+		It("returns error when failed_backup_action is not keep, mark or delete", func() {
+			opts.FailedBackupAction = "remove"
+			err := s3plugin.InitializeAndValidateConfig(pluginConfig)
+			Expect(err).To(MatchError(ContainSubstring("Invalid failed_backup_action")))
+		})
+		It("accepts storage classes in any case", func() {
+			opts.StorageClass = "intelligent_tiering"
+			opts.MetadataStorageClass = "STANDARD"
+			err := s3plugin.InitializeAndValidateConfig(pluginConfig)
+			Expect(err).To(BeNil())
+			Expect(opts.StorageClass).To(Equal("INTELLIGENT_TIERING"))
+		})
+		It("returns error when a storage class is unknown", func() {
+			opts.DataStorageClass = "COLD"
+			err := s3plugin.InitializeAndValidateConfig(pluginConfig)
+			Expect(err).To(MatchError(ContainSubstring("Invalid data_storage_class COLD")))
+		})
+		It("returns error when a storage class is used with the filesystem backend", func() {
+			opts.StorageBackend = "filesystem"
+			opts.FilesystemPath = "/backups"
+			opts.DataStorageClass = "STANDARD_IA"
+			err := s3plugin.InitializeAndValidateConfig(pluginConfig)
+			Expect(err).To(MatchError(ContainSubstring(
+				"storage_class, data_storage_class and metadata_storage_class require storage_backend s3")))
+		})
+		It("accepts an object lock mode in any case with a retention", func() {
+			opts.ObjectLockMode = "compliance"
+			opts.ObjectLockRetentionDays = "90"
+			err := s3plugin.InitializeAndValidateConfig(pluginConfig)
+			Expect(err).To(BeNil())
+			Expect(opts.ObjectLockMode).To(Equal("COMPLIANCE"))
+			Expect(opts.ObjectLockRetentionDaysValue).To(Equal(90))
+			Expect(opts.ObjectLockLegalHold).To(Equal("off"))
+		})
+		It("returns error when an object lock mode has no retention", func() {
+			opts.ObjectLockMode = "governance"
+			err := s3plugin.InitializeAndValidateConfig(pluginConfig)
+			Expect(err).To(MatchError(ContainSubstring("object_lock_mode requires object_lock_retention_days")))
+		})
+		It("returns error when object lock is used with the filesystem backend", func() {
+			opts.StorageBackend = "filesystem"
+			opts.FilesystemPath = "/backups"
+			opts.ObjectLockLegalHold = "on"
+			err := s3plugin.InitializeAndValidateConfig(pluginConfig)
+			Expect(err).To(MatchError(ContainSubstring("object_lock_mode and object_lock_legal_hold require storage_backend s3")))
+		})
+		It("returns error when the replica has no bucket or conflicting credentials", func() {
+			opts.Replica = &s3plugin.ReplicaOptions{Region: "us-west-2", AwsAccessKeyId: "abc",
+				AwsSecretAccessKey: "def", AwsProfile: "backup"}
+			err := s3plugin.InitializeAndValidateConfig(pluginConfig)
+			Expect(err).To(MatchError(ContainSubstring("bucket must exist and cannot be empty in replica")))
+			Expect(err).To(MatchError(ContainSubstring("replica: Only one source of credentials may be configured")))
+		})
+		It("returns error when the replica is the primary location", func() {
+			opts.Replica = &s3plugin.ReplicaOptions{Endpoint: opts.Endpoint, Region: opts.Region, Bucket: opts.Bucket}
+			err := s3plugin.InitializeAndValidateConfig(pluginConfig)
+			Expect(err).To(MatchError(ContainSubstring("replica must not be the same location as the primary")))
+		})
+		It("uses the credentials of the primary for a replica without its own", func() {
+			opts.Replica = &s3plugin.ReplicaOptions{Region: "us-west-2", Bucket: "replica_bucket"}
+			Expect(s3plugin.InitializeAndValidateConfig(pluginConfig)).To(Succeed())
+			replica := opts.ReplicaConfig.Options
+			Expect(replica.Bucket).To(Equal("replica_bucket"))
+			Expect(replica.Folder).To(Equal(opts.Folder))
+			Expect(replica.AwsAccessKeyId).To(Equal(opts.AwsAccessKeyId))
+			Expect(replica.AwsSecretAccessKey).To(Equal(opts.AwsSecretAccessKey))
+		})
+		It("returns error when tags use a reserved key or exceed the S3 limit", func() {
+			opts.Tags = map[string]string{"gpbackup-database": "sales"}
+			for i := 0; i < 5; i++ {
+				opts.Tags[fmt.Sprintf("team%d", i)] = "dba"
+			}
+			opts.AutomaticTags = "on"
+			err := s3plugin.InitializeAndValidateConfig(pluginConfig)
+			Expect(err).To(MatchError(ContainSubstring("Tag gpbackup-database is reserved for automatic_tags")))
+			Expect(err).To(MatchError(ContainSubstring("S3 allows at most 10 tags per object, but tags and automatic_tags add 11")))
+		})
+		It("returns error when a tag has invalid characters", func() {
+			opts.Tags = map[string]string{"aws:cluster": "prod", "owner": "dba;ops"}
+			err := s3plugin.InitializeAndValidateConfig(pluginConfig)
+			Expect(err).To(MatchError(ContainSubstring(`Invalid tag "aws:cluster"`)))
+			Expect(err).To(MatchError(ContainSubstring("Invalid value of tag owner")))
+		})
+		It("succeeds when a profile is used to assume a role", func() {
+			opts.AwsAccessKeyId = ""
+			opts.AwsSecretAccessKey = ""
+			opts.AwsProfile = "backup"
+			opts.AwsRoleArn = "arn:aws:iam::123456789012:role/gpbackup"
+			opts.AwsRoleExternalId = "greenplum"
+			opts.AwsRoleDuration = "2h"
+			err := s3plugin.InitializeAndValidateConfig(pluginConfig)
+			Expect(err).To(BeNil())
+			Expect(opts.AwsRoleDurationValue).To(Equal(2 * time.Hour))
+		})
+		It("returns error when more than one source of credentials is configured", func() {
+			opts.AwsCredentialProcess = "/usr/local/bin/fetch-credentials"
+			opts.AwsInstanceMetadata = "on"
+			err := s3plugin.InitializeAndValidateConfig(pluginConfig)
+			Expect(err).To(MatchError(ContainSubstring(
+				"Only one source of credentials may be configured, but found aws_access_key_id, aws_credential_process, aws_instance_metadata")))
+		})
+		It("returns error when a web identity token file is configured without a role", func() {
+			opts.AwsAccessKeyId = ""
+			opts.AwsSecretAccessKey = ""
+			opts.AwsWebIdentityTokenFile = "/var/run/secrets/token"
+			err := s3plugin.InitializeAndValidateConfig(pluginConfig)
+			Expect(err).To(MatchError(ContainSubstring("aws_web_identity_token_file requires aws_role_arn")))
+		})
+		It("returns error when the role options are set without aws_role_arn or out of range", func() {
+			opts.AwsRoleSessionName = "nightly"
+			err := s3plugin.InitializeAndValidateConfig(pluginConfig)
+			Expect(err).To(MatchError(ContainSubstring("require aws_role_arn")))
+
+			opts.AwsRoleArn = "arn:aws:iam::123456789012:role/gpbackup"
+			opts.AwsRoleDuration = "13h"
+			err = s3plugin.InitializeAndValidateConfig(pluginConfig)
+			Expect(err).To(MatchError(ContainSubstring("Invalid aws_role_duration")))
+		})
+		It(`sets server_side_encryption to default value "none" if none is specified`, func() {
+			err := s3plugin.InitializeAndValidateConfig(pluginConfig)
+			Expect(err).To(BeNil())
+			Expect(opts.ServerSideEncryption).To(Equal(s3plugin.SseNone))
+		})
+		It("succeeds when server_side_encryption is sse-kms with a key id and encryption context", func() {
+			opts.ServerSideEncryption = "sse-kms"
+			opts.SseKmsKeyId = "arn:aws:kms:us-west-2:111122223333:key/1234abcd"
+			opts.SseKmsEncryptionContext = map[string]string{"cluster": "prod"}
+			err := s3plugin.InitializeAndValidateConfig(pluginConfig)
+			Expect(err).To(BeNil())
+		})
+		It("succeeds when server_side_encryption is sse-c with a 256-bit key", func() {
+			opts.ServerSideEncryption = "sse-c"
+			opts.SseCustomerKey = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+			err := s3plugin.InitializeAndValidateConfig(pluginConfig)
+			Expect(err).To(BeNil())
+		})
+		It("returns error when the server_side_encryption value is invalid", func() {
+			opts.ServerSideEncryption = "invalid_value"
+			err := s3plugin.InitializeAndValidateConfig(pluginConfig)
+			Expect(err).To(HaveOccurred())
+		})
+		It("returns error when sse_kms_key_id is set without sse-kms", func() {
+			opts.ServerSideEncryption = "sse-s3"
+			opts.SseKmsKeyId = "alias/backups"
+			err := s3plugin.InitializeAndValidateConfig(pluginConfig)
+			Expect(err).To(HaveOccurred())
+		})
+		It("returns error when server_side_encryption is sse-c without sse_customer_key", func() {
+			opts.ServerSideEncryption = "sse-c"
+			err := s3plugin.InitializeAndValidateConfig(pluginConfig)
+			Expect(err).To(HaveOccurred())
+		})
+		It("returns error when sse_customer_key does not decode to 32 bytes", func() {
+			opts.ServerSideEncryption = "sse-c"
+			opts.SseCustomerKey = "c2hvcnRrZXk="
+			err := s3plugin.InitializeAndValidateConfig(pluginConfig)
+			Expect(err).To(HaveOccurred())
+		})
+		It("returns error when server_side_encryption is sse-c and encryption is off", func() {
+			opts.ServerSideEncryption = "sse-c"
+			opts.SseCustomerKey = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+			opts.Encryption = "off"
+			err := s3plugin.InitializeAndValidateConfig(pluginConfig)
+			Expect(err).To(HaveOccurred())
+		})
+		It("reads the client-side encryption master key from a base64 encoded keyfile", func() {
+			keyfile, err := ioutil.TempFile("", "s3plugin_keyfile")
+			Expect(err).ToNot(HaveOccurred())
+			defer os.Remove(keyfile.Name())
+			_, _ = keyfile.WriteString("MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=\n")
+			_ = keyfile.Close()
+			opts.ClientSideEncryptionKeyfile = keyfile.Name()
+			err = s3plugin.InitializeAndValidateConfig(pluginConfig)
+			Expect(err).To(BeNil())
+			Expect(opts.ClientSideEncryptionKey).To(Equal([]byte("0123456789abcdef0123456789abcdef")))
+		})
+		It("returns error when the client-side encryption keyfile does not hold a 256-bit key", func() {
+			keyfile, err := ioutil.TempFile("", "s3plugin_keyfile")
+			Expect(err).ToNot(HaveOccurred())
+			defer os.Remove(keyfile.Name())
+			_, _ = keyfile.WriteString("too short")
+			_ = keyfile.Close()
+			opts.ClientSideEncryptionKeyfile = keyfile.Name()
+			err = s3plugin.InitializeAndValidateConfig(pluginConfig)
+			Expect(err).To(HaveOccurred())
+		})
+		It("returns error when the client-side encryption keyfile does not exist", func() {
+			opts.ClientSideEncryptionKeyfile = "/tmp/does_not_exist_keyfile"
+			err := s3plugin.InitializeAndValidateConfig(pluginConfig)
+			Expect(err).To(HaveOccurred())
+		})
 		It("correctly parses upload params from config", func() {
 			opts.BackupMultipartChunksize = "10MB"
 			opts.BackupMaxConcurrentRequests = "10"
@@ -212,6 +426,158 @@ var _ = Describe("s3_plugin tests", func() {
 			Expect(err.Error()).To(Equal("delete requires a <timestamp> with format YYYYMMDDHHMMSS, but received: badformat"))
 		})
 	})
+	Describe("filesystem storage backend", func() {
+		var storageRoot, localDir, configPath string
+
+		writeFile := func(path string, contents string) {
+			Expect(os.MkdirAll(filepath.Dir(path), 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(path, []byte(contents), 0644)).To(Succeed())
+		}
+
+		BeforeEach(func() {
+			_, _, _ = testhelper.SetupTestLogger()
+			var err error
+			storageRoot, err = ioutil.TempDir("", "s3plugin_storage")
+			Expect(err).ToNot(HaveOccurred())
+			localDir, err = ioutil.TempDir("", "s3plugin_local")
+			Expect(err).ToNot(HaveOccurred())
+			configPath = filepath.Join(localDir, "plugin_config.yaml")
+			writeFile(configPath, fmt.Sprintf(`executablepath: /tmp/location
+options:
+  storage_backend: filesystem
+  filesystem_path: %s
+  folder: folder_name
+`, storageRoot))
+		})
+		AfterEach(func() {
+			_ = os.RemoveAll(storageRoot)
+			_ = os.RemoveAll(localDir)
+		})
+		It("requires filesystem_path when storage_backend is filesystem", func() {
+			opts.StorageBackend = "filesystem"
+			err := s3plugin.InitializeAndValidateConfig(pluginConfig)
+			Expect(err).To(HaveOccurred())
+		})
+		It("does not require a bucket when storage_backend is filesystem", func() {
+			opts.StorageBackend = "filesystem"
+			opts.FilesystemPath = "/data/backups"
+			opts.Bucket = ""
+			err := s3plugin.InitializeAndValidateConfig(pluginConfig)
+			Expect(err).To(BeNil())
+		})
+		It("returns error when storage_backend is invalid", func() {
+			opts.StorageBackend = "tape"
+			err := s3plugin.InitializeAndValidateConfig(pluginConfig)
+			Expect(err).To(HaveOccurred())
+		})
+		It("restores a file that was backed up with backup_file", func() {
+			backupFile := filepath.Join(localDir, "backups/20180101/20180101082233/gpbackup_20180101082233_metadata.sql")
+			writeFile(backupFile, "CREATE TABLE foo(i int);")
+
+			Expect(s3plugin.BackupFile(contextWithArgs(configPath, backupFile))).To(Succeed())
+			Expect(filepath.Join(storageRoot, "folder_name/backups/20180101/20180101082233/gpbackup_20180101082233_metadata.sql")).To(BeAnExistingFile())
+			Expect(os.Remove(backupFile)).To(Succeed())
+
+			Expect(s3plugin.RestoreFile(contextWithArgs(configPath, backupFile))).To(Succeed())
+			contents, err := ioutil.ReadFile(backupFile)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(contents)).To(Equal("CREATE TABLE foo(i int);"))
+		})
+		It("fails to restore a file whose stored contents were modified", func() {
+			backupFile := filepath.Join(localDir, "backups/20180101/20180101082233/gpbackup_20180101082233_metadata.sql")
+			writeFile(backupFile, "CREATE TABLE foo(i int);")
+			Expect(s3plugin.BackupFile(contextWithArgs(configPath, backupFile))).To(Succeed())
+			writeFile(filepath.Join(storageRoot, "folder_name/backups/20180101/20180101082233/gpbackup_20180101082233_metadata.sql"), "CREATE TABLE bar(i int);")
+
+			err := s3plugin.RestoreFile(contextWithArgs(configPath, backupFile))
+			Expect(err).To(MatchError(ContainSubstring("Checksum mismatch")))
+			Expect(backupFile).ToNot(BeAnExistingFile())
+		})
+		It("keeps to backup_max_bandwidth", func() {
+			contents, err := ioutil.ReadFile(configPath)
+			Expect(err).ToNot(HaveOccurred())
+			writeFile(configPath, string(contents)+"  backup_max_bandwidth: 1MB/s\n")
+			backupFile := filepath.Join(localDir, "backups/20180101/20180101082233/gpbackup_20180101082233_metadata.sql")
+			writeFile(backupFile, strings.Repeat("a", 3*1024*1024/2))
+
+			start := time.Now()
+			Expect(s3plugin.BackupFile(contextWithArgs(configPath, backupFile))).To(Succeed())
+			// A second's worth passes at once, the remaining half takes 0.5s
+			Expect(time.Since(start)).To(BeNumerically(">=", 400*time.Millisecond))
+		})
+		It("uploads every file of a directory with backup_directory_parallel", func() {
+			sourceDir := filepath.Join(localDir, "backups/20180101/20180101082233")
+			writeFile(filepath.Join(sourceDir, "file1"), "one")
+			writeFile(filepath.Join(sourceDir, "file2"), "two")
+
+			Expect(s3plugin.BackupDirectoryParallel(contextWithArgs(configPath, sourceDir, "2"))).To(Succeed())
+			for _, name := range []string{"file1", "file2"} {
+				contents, err := ioutil.ReadFile(filepath.Join(storageRoot, sourceDir, name))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(contents).ToNot(BeEmpty())
+			}
+		})
+		It("lists and deletes objects whose names start with a dot", func() {
+			stdout := captureStdout()
+			backupFile := filepath.Join(localDir, "backups/20180101/20180101082233/.backup_label")
+			writeFile(backupFile, "label")
+			Expect(s3plugin.BackupFile(contextWithArgs(configPath, backupFile))).To(Succeed())
+
+			Expect(s3plugin.ListDirectory(contextWithArgs(configPath))).To(Succeed())
+			Expect(stdout).To(gbytes.Say("folder_name/backups/20180101/20180101082233/.backup_label +5"))
+			Expect(string(stdout.Contents())).ToNot(ContainSubstring(".metadata"))
+			Expect(s3plugin.DeleteBackup(contextWithArgs(configPath, "20180101082233"))).To(Succeed())
+			Expect(filepath.Join(storageRoot, "folder_name/backups/20180101")).ToNot(BeAnExistingFile())
+		})
+		It("deletes only the objects of the given timestamp with delete_backup", func() {
+			writeFile(filepath.Join(storageRoot, "folder_name/backups/20180101/20180101082233/file1"), "one")
+			writeFile(filepath.Join(storageRoot, "folder_name/backups/20180101/20180101082233/file2"), "two")
+			writeFile(filepath.Join(storageRoot, "folder_name/backups/20180102/20180102082233/file1"), "one")
+
+			Expect(s3plugin.DeleteBackup(contextWithArgs(configPath, "20180101082233"))).To(Succeed())
+			Expect(filepath.Join(storageRoot, "folder_name/backups/20180101/20180101082233/file1")).ToNot(BeAnExistingFile())
+			Expect(filepath.Join(storageRoot, "folder_name/backups/20180101/20180101082233/file2")).ToNot(BeAnExistingFile())
+			Expect(filepath.Join(storageRoot, "folder_name/backups/20180102/20180102082233/file1")).To(BeAnExistingFile())
+		})
+		It("lists the objects under the configured folder with list_directory", func() {
+			stdout := captureStdout()
+			writeFile(filepath.Join(storageRoot, "folder_name/backups/20180101/20180101082233/file1"), "one")
+			writeFile(filepath.Join(storageRoot, "other_folder/backups/20180101/20180101082233/file2"), "three")
+
+			Expect(s3plugin.ListDirectory(contextWithArgs(configPath))).To(Succeed())
+			Expect(stdout).To(gbytes.Say("folder_name/backups/20180101/20180101082233/file1 +3"))
+			Expect(string(stdout.Contents())).ToNot(ContainSubstring("file2"))
+		})
+		It("lists objects in key order", func() {
+			stdout := captureStdout()
+			writeFile(filepath.Join(storageRoot, "folder_name/backups/a/b"), "one")
+			writeFile(filepath.Join(storageRoot, "folder_name/backups/a.b"), "two")
+
+			Expect(s3plugin.ListDirectory(contextWithArgs(configPath))).To(Succeed())
+			Expect(stdout).To(gbytes.Say("folder_name/backups/a.b "))
+			Expect(stdout).To(gbytes.Say("folder_name/backups/a/b "))
+		})
+		It("refuses keys outside of filesystem_path", func() {
+			outside := filepath.Join(localDir, "outside")
+			writeFile(outside, "keep me")
+			relativeDir, err := filepath.Rel(storageRoot, localDir)
+			Expect(err).ToNot(HaveOccurred())
+
+			err = s3plugin.DeleteDirectory(contextWithArgs(configPath, relativeDir+"/"))
+			Expect(err).To(MatchError(ContainSubstring("is outside of filesystem_path")))
+			Expect(outside).To(BeAnExistingFile())
+		})
+		It("lists the immediate contents of a directory with list_directory --view directory", func() {
+			stdout := captureStdout()
+			writeFile(filepath.Join(storageRoot, "folder_name/backups/20180101/20180101082233/file1"), "one")
+			writeFile(filepath.Join(storageRoot, "folder_name/backups/20180102/20180102082233/file1"), "one")
+
+			Expect(s3plugin.ListDirectory(contextWithArgs("--format", "jsonl", "--view", "directory", configPath, "folder_name/backups"))).To(Succeed())
+			Expect(string(stdout.Contents())).To(Equal(`{"key":"folder_name/backups/20180101/","type":"prefix","size":0}
+{"key":"folder_name/backups/20180102/","type":"prefix","size":0}
+`))
+		})
+	})
 	Describe("CustomRetryer", func() {
 		DescribeTable("validate retryer on different http status codes",
 			func(httpStatusCode int, expectedRetryValue bool) {
@@ -228,5 +594,14 @@ var _ = Describe("s3_plugin tests", func() {
 			Entry("status OK", 200, false),
 			Entry("NoSuchKey", 404, true),
 		)
+		It("does not retry the missing object lock configuration of a bucket", func() {
+			_, _, _ = testhelper.SetupTestLogger()
+			req := &request.Request{
+				HTTPResponse: &http.Response{StatusCode: 404},
+				Error:        awserr.New("ObjectLockConfigurationNotFoundError", "Object Lock configuration does not exist for this bucket", nil),
+			}
+			retryer := s3plugin.CustomRetryer{DefaultRetryer: client.DefaultRetryer{NumMaxRetries: 5}}
+			Expect(retryer.ShouldRetry(req)).To(BeFalse())
+		})
 	})
 })
@@ -0,0 +1,184 @@
+package s3plugin
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/greenplum-db/gp-common-go-libs/gplog"
+)
+
+/*
+ * Secret options of the plugin configuration may refer to the secret instead
+ * of holding it, so that the configuration gpbackup copies to every host does
+ * not contain it:
+ *
+ *   env:NAME       the value of the environment variable NAME
+ *   file:PATH      the contents of PATH, which only its owner may access
+ *   exec:COMMAND   what COMMAND prints, run with sh -c
+ *
+ * References are resolved when the configuration is read, before it is
+ * validated. A secret held inline in a configuration file everyone can read is
+ * warned about, or refused with inline_secret_action set to refuse.
+ */
+
+const (
+	secretEnvPrefix  = "env:"
+	secretFilePrefix = "file:"
+	secretExecPrefix = "exec:"
+
+	WarnInlineSecret   = "warn"
+	RefuseInlineSecret = "refuse"
+)
+
+var secretCommandTimeout = 30 * time.Second
+
+/*
+ * An option that may refer to its value instead of holding it. Only secret
+ * options are reported when they are held inline, as the key ID is no secret.
+ */
+type secretOption struct {
+	name   string
+	value  *string
+	secret bool
+}
+
+func secretOptions(opt *PluginOptions) []secretOption {
+	secrets := []secretOption{
+		{"aws_access_key_id", &opt.AwsAccessKeyId, false},
+		{"aws_secret_access_key", &opt.AwsSecretAccessKey, true},
+		{"sse_customer_key", &opt.SseCustomerKey, true},
+	}
+	if opt.Replica != nil {
+		secrets = append(secrets,
+			secretOption{"replica aws_access_key_id", &opt.Replica.AwsAccessKeyId, false},
+			secretOption{"replica aws_secret_access_key", &opt.Replica.AwsSecretAccessKey, true})
+	}
+	return secrets
+}
+
+func validateInlineSecretAction(opt *PluginOptions) string {
+	if opt.InlineSecretAction == "" {
+		opt.InlineSecretAction = WarnInlineSecret
+	}
+	if opt.InlineSecretAction != WarnInlineSecret && opt.InlineSecretAction != RefuseInlineSecret {
+		return fmt.Sprintf("Invalid inline_secret_action configuration. Valid choices are %s or %s.\n",
+			WarnInlineSecret, RefuseInlineSecret)
+	}
+	return ""
+}
+
+/*
+ * Replaces the secret references in opt with the secrets they refer to and
+ * returns the names of the secret options that hold their secret inline.
+ */
+func resolveSecrets(opt *PluginOptions) ([]string, error) {
+	inline := make([]string, 0)
+	for _, secret := range secretOptions(opt) {
+		if *secret.value == "" {
+			continue
+		}
+		value, isReference, err := resolveSecret(*secret.value)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to resolve %s: %s", secret.name, err)
+		}
+		if !isReference {
+			if secret.secret {
+				inline = append(inline, secret.name)
+			}
+			continue
+		}
+		*secret.value = value
+	}
+	return inline, nil
+}
+
+// Returns the secret value refers to, or value itself if it is no reference
+func resolveSecret(value string) (string, bool, error) {
+	var secret string
+	var err error
+	switch {
+	case strings.HasPrefix(value, secretEnvPrefix):
+		name := strings.TrimPrefix(value, secretEnvPrefix)
+		secret = os.Getenv(name)
+		if secret == "" {
+			err = fmt.Errorf("environment variable %s is not set", name)
+		}
+	case strings.HasPrefix(value, secretFilePrefix):
+		secret, err = readSecretFile(strings.TrimPrefix(value, secretFilePrefix))
+	case strings.HasPrefix(value, secretExecPrefix):
+		secret, err = runSecretCommand(strings.TrimPrefix(value, secretExecPrefix))
+	default:
+		return value, false, nil
+	}
+	return secret, true, err
+}
+
+func readSecretFile(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return "", fmt.Errorf("%s must only be accessible by its owner, but its mode is %04o", path, info.Mode().Perm())
+	}
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	secret := strings.TrimSpace(string(contents))
+	if secret == "" {
+		return "", fmt.Errorf("%s is empty", path)
+	}
+	return secret, nil
+}
+
+func runSecretCommand(command string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), secretCommandTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	output, err := cmd.Output()
+	if ctx.Err() != nil {
+		return "", fmt.Errorf("command %q did not finish within %v", command, secretCommandTimeout)
+	} else if err != nil {
+		return "", fmt.Errorf("command %q failed: %s %s", command, err, strings.TrimSpace(stderr.String()))
+	}
+	secret := strings.TrimSpace(string(output))
+	if secret == "" {
+		return "", fmt.Errorf("command %q printed nothing", command)
+	}
+	return secret, nil
+}
+
+/*
+ * Warns about, or refuses, secrets held inline in a configuration file that
+ * everyone can read.
+ */
+func checkInlineSecrets(configFile string, opt *PluginOptions, inline []string) error {
+	if len(inline) == 0 {
+		return nil
+	}
+	info, err := os.Stat(configFile)
+	if err != nil {
+		return err
+	}
+	if info.Mode().Perm()&0004 == 0 {
+		return nil
+	}
+	message := fmt.Sprintf("Plugin configuration file %s is readable by everyone and holds %s in plain text. "+
+		"Restrict its permissions or refer to the secrets with %s, %s or %s", configFile, strings.Join(inline, ", "),
+		secretEnvPrefix, secretFilePrefix, secretExecPrefix)
+	if opt.InlineSecretAction == RefuseInlineSecret {
+		return errors.New(message)
+	}
+	gplog.Warn(message)
+	return nil
+}
@@ -0,0 +1,93 @@
+package s3plugin
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/greenplum-db/gp-common-go-libs/testhelper"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("secret references", func() {
+	var dir string
+
+	BeforeEach(func() {
+		_, _, _ = testhelper.SetupTestLogger()
+		var err error
+		dir, err = ioutil.TempDir("", "s3plugin_secrets")
+		Expect(err).ToNot(HaveOccurred())
+	})
+	AfterEach(func() {
+		_ = os.RemoveAll(dir)
+	})
+
+	It("resolves references to environment variables, files and commands", func() {
+		Expect(os.Setenv("S3PLUGIN_TEST_KEY_ID", "AKIDFROMENV")).To(Succeed())
+		defer os.Unsetenv("S3PLUGIN_TEST_KEY_ID")
+		secretFile := filepath.Join(dir, "secret")
+		Expect(ioutil.WriteFile(secretFile, []byte("secretfromfile\n"), 0600)).To(Succeed())
+		opt := &PluginOptions{
+			AwsAccessKeyId:     "env:S3PLUGIN_TEST_KEY_ID",
+			AwsSecretAccessKey: "file:" + secretFile,
+			SseCustomerKey:     "exec:echo keyfromcommand",
+		}
+
+		inline, err := resolveSecrets(opt)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(inline).To(BeEmpty())
+		Expect(opt.AwsAccessKeyId).To(Equal("AKIDFROMENV"))
+		Expect(opt.AwsSecretAccessKey).To(Equal("secretfromfile"))
+		Expect(opt.SseCustomerKey).To(Equal("keyfromcommand"))
+	})
+	It("reports the options that hold their secret inline", func() {
+		opt := &PluginOptions{AwsAccessKeyId: "12345", AwsSecretAccessKey: "6789"}
+		inline, err := resolveSecrets(opt)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(inline).To(Equal([]string{"aws_secret_access_key"}))
+		Expect(opt.AwsSecretAccessKey).To(Equal("6789"))
+	})
+	It("does not report an inline key ID, which is no secret", func() {
+		opt := &PluginOptions{AwsAccessKeyId: "12345", AwsSecretAccessKey: "env:S3PLUGIN_TEST_SECRET",
+			Replica: &ReplicaOptions{AwsAccessKeyId: "abc", AwsSecretAccessKey: "env:S3PLUGIN_TEST_SECRET"}}
+		Expect(os.Setenv("S3PLUGIN_TEST_SECRET", "secretfromenv")).To(Succeed())
+		defer os.Unsetenv("S3PLUGIN_TEST_SECRET")
+		inline, err := resolveSecrets(opt)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(inline).To(BeEmpty())
+		Expect(opt.AwsAccessKeyId).To(Equal("12345"))
+		Expect(opt.Replica.AwsSecretAccessKey).To(Equal("secretfromenv"))
+	})
+	It("refuses secret files that others may read", func() {
+		secretFile := filepath.Join(dir, "secret")
+		Expect(ioutil.WriteFile(secretFile, []byte("secret"), 0640)).To(Succeed())
+		_, err := resolveSecrets(&PluginOptions{AwsSecretAccessKey: "file:" + secretFile})
+		Expect(err).To(MatchError(ContainSubstring("Unable to resolve aws_secret_access_key")))
+		Expect(err).To(MatchError(ContainSubstring("must only be accessible by its owner")))
+	})
+	It("fails when a reference cannot be resolved", func() {
+		_, err := resolveSecrets(&PluginOptions{AwsSecretAccessKey: "env:S3PLUGIN_TEST_UNSET"})
+		Expect(err).To(MatchError(ContainSubstring("environment variable S3PLUGIN_TEST_UNSET is not set")))
+
+		_, err = resolveSecrets(&PluginOptions{AwsSecretAccessKey: "exec:echo denied >&2; exit 3"})
+		Expect(err).To(MatchError(ContainSubstring("exit status 3 denied")))
+	})
+	It("warns about or refuses inline secrets in a configuration file everyone can read", func() {
+		configFile := filepath.Join(dir, "config.yaml")
+		Expect(ioutil.WriteFile(configFile, []byte{}, 0644)).To(Succeed())
+		opt := &PluginOptions{}
+		Expect(validateInlineSecretAction(opt)).To(BeEmpty())
+		Expect(opt.InlineSecretAction).To(Equal(WarnInlineSecret))
+		Expect(checkInlineSecrets(configFile, opt, []string{"aws_secret_access_key"})).To(Succeed())
+
+		opt.InlineSecretAction = RefuseInlineSecret
+		Expect(checkInlineSecrets(configFile, opt, []string{"aws_secret_access_key"})).To(MatchError(
+			ContainSubstring("is readable by everyone and holds aws_secret_access_key in plain text")))
+		Expect(checkInlineSecrets(configFile, opt, []string{})).To(Succeed())
+
+		Expect(os.Chmod(configFile, 0600)).To(Succeed())
+		Expect(checkInlineSecrets(configFile, opt, []string{"aws_secret_access_key"})).To(Succeed())
+	})
+})
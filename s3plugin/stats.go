@@ -0,0 +1,129 @@
+package s3plugin
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/greenplum-db/gp-common-go-libs/gplog"
+)
+
+/*
+ * Every plugin command runs in its own process, so the transfers of a backup
+ * or restore are appended to a statistics file per timestamp and direction
+ * in upload_state_dir. The cleanup hooks summarize the file in the log and
+ * remove it.
+ */
+
+const (
+	BackupTransfer  = "backup"
+	RestoreTransfer = "restore"
+)
+
+type transferRecord struct {
+	Key     string  `json:"key"`
+	Bytes   int64   `json:"bytes"`
+	Seconds float64 `json:"seconds"`
+}
+
+type transferSummary struct {
+	Files   int
+	Bytes   int64
+	Seconds float64
+}
+
+func transferStatsPath(config *PluginConfig, timestamp string, direction string) string {
+	return filepath.Join(config.Options.UploadStateDir, "stats", timestamp+"_"+direction+".jsonl")
+}
+
+// Returns the innermost directory of key that is a backup timestamp
+func timestampOfKey(key string) string {
+	dirs := strings.Split(filepath.Dir(key), "/")
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if IsValidTimestamp(dirs[i]) {
+			return dirs[i]
+		}
+	}
+	return ""
+}
+
+/*
+ * Statistics are best effort, a transfer that cannot be recorded is only
+ * logged and never fails the backup or restore.
+ */
+func recordTransfer(config *PluginConfig, direction string, key string, bytes int64, elapsed time.Duration) {
+	timestamp := timestampOfKey(key)
+	if timestamp == "" {
+		return
+	}
+	contents, err := json.Marshal(transferRecord{Key: key, Bytes: bytes, Seconds: elapsed.Seconds()})
+	if err != nil {
+		gplog.Verbose("Unable to record transfer of %s: %s", key, err)
+		return
+	}
+	path := transferStatsPath(config, timestamp, direction)
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		gplog.Verbose("Unable to record transfer of %s: %s", key, err)
+		return
+	}
+	// Appends of a single short line do not interleave between processes
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		gplog.Verbose("Unable to record transfer of %s: %s", key, err)
+		return
+	}
+	defer file.Close()
+	if _, err = file.Write(append(contents, '\n')); err != nil {
+		gplog.Verbose("Unable to record transfer of %s: %s", key, err)
+	}
+}
+
+func readTransferStats(path string) (transferSummary, error) {
+	summary := transferSummary{}
+	file, err := os.Open(path)
+	if err != nil {
+		return summary, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		record := transferRecord{}
+		if err = json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			// A process killed mid-write leaves a partial line behind
+			continue
+		}
+		summary.Files++
+		summary.Bytes += record.Bytes
+		summary.Seconds += record.Seconds
+	}
+	return summary, scanner.Err()
+}
+
+/*
+ * Logs the transfers of direction recorded on this host for timestamp and
+ * removes their statistics file.
+ */
+func flushTransferStats(config *PluginConfig, timestamp string, direction string) {
+	path := transferStatsPath(config, timestamp, direction)
+	summary, err := readTransferStats(path)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		gplog.Warn("Unable to read transfer statistics %s: %s", path, err)
+		return
+	}
+	throughput := float64(0)
+	if summary.Seconds > 0 {
+		throughput = float64(summary.Bytes) / summary.Seconds / Mebibyte
+	}
+	gplog.Info("Transferred %d files (%d bytes) for %s %s in %v of transfer time (%.2f MB/s on average)",
+		summary.Files, summary.Bytes, direction, timestamp,
+		time.Duration(summary.Seconds*float64(time.Second)).Round(time.Millisecond), throughput)
+	if err = os.Remove(path); err != nil && !os.IsNotExist(err) {
+		gplog.Warn("Unable to remove transfer statistics %s: %s", path, err)
+	}
+}
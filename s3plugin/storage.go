@@ -0,0 +1,111 @@
+package s3plugin
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Storage backends accepted by the storage_backend option
+const (
+	S3Backend         = "s3"
+	FilesystemBackend = "filesystem"
+)
+
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+	ETag         string
+	StorageClass string
+	// Metadata is only populated by Head, listings leave it empty
+	Metadata map[string]string
+	// Restore is the x-amz-restore status of an archived object, also only
+	// populated by Head
+	Restore string
+	// IsPrefix is set for the "directories" returned by WalkDirectory
+	IsPrefix bool
+}
+
+/*
+ * Storage is the interface the plugin commands use to talk to the location
+ * backups are stored in. Keys are always "/" separated, regardless of the
+ * backend.
+ */
+type Storage interface {
+	// Put stores the contents of body under key along with metadata
+	Put(key string, body io.Reader, metadata map[string]string) error
+	// Head returns the size and metadata of the object stored under key
+	Head(key string) (*ObjectInfo, error)
+	// GetRange fills buffer with the object's bytes starting at offset
+	GetRange(key string, offset int64, buffer []byte) (int64, error)
+	// Walk calls fn for every object whose key starts with prefix, in key
+	// order, fetching the listing a page at a time. It stops at and returns
+	// the first error returned by fn.
+	Walk(prefix string, fn func(object ObjectInfo) error) error
+	// WalkDirectory is like Walk, but treats "/" as a directory separator.
+	// Objects in the directory prefix names are reported, and every deeper
+	// level is reported once as an ObjectInfo with IsPrefix set and a key
+	// ending in "/".
+	WalkDirectory(prefix string, fn func(object ObjectInfo) error) error
+	// DeletePrefix deletes every object whose key starts with prefix
+	DeletePrefix(prefix string) error
+	// URL returns a human readable location of key for log messages
+	URL(key string) string
+}
+
+func newStorage(config *PluginConfig) (Storage, error) {
+	var storage Storage
+	if config.Options.StorageBackend == FilesystemBackend {
+		storage = newFilesystemStorage(config)
+	} else {
+		bucketStorage, err := newS3Storage(config)
+		if err != nil {
+			return nil, err
+		}
+		storage = bucketStorage
+	}
+	if config.Options.ReplicaConfig != nil {
+		replicated, err := newReplicatedStorage(config, storage)
+		if err != nil {
+			return nil, err
+		}
+		return replicated, nil
+	}
+	return storage, nil
+}
+
+func getMetadataValue(metadata map[string]string, name string) string {
+	// S3 returns user metadata keys in canonical header form, so compare
+	// case-insensitively
+	for key, value := range metadata {
+		if strings.EqualFold(key, name) {
+			return value
+		}
+	}
+	return ""
+}
+
+func validateStorageBackend(config *PluginConfig) string {
+	var errTxt string
+	opt := &config.Options
+	switch opt.StorageBackend {
+	case S3Backend:
+		if opt.Bucket == "" {
+			errTxt += fmt.Sprintf("bucket must exist and cannot be empty in plugin configuration file\n")
+		}
+		if opt.Region == "unused" && opt.Endpoint == "" {
+			errTxt += fmt.Sprintf("region or endpoint must exist in plugin configuration file\n")
+		}
+	case FilesystemBackend:
+		if opt.FilesystemPath == "" {
+			errTxt += fmt.Sprintf("filesystem_path must exist in plugin configuration file if storage_backend is filesystem\n")
+		} else if !strings.HasPrefix(opt.FilesystemPath, "/") {
+			errTxt += fmt.Sprintf("filesystem_path must be an absolute path\n")
+		}
+	default:
+		errTxt += fmt.Sprintf("Invalid storage_backend configuration. Valid choices are s3 or filesystem.\n")
+	}
+	return errTxt
+}
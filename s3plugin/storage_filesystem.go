@@ -0,0 +1,305 @@
+package s3plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+/*
+ * Stores backups in a local directory, typically an NFS mount shared by all
+ * hosts. Object metadata is kept in a hidden file next to each object.
+ * Hidden files are objects like any other, only the metadata and temporary
+ * files of the storage itself are left out of listings.
+ */
+type filesystemStorage struct {
+	root string
+	// Shares requests and bandwidth with the other processes of the host
+	host *hostCoordinator
+	// Limits the bandwidth of the transfers of this process
+	limiter *rateLimiter
+}
+
+func newFilesystemStorage(config *PluginConfig) *filesystemStorage {
+	return &filesystemStorage{root: config.Options.FilesystemPath}
+}
+
+// Returns the path of key below the root, refusing keys that lead out of it
+func (s *filesystemStorage) path(key string) (string, error) {
+	path := filepath.Join(s.root, filepath.FromSlash(key))
+	relativePath, err := filepath.Rel(filepath.Clean(s.root), path)
+	if err != nil || relativePath == ".." || strings.HasPrefix(relativePath, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is outside of filesystem_path %s", key, s.root)
+	}
+	return path, nil
+}
+
+func metadataPath(path string) string {
+	dir, name := filepath.Split(path)
+	return filepath.Join(dir, "."+name+".metadata")
+}
+
+// Names of the temporary files of uploads that are in progress or failed
+var tempFileName = regexp.MustCompile(`^\..*\.tmp\d+$`)
+
+// Files the storage keeps next to the objects, which are not objects themselves
+func isStorageFile(name string) bool {
+	return (strings.HasPrefix(name, ".") && strings.HasSuffix(name, ".metadata")) || tempFileName.MatchString(name)
+}
+
+func (s *filesystemStorage) URL(key string) string {
+	return fmt.Sprintf("file://%s", filepath.Join(s.root, filepath.FromSlash(key)))
+}
+
+func (s *filesystemStorage) Put(key string, body io.Reader, metadata map[string]string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(path)
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so that a failed upload never leaves a
+	// partial object behind
+	tempFile, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+	_, err = io.Copy(tempFile, s.limiter.limitReader(body))
+	if err == nil {
+		err = tempFile.Sync()
+	}
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	// The metadata is renamed into place after the data, so that an object
+	// that is still stored is never paired with the metadata of an upload
+	// that did not finish
+	tempMetadata := ""
+	if len(metadata) > 0 {
+		contents, err := json.Marshal(metadata)
+		if err != nil {
+			return err
+		}
+		if tempMetadata, err = writeTempFile(dir, filepath.Base(metadataPath(path)), contents); err != nil {
+			return err
+		}
+		defer os.Remove(tempMetadata)
+	}
+	if err = os.Rename(tempFile.Name(), path); err != nil {
+		return err
+	}
+	if tempMetadata != "" {
+		return os.Rename(tempMetadata, metadataPath(path))
+	}
+	if err = os.Remove(metadataPath(path)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Writes contents to a new temporary file in dir and returns its path
+func writeTempFile(dir string, name string, contents []byte) (string, error) {
+	tempFile, err := ioutil.TempFile(dir, name+".tmp")
+	if err != nil {
+		return "", err
+	}
+	_, err = tempFile.Write(contents)
+	if err == nil {
+		err = tempFile.Sync()
+	}
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tempFile.Name())
+		return "", err
+	}
+	return tempFile.Name(), nil
+}
+
+func (s *filesystemStorage) Head(key string) (*ObjectInfo, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a regular file", path)
+	}
+
+	metadata := make(map[string]string)
+	contents, err := ioutil.ReadFile(metadataPath(path))
+	if err == nil {
+		err = json.Unmarshal(contents, &metadata)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("Unable to read metadata of %s: %s", path, err)
+	}
+	return &ObjectInfo{Key: key, Size: info.Size(), LastModified: info.ModTime(), Metadata: metadata}, nil
+}
+
+func (s *filesystemStorage) GetRange(key string, offset int64, buffer []byte) (int64, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return 0, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	release := s.host.acquireRequest()
+	n, err := file.ReadAt(buffer, offset)
+	release()
+	s.limiter.wait(n)
+	if err == io.EOF && n < len(buffer) {
+		err = io.ErrUnexpectedEOF
+	} else if err == io.EOF {
+		err = nil
+	}
+	return int64(n), err
+}
+
+/*
+ * Reports the objects in key order like S3 does. filepath.Walk would visit
+ * "a/b" before "a.b" although it sorts after it, so every directory is read
+ * with the names of its subdirectories sorted as keys ending in "/". Objects
+ * are reported as they are reached, only the entries of the directories being
+ * walked are held in memory.
+ */
+func (s *filesystemStorage) Walk(prefix string, fn func(object ObjectInfo) error) error {
+	// Keys are relative to the root, so a leading "/" carries no meaning
+	prefix = strings.TrimLeft(prefix, "/")
+	dirKey := prefix[:strings.LastIndex(prefix, "/")+1]
+	dir, err := s.path(dirKey)
+	if err != nil {
+		return err
+	}
+	return s.walkDir(dir, dirKey, prefix, fn)
+}
+
+func (s *filesystemStorage) walkDir(dir string, dirKey string, prefix string,
+	fn func(object ObjectInfo) error) error {
+
+	objects, err := readDir(dir, dirKey, prefix)
+	if err != nil {
+		return err
+	}
+	for _, object := range objects {
+		if !object.IsPrefix {
+			err = fn(object)
+		} else {
+			subdir := filepath.Join(dir, strings.TrimSuffix(strings.TrimPrefix(object.Key, dirKey), "/"))
+			err = s.walkDir(subdir, object.Key, prefix, fn)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *filesystemStorage) WalkDirectory(prefix string, fn func(object ObjectInfo) error) error {
+	prefix = strings.TrimLeft(prefix, "/")
+	dirKey := prefix[:strings.LastIndex(prefix, "/")+1]
+	dir, err := s.path(dirKey)
+	if err != nil {
+		return err
+	}
+	objects, err := readDir(dir, dirKey, prefix)
+	if err != nil {
+		return err
+	}
+	for _, object := range objects {
+		if err = fn(object); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+ * Returns the objects in dir whose keys start with prefix and the
+ * subdirectories that can hold such objects, in key order
+ */
+func readDir(dir string, dirKey string, prefix string) ([]ObjectInfo, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	objects := make([]ObjectInfo, 0, len(entries))
+	for _, entry := range entries {
+		key := dirKey + entry.Name()
+		if isStorageFile(entry.Name()) {
+			continue
+		}
+		if entry.IsDir() {
+			key += "/"
+			if strings.HasPrefix(key, prefix) || strings.HasPrefix(prefix, key) {
+				objects = append(objects, ObjectInfo{Key: key, IsPrefix: true})
+			}
+		} else if entry.Mode().IsRegular() && strings.HasPrefix(key, prefix) {
+			objects = append(objects, ObjectInfo{Key: key, Size: entry.Size(), LastModified: entry.ModTime()})
+		}
+	}
+	// Directory names end in "/" as keys, which can sort them after files
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+func (s *filesystemStorage) DeletePrefix(prefix string) error {
+	// Collect the keys first, removing files while walking their directory
+	// would confuse the walk
+	keys := make([]string, 0)
+	err := s.Walk(prefix, func(object ObjectInfo) error {
+		keys = append(keys, object.Key)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		path, err := s.path(key)
+		if err != nil {
+			return err
+		}
+		if err = os.Remove(path); err != nil {
+			return err
+		}
+		if err = os.Remove(metadataPath(path)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		s.removeEmptyParents(filepath.Dir(path))
+	}
+	return nil
+}
+
+// Directories are implied by keys, so remove the ones no object lives in anymore
+func (s *filesystemStorage) removeEmptyParents(dir string) {
+	for strings.HasPrefix(dir, s.root+string(filepath.Separator)) {
+		if os.Remove(dir) != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
@@ -0,0 +1,271 @@
+package s3plugin
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/greenplum-db/gp-common-go-libs/gplog"
+)
+
+type s3Storage struct {
+	client  s3iface.S3API
+	bucket  string
+	options *PluginOptions
+	// Shares requests and bandwidth with the other processes of the host
+	host *hostCoordinator
+	// Limits the bandwidth of the transfers of this process
+	limiter *rateLimiter
+}
+
+func newS3Storage(config *PluginConfig) (*s3Storage, error) {
+	sess, err := startSession(config)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Storage{
+		client:  s3.New(sess),
+		bucket:  config.Options.Bucket,
+		options: &config.Options,
+	}, nil
+}
+
+func (s *s3Storage) URL(key string) string {
+	return fmt.Sprintf("s3://%s/%s", s.bucket, key)
+}
+
+func (s *s3Storage) Put(key string, body io.Reader, metadata map[string]string) error {
+	uploadChunkSize := s.options.UploadChunkSize
+	uploadConcurrency := s.options.UploadConcurrency
+
+	uploader := s3manager.NewUploaderWithClient(s.client, func(u *s3manager.Uploader) {
+		u.PartSize = uploadChunkSize
+		u.Concurrency = uploadConcurrency
+		if s.host != nil {
+			u.RequestOptions = append(u.RequestOptions, s.host.requestOption())
+		}
+	})
+	gplog.Debug("Uploading file %s with chunksize %d and concurrency %d",
+		filepath.Base(key), uploader.PartSize, uploader.Concurrency)
+	input := &s3manager.UploadInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+		// This will cause memory issues if
+		// segment_per_host*uploadChunkSize*uploadConcurreny is larger than
+		// the amount of ram a system has.
+		Body: bufio.NewReaderSize(s.limiter.limitReader(body), int(uploadChunkSize)*uploadConcurrency),
+	}
+	if len(metadata) > 0 {
+		input.Metadata = aws.StringMap(metadata)
+	}
+	if storageClass := objectStorageClass(s.options, key); storageClass != "" {
+		input.StorageClass = aws.String(storageClass)
+	}
+	if tagging := objectTagging(s.options, metadata); tagging != "" {
+		input.Tagging = aws.String(tagging)
+	}
+	setUploadEncryption(input, s.options)
+	setUploadObjectLock(input, s.options)
+	_, err := uploader.Upload(input)
+	return err
+}
+
+func (s *s3Storage) Head(key string) (*ObjectInfo, error) {
+	input := &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	}
+	setHeadEncryption(input, s.options)
+	req, resp := s.client.HeadObjectRequest(input)
+	err := req.Send()
+
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectInfo{
+		Key:          key,
+		Size:         *resp.ContentLength,
+		LastModified: aws.TimeValue(resp.LastModified),
+		ETag:         strings.Trim(aws.StringValue(resp.ETag), `"`),
+		StorageClass: aws.StringValue(resp.StorageClass),
+		Metadata:     aws.StringValueMap(resp.Metadata),
+		Restore:      aws.StringValue(resp.Restore),
+	}, nil
+}
+
+func (s *s3Storage) GetRange(key string, offset int64, buffer []byte) (int64, error) {
+	if len(buffer) == 0 {
+		return 0, nil
+	}
+	// Download concurrency is handled by the caller hence we don't need to set concurrency
+	downloader := s3manager.NewDownloaderWithClient(s.client, func(u *s3manager.Downloader) {
+		u.PartSize = int64(len(buffer))
+		u.Concurrency = 1
+	})
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+int64(len(buffer))-1)),
+	}
+	setDownloadEncryption(input, s.options)
+	release := s.host.acquireRequest()
+	n, err := downloader.Download(aws.NewWriteAtBuffer(buffer), input)
+	release()
+	// Waiting after the request frees its slot for others in the meantime
+	s.limiter.wait(int(n))
+	if isArchivedObjectError(err) {
+		err = fmt.Errorf("%s is archived and must be thawed with thaw_backup before it can be read: %s", key, err)
+	}
+	return n, err
+}
+
+func (s *s3Storage) Walk(prefix string, fn func(object ObjectInfo) error) error {
+	return s.walk(prefix, "", fn)
+}
+
+func (s *s3Storage) WalkDirectory(prefix string, fn func(object ObjectInfo) error) error {
+	return s.walk(prefix, "/", fn)
+}
+
+func (s *s3Storage) walk(prefix string, delimiter string, fn func(object ObjectInfo) error) error {
+	params := &s3.ListObjectsV2Input{Bucket: aws.String(s.bucket), Prefix: aws.String(listPrefix(prefix))}
+	if delimiter != "" {
+		params.Delimiter = aws.String(delimiter)
+	}
+	var fnErr error
+	err := s.client.ListObjectsV2Pages(params, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		// Each page holds the next keys in order, split into objects and
+		// prefixes, so merging the two keeps the whole walk in order
+		objects := make([]ObjectInfo, 0, len(page.Contents)+len(page.CommonPrefixes))
+		for _, object := range page.Contents {
+			objects = append(objects, s3ObjectInfo(object))
+		}
+		for _, commonPrefix := range page.CommonPrefixes {
+			objects = append(objects, ObjectInfo{Key: *commonPrefix.Prefix, IsPrefix: true})
+		}
+		sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+		for _, object := range objects {
+			fnErr = fn(object)
+			if fnErr != nil {
+				return false
+			}
+		}
+		return true
+	})
+	if fnErr != nil {
+		return fnErr
+	}
+	return err
+}
+
+func s3ObjectInfo(object *s3.Object) ObjectInfo {
+	return ObjectInfo{
+		Key:          aws.StringValue(object.Key),
+		Size:         aws.Int64Value(object.Size),
+		LastModified: aws.TimeValue(object.LastModified),
+		ETag:         strings.Trim(aws.StringValue(object.ETag), `"`),
+		StorageClass: aws.StringValue(object.StorageClass),
+	}
+}
+
+func (s *s3Storage) DeletePrefix(prefix string) error {
+	if err := s.checkUnlocked(prefix); err != nil {
+		return err
+	}
+	iter := s3manager.NewDeleteListIterator(s.client, &s3.ListObjectsInput{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(listPrefix(prefix)),
+	})
+	batchClient := s3manager.NewBatchDeleteWithClient(s.client)
+	return batchClient.Delete(aws.BackgroundContext(), iter)
+}
+
+/*
+ * The SDK cleans the request path, so an object put under "/dir/file" is stored
+ * as "dir/file". Prefixes are sent as query parameters and are not cleaned, so
+ * strip the leading "/" to match what was stored.
+ */
+func listPrefix(prefix string) string {
+	return strings.TrimLeft(prefix, "/")
+}
+
+/*
+ * Server-side encryption parameters have to be sent with every upload. Objects
+ * encrypted with SSE-S3 or SSE-KMS are decrypted transparently by S3, but
+ * objects encrypted with a customer-provided key (SSE-C) require the same key
+ * on every GET and HEAD request as well.
+ */
+func setUploadEncryption(input *s3manager.UploadInput, opt *PluginOptions) {
+	params := uploadEncryptionParams(opt)
+	input.ServerSideEncryption = params.serverSideEncryption
+	input.SSEKMSKeyId, input.SSEKMSEncryptionContext = params.kmsKeyId, params.kmsEncryptionContext
+	input.SSECustomerAlgorithm, input.SSECustomerKey = params.customerAlgorithm, params.customerKey
+}
+
+func setCreateMultipartEncryption(input *s3.CreateMultipartUploadInput, opt *PluginOptions) {
+	params := uploadEncryptionParams(opt)
+	input.ServerSideEncryption = params.serverSideEncryption
+	input.SSEKMSKeyId, input.SSEKMSEncryptionContext = params.kmsKeyId, params.kmsEncryptionContext
+	input.SSECustomerAlgorithm, input.SSECustomerKey = params.customerAlgorithm, params.customerKey
+}
+
+// The server-side encryption fields of an upload, which are nil when unused
+type encryptionParams struct {
+	serverSideEncryption *string
+	kmsKeyId             *string
+	kmsEncryptionContext *string
+	customerAlgorithm    *string
+	customerKey          *string
+}
+
+func uploadEncryptionParams(opt *PluginOptions) encryptionParams {
+	var params encryptionParams
+	switch opt.ServerSideEncryption {
+	case SseS3:
+		params.serverSideEncryption = aws.String(s3.ServerSideEncryptionAes256)
+	case SseKms:
+		params.serverSideEncryption = aws.String(s3.ServerSideEncryptionAwsKms)
+		if opt.SseKmsKeyId != "" {
+			params.kmsKeyId = aws.String(opt.SseKmsKeyId)
+		}
+		if len(opt.SseKmsEncryptionContext) > 0 {
+			params.kmsEncryptionContext = aws.String(encodeEncryptionContext(opt.SseKmsEncryptionContext))
+		}
+	case SseC:
+		params.customerAlgorithm, params.customerKey = sseCustomerKeyParams(opt)
+	}
+	return params
+}
+
+func setDownloadEncryption(input *s3.GetObjectInput, opt *PluginOptions) {
+	if opt.ServerSideEncryption == SseC {
+		input.SSECustomerAlgorithm, input.SSECustomerKey = sseCustomerKeyParams(opt)
+	}
+}
+
+func setHeadEncryption(input *s3.HeadObjectInput, opt *PluginOptions) {
+	if opt.ServerSideEncryption == SseC {
+		input.SSECustomerAlgorithm, input.SSECustomerKey = sseCustomerKeyParams(opt)
+	}
+}
+
+// The SDK base64 encodes the raw key and computes its MD5 for us
+func sseCustomerKeyParams(opt *PluginOptions) (*string, *string) {
+	key, _ := base64.StdEncoding.DecodeString(opt.SseCustomerKey)
+	return aws.String(s3.ServerSideEncryptionAes256), aws.String(string(key))
+}
+
+// S3 expects the KMS encryption context as base64 encoded JSON
+func encodeEncryptionContext(context map[string]string) string {
+	contextJSON, _ := json.Marshal(context)
+	return base64.StdEncoding.EncodeToString(contextJSON)
+}
@@ -0,0 +1,77 @@
+package s3plugin
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+/*
+ * Storage classes of the objects the plugin uploads.
+ *
+ * storage_class applies to every object. data_storage_class applies instead
+ * to the data files of a backup, which hold the table data and make up most of
+ * its size, and metadata_storage_class to all other files, such as the
+ * metadata, TOC, report and checksum files, which are small and read by every
+ * restore. Data files are told apart by their name. Without any of the options
+ * objects get the default class of the bucket.
+ */
+
+// gpbackup_<content id>_<timestamp>, followed by a table oid unless the
+// backup was taken with --single-data-file, and the compression extension
+var dataFileName = regexp.MustCompile(`^gpbackup_-?\d+_\d{14}(_\d+)?(\.gz|\.zst)?$`)
+
+func validateStorageClasses(opt *PluginOptions) string {
+	var errTxt string
+	isConfigured := false
+	for _, class := range []struct {
+		name  string
+		value *string
+	}{
+		{"storage_class", &opt.StorageClass},
+		{"data_storage_class", &opt.DataStorageClass},
+		{"metadata_storage_class", &opt.MetadataStorageClass},
+	} {
+		if *class.value == "" {
+			continue
+		}
+		isConfigured = true
+		*class.value = strings.ToUpper(*class.value)
+		if !isValidStorageClass(*class.value) {
+			errTxt += fmt.Sprintf("Invalid %s %s. Valid choices are %s.\n", class.name, *class.value,
+				strings.Join(s3.StorageClass_Values(), ", "))
+		}
+	}
+	if isConfigured && opt.StorageBackend != S3Backend {
+		errTxt += fmt.Sprintf("storage_class, data_storage_class and metadata_storage_class require storage_backend s3\n")
+	}
+	return errTxt
+}
+
+func isValidStorageClass(class string) bool {
+	for _, valid := range s3.StorageClass_Values() {
+		if class == valid {
+			return true
+		}
+	}
+	return false
+}
+
+func isDataFile(key string) bool {
+	return dataFileName.MatchString(path.Base(key))
+}
+
+// The storage class to upload key with, or "" for the default of the bucket
+func objectStorageClass(opt *PluginOptions, key string) string {
+	if isDataFile(key) {
+		if opt.DataStorageClass != "" {
+			return opt.DataStorageClass
+		}
+	} else if opt.MetadataStorageClass != "" {
+		return opt.MetadataStorageClass
+	}
+	return opt.StorageClass
+}
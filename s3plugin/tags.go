@@ -0,0 +1,212 @@
+package s3plugin
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"gopkg.in/yaml.v2"
+)
+
+/*
+ * Every uploaded object is labelled with the backup it belongs to in its
+ * metadata: the backup timestamp, the content id of the segment, the database
+ * when the plugin can tell and the plugin versions. S3 tags, unlike metadata,
+ * can be used in cost allocation reports, lifecycle rules and bucket
+ * policies. tags are applied to every object, and with automatic_tags on the
+ * labels are applied as tags as well.
+ */
+
+// Names of the labels in the metadata and tags of an object
+const (
+	timestampLabel           = "gpbackup-timestamp"
+	contentIdLabel           = "gpbackup-content-id"
+	databaseLabel            = "gpbackup-database"
+	pluginVersionLabel       = "gpbackup-s3-plugin-version"
+	backupPluginVersionLabel = "gpbackup-backup-plugin-version"
+)
+
+var backupLabels = []string{timestampLabel, contentIdLabel, databaseLabel, pluginVersionLabel, backupPluginVersionLabel}
+
+// S3 limits on the tags of an object
+const (
+	maxObjectTags     = 10
+	maxTagKeyLength   = 128
+	maxTagValueLength = 256
+)
+
+var tagCharacters = regexp.MustCompile(`^[\p{L}\p{Z}\p{N}_.:/=+\-@]*$`)
+
+// Label values are restricted to characters valid in both tags and headers
+var invalidLabelCharacters = regexp.MustCompile(`[^A-Za-z0-9 _.:/=+\-@]`)
+
+// gpbackup_<content id>_<timestamp> for segment files and
+// gpbackup_<timestamp>_<name> for those of the coordinator
+var segmentFileName = regexp.MustCompile(`^gpbackup_(-?\d+)_\d{14}`)
+var coordinatorFileName = regexp.MustCompile(`^gpbackup_\d{14}_`)
+
+func validateTags(opt *PluginOptions) string {
+	var errTxt string
+	if opt.AutomaticTags == "" {
+		opt.AutomaticTags = "off"
+	}
+	if opt.AutomaticTags != "on" && opt.AutomaticTags != "off" {
+		errTxt += fmt.Sprintf("Invalid automatic_tags configuration. Valid choices are on or off.\n")
+	}
+	keys := make([]string, 0, len(opt.Tags))
+	for key := range opt.Tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := opt.Tags[key]
+		if key == "" || utf8.RuneCountInString(key) > maxTagKeyLength || !tagCharacters.MatchString(key) ||
+			strings.HasPrefix(key, "aws:") {
+			errTxt += fmt.Sprintf("Invalid tag %q. Tag keys must have 1 to %d letters, digits, spaces or "+
+				"_.:/=+-@ characters and cannot start with aws:\n", key, maxTagKeyLength)
+		}
+		if utf8.RuneCountInString(value) > maxTagValueLength || !tagCharacters.MatchString(value) {
+			errTxt += fmt.Sprintf("Invalid value of tag %s. Tag values must have up to %d letters, digits, "+
+				"spaces or _.:/=+-@ characters\n", key, maxTagValueLength)
+		}
+		if isBackupLabel(key) {
+			errTxt += fmt.Sprintf("Tag %s is reserved for automatic_tags\n", key)
+		}
+	}
+	numTags := len(opt.Tags)
+	if opt.AutomaticTags == "on" {
+		numTags += len(backupLabels)
+	}
+	if numTags > maxObjectTags {
+		errTxt += fmt.Sprintf("S3 allows at most %d tags per object, but tags and automatic_tags add %d\n",
+			maxObjectTags, numTags)
+	}
+	if (len(opt.Tags) > 0 || opt.AutomaticTags == "on") && opt.StorageBackend != S3Backend {
+		errTxt += fmt.Sprintf("tags and automatic_tags require storage_backend s3\n")
+	}
+	return errTxt
+}
+
+func isBackupLabel(name string) bool {
+	for _, label := range backupLabels {
+		if name == label {
+			return true
+		}
+	}
+	return false
+}
+
+func sanitizeLabel(value string) string {
+	value = invalidLabelCharacters.ReplaceAllString(value, "_")
+	if len(value) > maxTagValueLength {
+		value = value[:maxTagValueLength]
+	}
+	return value
+}
+
+func contentIdOfKey(key string) string {
+	name := strings.TrimSuffix(filepath.Base(key), checksumSuffix)
+	if match := segmentFileName.FindStringSubmatch(name); match != nil {
+		return match[1]
+	}
+	if coordinatorFileName.MatchString(name) {
+		return "-1"
+	}
+	return ""
+}
+
+/*
+ * gpbackup only writes the configuration of a backup, which names its
+ * database, to the backup directory of the coordinator, so the database is
+ * only known for the files uploaded from there after it was written
+ */
+func backupDatabase(localDir string, timestamp string) string {
+	contents, err := ioutil.ReadFile(filepath.Join(localDir, backupConfigName(timestamp)))
+	if err != nil {
+		return ""
+	}
+	backupConfig := struct {
+		DatabaseName string `yaml:"databasename"`
+	}{}
+	if err = yaml.Unmarshal(contents, &backupConfig); err != nil {
+		return ""
+	}
+	return backupConfig.DatabaseName
+}
+
+// The directory of the local file body is read from, if it is one
+func localFileDir(body io.Reader) string {
+	file, ok := body.(*os.File)
+	if !ok {
+		return ""
+	}
+	info, err := file.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		return ""
+	}
+	return filepath.Dir(file.Name())
+}
+
+/*
+ * Returns metadata holding the labels of the object stored under fileKey.
+ * localDir is the directory of the local file it is uploaded from, if any.
+ */
+func backupMetadata(config *PluginConfig, fileKey string, localDir string) map[string]string {
+	timestamp := timestampOfKey(fileKey)
+	labels := map[string]string{
+		timestampLabel:           timestamp,
+		contentIdLabel:           contentIdOfKey(fileKey),
+		pluginVersionLabel:       Version,
+		backupPluginVersionLabel: config.Options.BackupPluginVersion,
+	}
+	if localDir != "" && timestamp != "" {
+		labels[databaseLabel] = backupDatabase(localDir, timestamp)
+	}
+	metadata := make(map[string]string)
+	for name, value := range labels {
+		if value = sanitizeLabel(value); value != "" {
+			metadata[name] = value
+		}
+	}
+	return metadata
+}
+
+// Returns the tags to upload an object with metadata with, URL encoded as S3 expects them
+func objectTagging(opt *PluginOptions, metadata map[string]string) string {
+	tags := url.Values{}
+	for key, value := range opt.Tags {
+		tags.Set(key, value)
+	}
+	if opt.AutomaticTags == "on" {
+		for _, label := range backupLabels {
+			if value := getMetadataValue(metadata, label); value != "" {
+				tags.Set(label, value)
+			}
+		}
+	}
+	return tags.Encode()
+}
+
+func (s *s3Storage) objectTags(key string) (map[string]string, error) {
+	output, err := s.client.GetObjectTagging(&s3.GetObjectTaggingInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	tags := make(map[string]string, len(output.TagSet))
+	for _, tag := range output.TagSet {
+		tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+	return tags, nil
+}
@@ -0,0 +1,59 @@
+package s3plugin_test
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"strings"
+
+	"github.com/greenplum-db/gp-common-go-libs/operating"
+	"github.com/greenplum-db/gpbackup-s3-plugin/s3plugin"
+	"github.com/urfave/cli"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+)
+
+/*
+ * Returns the context a plugin command is called with for args, which may
+ * start with options. Every option of the commands is known, with the default
+ * gpbackup_s3_plugin gives it.
+ */
+func contextWithArgs(args ...string) *cli.Context {
+	flags := flag.NewFlagSet("testing flagset", flag.PanicOnError)
+	flags.String("format", s3plugin.TableFormat, "")
+	flags.String("view", s3plugin.RecursiveView, "")
+	flags.Bool("metadata", false, "")
+	flags.Bool("tags", false, "")
+	flags.Bool("dry-run", false, "")
+	flags.String("older-than", "", "")
+	flags.Int("concurrency", 0, "")
+	flags.String("tier", s3plugin.DefaultThawTier, "")
+	flags.Int("days", s3plugin.DefaultThawDays, "")
+	Expect(flags.Parse(args)).To(Succeed())
+	return cli.NewContext(nil, flags, nil)
+}
+
+// Returns a buffer that receives what the plugin writes to stdout until the spec ends
+func captureStdout() *gbytes.Buffer {
+	stdout := gbytes.NewBuffer()
+	operating.System.Stdout = stdout
+	DeferCleanup(func() {
+		operating.System.Stdout = os.Stdout
+	})
+	return stdout
+}
+
+// Returns the records of the jsonl output in stdout
+func jsonLines(stdout *gbytes.Buffer) []map[string]interface{} {
+	records := make([]map[string]interface{}, 0)
+	for _, line := range strings.Split(strings.TrimSpace(string(stdout.Contents())), "\n") {
+		if line != "" {
+			record := make(map[string]interface{})
+			Expect(json.Unmarshal([]byte(line), &record)).To(Succeed())
+			records = append(records, record)
+		}
+	}
+	return records
+}
@@ -0,0 +1,296 @@
+package s3plugin
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/greenplum-db/gp-common-go-libs/gplog"
+	"github.com/greenplum-db/gp-common-go-libs/operating"
+	"github.com/urfave/cli"
+)
+
+/*
+ * Objects in the GLACIER and DEEP_ARCHIVE storage classes, whether uploaded
+ * there or moved there by a lifecycle rule, cannot be read until S3 restores a
+ * temporary copy of them from the archive. To keep it apart from gprestore
+ * the plugin calls this thawing. thaw_backup requests a copy of every
+ * archived object of a backup and thaw_status reports which copies are ready.
+ * A copy is kept for the requested number of days.
+ */
+
+const (
+	DefaultThawTier = s3.TierStandard
+	DefaultThawDays = 7
+)
+
+// Thaw states of the objects of a backup
+const (
+	thawNotArchived = "not archived"
+	thawArchived    = "archived"
+	thawRequested   = "requested"
+	thawInProgress  = "in progress"
+	thawThawed      = "thawed"
+)
+
+type objectThaw struct {
+	Key          string `json:"key"`
+	StorageClass string `json:"storage_class"`
+	Status       string `json:"status"`
+	Expiry       string `json:"expiry,omitempty"`
+}
+
+var objectThawTableColumns = []string{"KEY", "STORAGE CLASS", "STATUS", "EXPIRES"}
+var objectThawCSVColumns = []string{"key", "storage_class", "status", "expiry"}
+
+func (thaw objectThaw) tableRow() []string {
+	return []string{thaw.Key, thaw.StorageClass, thaw.Status, thaw.Expiry}
+}
+
+func (thaw objectThaw) csvRow() []string {
+	return []string{thaw.Key, thaw.StorageClass, thaw.Status, thaw.Expiry}
+}
+
+func isArchivedStorageClass(storageClass string) bool {
+	return storageClass == s3.StorageClassGlacier || storageClass == s3.StorageClassDeepArchive
+}
+
+/*
+ * Parses the x-amz-restore header S3 returns for archived objects, for
+ * example: ongoing-request="false", expiry-date="Fri, 21 Dec 2012 00:00:00 GMT"
+ */
+func parseRestoreStatus(restore string) (string, time.Time) {
+	if restore == "" {
+		return thawArchived, time.Time{}
+	}
+	if strings.Contains(restore, `ongoing-request="true"`) {
+		return thawInProgress, time.Time{}
+	}
+	var expiry time.Time
+	if _, value, ok := strings.Cut(restore, `expiry-date="`); ok {
+		value, _, _ = strings.Cut(value, `"`)
+		expiry, _ = time.Parse(http.TimeFormat, value)
+	}
+	return thawThawed, expiry
+}
+
+// Archived objects can only be read while a thawed copy of them exists
+func checkThawed(object *ObjectInfo) error {
+	if !isArchivedStorageClass(object.StorageClass) {
+		return nil
+	}
+	switch status, _ := parseRestoreStatus(object.Restore); status {
+	case thawThawed:
+		return nil
+	case thawInProgress:
+		return fmt.Errorf("%s is archived in storage class %s and is still being thawed. "+
+			"Check the progress with thaw_status", object.Key, object.StorageClass)
+	default:
+		return fmt.Errorf("%s is archived in storage class %s and must be thawed with thaw_backup "+
+			"before it can be read", object.Key, object.StorageClass)
+	}
+}
+
+func isArchivedObjectError(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == s3.ErrCodeInvalidObjectState
+}
+
+// Requests a copy of the archived object under key that is kept for days
+func (s *s3Storage) requestThaw(key string, tier string, days int64) (string, error) {
+	req, _ := s.client.RestoreObjectRequest(&s3.RestoreObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+		RestoreRequest: &s3.RestoreRequest{
+			Days:                 aws.Int64(days),
+			GlacierJobParameters: &s3.GlacierJobParameters{Tier: aws.String(tier)},
+		},
+	})
+	err := req.Send()
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "RestoreAlreadyInProgress" {
+		return thawInProgress, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	// S3 answers 202 Accepted to a new request and 200 OK when it only
+	// extended the expiry of a copy that is already thawed
+	if req.HTTPResponse.StatusCode == http.StatusOK {
+		return thawThawed, nil
+	}
+	return thawRequested, nil
+}
+
+// Returns the objects of the backup in key order
+func sortedBackupObjects(storage Storage, config *PluginConfig, timestamp string) ([]ObjectInfo, error) {
+	objects, err := listBackupObjects(storage, backupPrefix(config.Options.Folder, timestamp))
+	if err != nil {
+		return nil, err
+	}
+	if len(objects) == 0 {
+		return nil, fmt.Errorf("Backup %s has no objects", timestamp)
+	}
+	sorted := make([]ObjectInfo, 0, len(objects))
+	for _, object := range objects {
+		sorted = append(sorted, object)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Key < sorted[j].Key
+	})
+	return sorted, nil
+}
+
+func thawBackup(storage *s3Storage, config *PluginConfig, timestamp string, tier string, days int64,
+	fn func(thaw objectThaw) error) error {
+
+	objects, err := sortedBackupObjects(storage, config, timestamp)
+	if err != nil {
+		return err
+	}
+	for _, object := range objects {
+		thaw := objectThaw{Key: object.Key, StorageClass: object.StorageClass, Status: thawNotArchived}
+		if isArchivedStorageClass(object.StorageClass) {
+			thaw.Status, err = storage.requestThaw(object.Key, tier, days)
+			if err != nil {
+				return fmt.Errorf("Unable to request thawing of %s: %s", object.Key, err)
+			}
+		}
+		if err = fn(thaw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func thawStatus(storage *s3Storage, config *PluginConfig, timestamp string, fn func(thaw objectThaw) error) error {
+	objects, err := sortedBackupObjects(storage, config, timestamp)
+	if err != nil {
+		return err
+	}
+	for _, object := range objects {
+		thaw := objectThaw{Key: object.Key, StorageClass: object.StorageClass, Status: thawNotArchived}
+		if isArchivedStorageClass(object.StorageClass) {
+			head, err := storage.Head(object.Key)
+			if err != nil {
+				return fmt.Errorf("Unable to read the thaw status of %s: %s", object.Key, err)
+			}
+			var expiry time.Time
+			thaw.Status, expiry = parseRestoreStatus(head.Restore)
+			thaw.Expiry = formatCatalogTime(expiry)
+		}
+		if err = fn(thaw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateThawTier(tier string) (string, error) {
+	for _, valid := range s3.Tier_Values() {
+		if strings.EqualFold(tier, valid) {
+			return valid, nil
+		}
+	}
+	return "", fmt.Errorf("Invalid --tier %s. Valid choices are %s", tier, strings.Join(s3.Tier_Values(), ", "))
+}
+
+func readThawTimestamp(c *cli.Context, command string) (string, error) {
+	timestamp := c.Args().Get(1)
+	if !IsValidTimestamp(timestamp) {
+		return "", fmt.Errorf("%s requires a <timestamp> with format "+
+			"YYYYMMDDHHMMSS, but received: %s", command, timestamp)
+	}
+	return timestamp, nil
+}
+
+func ThawBackup(c *cli.Context) error {
+	format := c.String("format")
+	if err := validateListFormat(format); err != nil {
+		return err
+	}
+	timestamp, err := readThawTimestamp(c, "thaw_backup")
+	if err != nil {
+		return err
+	}
+	tier, err := validateThawTier(c.String("tier"))
+	if err != nil {
+		return err
+	}
+	days := c.Int("days")
+	if days < 1 {
+		return fmt.Errorf("Invalid --days %d. It must be at least 1", days)
+	}
+	config, storage, err := readConfigAndOpenStorage(c)
+	if err != nil {
+		return err
+	}
+	bucketStorage, err := requireS3Storage(storage, "thaw_backup")
+	if err != nil {
+		return err
+	}
+
+	writer := newListWriter(format, operating.System.Stdout, objectThawTableColumns, objectThawCSVColumns)
+	counts := make(map[string]int)
+	err = thawBackup(bucketStorage, config, timestamp, tier, int64(days), func(thaw objectThaw) error {
+		counts[thaw.Status]++
+		return writer.Write(thaw)
+	})
+	if err != nil {
+		return err
+	}
+	if err = writer.Flush(); err != nil {
+		return err
+	}
+	gplog.Info("Requested thawing of %d objects of backup %s with tier %s for %d days, "+
+		"%d were already being thawed and %d already thawed", counts[thawRequested], timestamp, tier, days,
+		counts[thawInProgress], counts[thawThawed])
+	return nil
+}
+
+func ThawStatus(c *cli.Context) error {
+	format := c.String("format")
+	if err := validateListFormat(format); err != nil {
+		return err
+	}
+	timestamp, err := readThawTimestamp(c, "thaw_status")
+	if err != nil {
+		return err
+	}
+	config, storage, err := readConfigAndOpenStorage(c)
+	if err != nil {
+		return err
+	}
+	bucketStorage, err := requireS3Storage(storage, "thaw_status")
+	if err != nil {
+		return err
+	}
+
+	writer := newListWriter(format, operating.System.Stdout, objectThawTableColumns, objectThawCSVColumns)
+	numArchived, numThawed := 0, 0
+	err = thawStatus(bucketStorage, config, timestamp, func(thaw objectThaw) error {
+		if thaw.Status != thawNotArchived {
+			numArchived++
+		}
+		if thaw.Status == thawThawed {
+			numThawed++
+		}
+		return writer.Write(thaw)
+	})
+	if err != nil {
+		return err
+	}
+	if err = writer.Flush(); err != nil {
+		return err
+	}
+	gplog.Info("%d of %d archived objects of backup %s are thawed", numThawed, numArchived, timestamp)
+	if numThawed < numArchived {
+		return fmt.Errorf("%d of %d archived objects of backup %s are not thawed yet",
+			numArchived-numThawed, numArchived, timestamp)
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+package s3plugin
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/greenplum-db/gp-common-go-libs/gplog"
+	"github.com/greenplum-db/gp-common-go-libs/operating"
+	"github.com/urfave/cli"
+)
+
+/*
+ * verify_backup_data reads every object of a backup the way restore_data
+ * would, with the same ranged parallel downloads, decryption and checksum
+ * verification, but discards the data. It shows whether a backup can be
+ * restored without running gprestore.
+ */
+
+type dataVerification struct {
+	Key      string  `json:"key"`
+	Bytes    int64   `json:"bytes"`
+	Seconds  float64 `json:"seconds"`
+	Checksum string  `json:"checksum"`
+	Error    string  `json:"error,omitempty"`
+}
+
+var dataVerificationTableColumns = []string{"KEY", "SIZE(bytes)", "TIME", "MB/s", "CHECKSUM", "ERROR"}
+var dataVerificationCSVColumns = []string{"key", "bytes", "seconds", "mb_per_second", "checksum", "error"}
+
+func (verification dataVerification) throughput() float64 {
+	if verification.Seconds <= 0 {
+		return 0
+	}
+	return float64(verification.Bytes) / verification.Seconds / Mebibyte
+}
+
+func (verification dataVerification) tableRow() []string {
+	return []string{verification.Key, fmt.Sprint(verification.Bytes),
+		time.Duration(verification.Seconds * float64(time.Second)).Round(time.Millisecond).String(),
+		fmt.Sprintf("%.2f", verification.throughput()), verification.Checksum, verification.Error}
+}
+
+func (verification dataVerification) csvRow() []string {
+	return []string{verification.Key, fmt.Sprint(verification.Bytes), fmt.Sprintf("%.3f", verification.Seconds),
+		fmt.Sprintf("%.2f", verification.throughput()), verification.Checksum, verification.Error}
+}
+
+/*
+ * Reads every object stored under the timestamp and calls fn with the
+ * results in key order, each as soon as it and the objects before it were
+ * read. DownloadConcurrency objects are read at a time, each with a single
+ * ranged request at a time, which takes as much memory as one restore_data.
+ * An object that cannot be read or does not match its checksum is reported
+ * to fn and does not stop the verification of the others.
+ */
+func verifyBackupData(storage Storage, config *PluginConfig, timestamp string,
+	fn func(verification dataVerification) error) error {
+
+	objects, err := listBackupObjects(storage, backupPrefix(config.Options.Folder, timestamp))
+	if err != nil {
+		return err
+	}
+	if len(objects) == 0 {
+		return fmt.Errorf("Backup %s has no objects", timestamp)
+	}
+	names := make([]string, 0, len(objects))
+	for name := range objects {
+		if !isChecksumFile(name, objects) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	order := make(map[string]int, len(names))
+	for i, name := range names {
+		order[name] = i
+	}
+
+	objectConfig := *config
+	objectConfig.Options.DownloadConcurrency = 1
+	// Guards the results read ahead of the next one in key order
+	var mutex sync.Mutex
+	readAhead := make(map[int]dataVerification)
+	next := 0
+	var fnErr error
+	err = downloadInParallel(config.Options.DownloadConcurrency, func(queue func(fileKey string)) error {
+		for _, name := range names {
+			queue(name)
+		}
+		return nil
+	}, func(name string) error {
+		mutex.Lock()
+		failed := fnErr != nil
+		mutex.Unlock()
+		if failed {
+			return nil
+		}
+		_, hasSidecar := objects[checksumKey(name)]
+		verification := verifyBackupObject(storage, &objectConfig, objects[name].Key, hasSidecar)
+
+		mutex.Lock()
+		defer mutex.Unlock()
+		readAhead[order[name]] = verification
+		for fnErr == nil {
+			ready, ok := readAhead[next]
+			if !ok {
+				break
+			}
+			delete(readAhead, next)
+			next++
+			fnErr = fn(ready)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return fnErr
+}
+
+/*
+ * An object is only reported as verified once its data matched the digest of
+ * its checksum file, which restore checks for every object marked as having
+ * one. Otherwise the report says whether a checksum file is present.
+ */
+func verifyBackupObject(storage Storage, config *PluginConfig, fileKey string, hasSidecar bool) dataVerification {
+	verification := dataVerification{Key: fileKey, Checksum: "missing"}
+	if hasSidecar {
+		verification.Checksum = "present"
+	}
+	head, err := storage.Head(fileKey)
+	if err == nil {
+		var elapsed time.Duration
+		verification.Bytes, elapsed, err = downloadObject(storage, config, head, io.Discard)
+		verification.Seconds = elapsed.Seconds()
+	}
+	if err != nil {
+		verification.Bytes, verification.Seconds = 0, 0
+		verification.Error = err.Error()
+		gplog.Verbose("Unable to verify %s: %s", fileKey, err)
+	} else if hasSidecar && hasChecksum(head.Metadata) {
+		verification.Checksum = "verified"
+	}
+	return verification
+}
+
+func VerifyBackupData(c *cli.Context) error {
+	format := c.String("format")
+	if err := validateListFormat(format); err != nil {
+		return err
+	}
+	timestamp := c.Args().Get(1)
+	if !IsValidTimestamp(timestamp) {
+		return fmt.Errorf("verify_backup_data requires a <timestamp> with format "+
+			"YYYYMMDDHHMMSS, but received: %s", timestamp)
+	}
+	concurrency := c.Int("concurrency")
+	if concurrency < 0 {
+		return fmt.Errorf("Invalid --concurrency %d. It must be a positive number", concurrency)
+	}
+	config, storage, err := readConfigAndOpenStorage(c)
+	if err != nil {
+		return err
+	}
+	if concurrency > 0 {
+		config.Options.DownloadConcurrency = concurrency
+	}
+	// The objects read at a time take the memory of one transfer between them
+	release, err := beginTransfers(config, storage, RestoreTransfer, 1)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	start := time.Now()
+	writer := newListWriter(format, operating.System.Stdout, dataVerificationTableColumns, dataVerificationCSVColumns)
+	numObjects, numFailed, totalBytes := 0, 0, int64(0)
+	err = verifyBackupData(storage, config, timestamp, func(verification dataVerification) error {
+		numObjects++
+		totalBytes += verification.Bytes
+		if verification.Error != "" {
+			numFailed++
+		}
+		return writer.Write(verification)
+	})
+	if err != nil {
+		return err
+	}
+	if err = writer.Flush(); err != nil {
+		return err
+	}
+
+	elapsed := time.Since(start)
+	gplog.Info("Read %d objects (%d bytes) of backup %s in %v at %.2f MB/s with concurrency %d",
+		numObjects, totalBytes, timestamp, elapsed.Round(time.Millisecond),
+		float64(totalBytes)/elapsed.Seconds()/Mebibyte, config.Options.DownloadConcurrency)
+	if numFailed > 0 {
+		return fmt.Errorf("%d of %d objects of backup %s could not be read or verified", numFailed, numObjects, timestamp)
+	}
+	return nil
+}